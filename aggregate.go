@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AggregateStats summarises the numbers extracted from a set of values.
+// Min, max, avg and last are left out when nothing was counted.
+type AggregateStats struct {
+	Count       int      `json:"count"`
+	Sum         float64  `json:"sum"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Avg         *float64 `json:"avg,omitempty"`
+	Last        *float64 `json:"last,omitempty"` // from the most recently updated value
+	LastKey     string   `json:"last_key,omitempty"`
+	LastUpdated int64    `json:"last_updated,omitempty"`
+}
+
+func (s *AggregateStats) add(key string, n float64, updatedTime int64) {
+	s.Count++
+	s.Sum += n
+	if s.Min == nil || n < *s.Min {
+		s.Min = &n
+	}
+	if s.Max == nil || n > *s.Max {
+		s.Max = &n
+	}
+	if s.Last == nil || updatedTime >= s.LastUpdated {
+		s.Last, s.LastKey, s.LastUpdated = &n, key, updatedTime
+	}
+	avg := s.Sum / float64(s.Count)
+	s.Avg = &avg
+}
+
+// AggregateResult holds the totals, or the totals per group when grouped.
+// Skipped counts matching values no number could be extracted from.
+// TimedOut tells that the timeout ran out and only part of the keys were
+// counted.
+type AggregateResult struct {
+	*AggregateStats
+	Groups   map[string]*AggregateStats `json:"groups,omitempty"`
+	Skipped  int                        `json:"skipped"`
+	TimedOut bool                       `json:"timed_out,omitempty"`
+}
+
+// Aggregation selects values and how to read and group their numbers
+type Aggregation struct {
+	Pattern string        // key regex, optional
+	Prefix  string        // key prefix, optional
+	Field   string        // JSON path to the number, empty if the message is the number
+	GroupBy string        // topic pattern like /house/+/temperature, grouping by the + segment
+	Timeout time.Duration // bounds the scan like a query's, defaultQueryTimeout if zero
+}
+
+// groupPattern is a parsed GroupBy pattern
+type groupPattern struct {
+	segments []string
+	group    int // index of the segment that names the group
+	multi    bool
+}
+
+func parseGroupPattern(pattern string) (*groupPattern, error) {
+	gp := &groupPattern{segments: strings.Split(pattern, "/"), group: -1}
+	if last := len(gp.segments) - 1; gp.segments[last] == "#" {
+		gp.segments, gp.multi = gp.segments[:last], true
+	}
+	for i, segment := range gp.segments {
+		if segment == "+" {
+			gp.group = i
+			break
+		}
+	}
+	if gp.group < 0 {
+		return nil, fmt.Errorf("group_by needs a + segment: %s", pattern)
+	}
+	return gp, nil
+}
+
+// prefix returns the literal start of the pattern before the group segment,
+// empty when the pattern starts with it
+func (gp *groupPattern) prefix() string {
+	if gp.group == 0 {
+		return ""
+	}
+	return strings.Join(gp.segments[:gp.group], "/") + "/"
+}
+
+// match returns the group a key belongs to, if it matches the pattern
+func (gp *groupPattern) match(key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	if len(segments) < len(gp.segments) || (!gp.multi && len(segments) != len(gp.segments)) {
+		return "", false
+	}
+	for i, segment := range gp.segments {
+		if segment != "+" && segment != segments[i] {
+			return "", false
+		}
+	}
+	return segments[gp.group], true
+}
+
+// extractNumber reads a finite number from a JSON number or numeric string
+func extractNumber(value interface{}) (float64, bool) {
+	var n float64
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		n, err = v.Float64()
+	case string:
+		n, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+	default:
+		return 0, false
+	}
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n, true
+}
+
+// Aggregate computes count, sum, min, max, avg and last over the numbers in
+// the selected values, optionally per group. The scan is bounded by the
+// timeout like a query's, leaving the result partial and TimedOut set.
+func (b *Broker) Aggregate(a *Aggregation) (*AggregateResult, error) {
+	var re *regexp.Regexp
+	if a.Pattern != "" {
+		var err error
+		if re, err = regexp.Compile(a.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	var field jsonPath
+	if a.Field != "" {
+		var err error
+		if field, err = parseJSONPath(a.Field); err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := a.Prefix
+	var groups *groupPattern
+	if a.GroupBy != "" {
+		var err error
+		if groups, err = parseGroupPattern(a.GroupBy); err != nil {
+			return nil, err
+		}
+		if prefix == "" {
+			prefix = groups.prefix()
+		}
+	}
+
+	result := &AggregateResult{}
+	if groups != nil {
+		result.Groups = make(map[string]*AggregateStats)
+	} else {
+		result.AggregateStats = &AggregateStats{}
+	}
+
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+	if timeout > maxQueryTimeout {
+		timeout = maxQueryTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Scan the index in slices like a query so the deadline bounds the work
+	cursor := ""
+	for {
+		keys, next := b.db.scanKeys(prefix, cursor, re, 0, queryScanBatch)
+		for _, key := range keys {
+			b.aggregateKey(result, key, field, groups)
+		}
+		if next == "" {
+			return result, nil
+		}
+		cursor = next
+		if time.Now().After(deadline) {
+			result.TimedOut = true
+			return result, nil
+		}
+	}
+}
+
+// aggregateKey adds the number in one key's value to the result, under its
+// group when grouped
+func (b *Broker) aggregateKey(result *AggregateResult, key string, field jsonPath, groups *groupPattern) {
+	stats := result.AggregateStats
+	if groups != nil {
+		group, ok := groups.match(key)
+		if !ok {
+			return
+		}
+		if stats = result.Groups[group]; stats == nil {
+			stats = &AggregateStats{}
+			result.Groups[group] = stats
+		}
+	}
+
+	value, err := b.db.GetValue(key)
+	if err != nil {
+		return
+	}
+	var msg Message
+	if err := json.Unmarshal([]byte(value), &msg); err != nil {
+		result.Skipped++
+		return
+	}
+
+	var raw interface{} = msg.Message
+	if field != nil {
+		raw = nil
+		if doc, err := decodeJSON(msg.Message); err == nil {
+			if values := field.eval(doc); len(values) > 0 {
+				raw = values[0]
+			}
+		}
+	}
+	n, ok := extractNumber(raw)
+	if !ok {
+		result.Skipped++
+		return
+	}
+	stats.add(key, n, msg.UpdatedTime)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/sensors/a", "10", "", "test", 3)
+	b.PutValue("/sensors/b", " 2.5 ", "", "test", 5)
+	b.PutValue("/sensors/c", "-4", "", "test", 1)
+	b.PutValue("/sensors/d", "off", "", "test", 9)
+	b.PutValue("/other", "100", "", "test", 1)
+
+	result, err := b.Aggregate(&Aggregation{Prefix: "/sensors/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 3 || result.Sum != 8.5 || *result.Min != -4 || *result.Max != 10 || result.Skipped != 1 {
+		t.Errorf("got %+v", result.AggregateStats)
+	}
+	if *result.Last != 2.5 || result.LastKey != "/sensors/b" || result.LastUpdated != 5 {
+		t.Errorf("last is %v from %s", *result.Last, result.LastKey)
+	}
+
+	empty, _ := b.Aggregate(&Aggregation{Pattern: "^/nothing"})
+	if empty.Count != 0 || empty.Min != nil || empty.Avg != nil {
+		t.Errorf("aggregate of nothing is %+v", empty.AggregateStats)
+	}
+}
+
+func TestAggregateFieldAndGroups(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/house/kitchen/temp", `{"celsius":20}`, "", "test", 1)
+	b.PutValue("/house/kitchen/humidity", `{"celsius":99}`, "", "test", 1)
+	b.PutValue("/house/hall/temp", `{"celsius":"16"}`, "", "test", 1)
+	b.PutValue("/house/hall/temp/raw", `{"celsius":0}`, "", "test", 1)
+	b.PutValue("/house/attic/temp", `{"fahrenheit":50}`, "", "test", 1)
+
+	result, err := b.Aggregate(&Aggregation{Field: "celsius", GroupBy: "/house/+/temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Groups) != 3 || result.Groups["kitchen"].Sum != 20 || result.Groups["hall"].Sum != 16 || result.Groups["attic"].Count != 0 {
+		t.Errorf("got groups %+v", result.Groups)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("skipped %d values, want the one without the field", result.Skipped)
+	}
+
+	result, _ = b.Aggregate(&Aggregation{Field: "$.celsius", GroupBy: "/house/+/#"})
+	if result.Groups["hall"].Count != 2 || result.Groups["kitchen"].Count != 2 {
+		t.Errorf("multi-level groups are %+v", result.Groups)
+	}
+
+	if _, err := b.Aggregate(&Aggregation{GroupBy: "/house/kitchen"}); err == nil {
+		t.Error("group_by without a + accepted")
+	}
+	if _, err := b.Aggregate(&Aggregation{Pattern: "("}); err == nil {
+		t.Error("invalid regex accepted")
+	}
+}
+
+func TestAggregateGroupFirstSegment(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("kitchen/temp", "20", "", "test", 1)
+	b.PutValue("hall/temp", "16", "", "test", 1)
+
+	result, err := b.Aggregate(&Aggregation{GroupBy: "+/temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Groups) != 2 || result.Groups["kitchen"].Sum != 20 || result.Groups["hall"].Sum != 16 {
+		t.Errorf("got groups %+v", result.Groups)
+	}
+}
+
+func TestAggregateTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	for i := 0; i < 3*queryScanBatch; i++ {
+		b.PutValue(fmt.Sprintf("/k/%04d", i), "1", "", "test", 1)
+	}
+
+	result, err := b.Aggregate(&Aggregation{Prefix: "/k/", Timeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TimedOut || result.Count != queryScanBatch {
+		t.Errorf("got %d values counted, timed out %v, want the first slice only", result.Count, result.TimedOut)
+	}
+	if result, _ := b.Aggregate(&Aggregation{Prefix: "/k/"}); result.TimedOut || result.Count != 3*queryScanBatch {
+		t.Errorf("got %d values counted, timed out %v", result.Count, result.TimedOut)
+	}
+}
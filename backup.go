@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backups are kept as <backup dir>/<timestamp>/<tenant dir>/<store file>,
+// with tenant directories laid out as under the data directory
+const (
+	backupTimeFormat   = "20060102-150405"     // parses names with and without milliseconds
+	backupNameFormat   = "20060102-150405.000" // new backups, so two in one second don't collide
+	backupPagesPerStep = 256                   // SQLite pages copied before letting writers in
+	backupStepPause    = 10 * time.Millisecond // pause between steps
+)
+
+// backupStore is implemented by stores that can write a consistent copy of
+// themselves while in use
+type backupStore interface {
+	// Backup copies the store into dir under its usual file name
+	Backup(dir string) error
+}
+
+// BackupResult describes one backup run
+type BackupResult struct {
+	Name    string            `json:"name"`
+	Tenants []string          `json:"tenants"`
+	Failed  map[string]string `json:"failed,omitempty"`
+	Pruned  []string          `json:"pruned,omitempty"`
+}
+
+// Backup flushes pending writes and copies the store into dir
+func (d *Database) Backup(dir string) error {
+	store, ok := d.store.(backupStore)
+	if !ok {
+		return fmt.Errorf("backups are not supported by this storage backend")
+	}
+	if _, err := d.Flush(); err != nil {
+		return fmt.Errorf("failed to flush before backup: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return store.Backup(dir)
+}
+
+// Backup copies the database with SQLite's online backup API. Pages are
+// copied in steps so writers are only held up briefly; SQLite restarts the
+// copy by itself if the database changes in between.
+func (s *sqliteStore) Backup(dir string) error {
+	path := filepath.Join(dir, filepath.Base(s.path))
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup database: %w", err)
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open backup database: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+			for {
+				done, err := backup.Step(backupPagesPerStep)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("backup failed: %w", err)
+				}
+				if done {
+					break
+				}
+				time.Sleep(backupStepPause)
+			}
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("backup failed: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// Backup copies the complete batches of the log while holding off writes
+func (s *fileStore) Backup(dir string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	src, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open store file: %w", err)
+	}
+	defer src.Close()
+
+	return writeFileSync(filepath.Join(dir, filepath.Base(s.path)), io.LimitReader(src, s.size))
+}
+
+// writeFileSync writes r to path and syncs it to disk
+func writeFileSync(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// syncDir makes renames in dir durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// backupRoot returns the directory backups are kept in
+func backupRoot(dbConfig DatabaseConfig, dataDir string) string {
+	if dbConfig.BackupPath != "" {
+		return dbConfig.BackupPath
+	}
+	return filepath.Join(dataDir, "backups")
+}
+
+// ListBackups returns the names of completed backups, newest first
+func ListBackups(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && isBackupName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+func isBackupName(name string) bool {
+	_, err := time.ParseInLocation(backupTimeFormat, name, time.Local)
+	return err == nil
+}
+
+// storedTenants returns every tenant with a store file in the data directory
+func storedTenants(dbConfig DatabaseConfig, dataDir string) []string {
+	var tenants []string
+	hasStore := func(tenant string) bool {
+		name := storeFileName(dbConfig.BackendFor(tenant))
+		if name == "" {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(tenantDataDir(dataDir, tenant), name))
+		return err == nil
+	}
+
+	if hasStore("public") {
+		tenants = append(tenants, "public")
+	}
+	entries, _ := os.ReadDir(filepath.Join(dataDir, "users"))
+	for _, entry := range entries {
+		if entry.IsDir() && hasStore(entry.Name()) {
+			tenants = append(tenants, entry.Name())
+		}
+	}
+	return tenants
+}
+
+// Backup copies the given tenants, or every tenant with stored data when
+// none are given, into a new timestamped backup and prunes old backups.
+// Tenants that fail are reported in the result; the backup is only
+// dropped if none succeeded.
+func (bm *BrokerManager) Backup(tenants []string) (*BackupResult, error) {
+	bm.backupMu.Lock()
+	defer bm.backupMu.Unlock()
+
+	root := backupRoot(bm.dbConfig, bm.dataDir)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	result := &BackupResult{
+		Name:    time.Now().Format(backupNameFormat),
+		Tenants: []string{},
+		Failed:  make(map[string]string),
+	}
+	final := filepath.Join(root, result.Name)
+	for {
+		if _, err := os.Stat(final); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+		result.Name = time.Now().Format(backupNameFormat)
+		final = filepath.Join(root, result.Name)
+	}
+
+	// Write into a temporary directory so a backup is either complete or absent
+	tmp := final + ".tmp"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	if len(tenants) == 0 {
+		tenants = storedTenants(bm.dbConfig, bm.dataDir)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		if err := bm.backupTenant(tenant, tenantDataDir(tmp, tenant)); err != nil {
+			bm.logger.Printf("Backup of %s failed: %v", tenant, err)
+			result.Failed[tenant] = err.Error()
+			if broker := bm.allBrokers()[tenant]; broker != nil {
+				broker.LogUser("Backup failed: %v", err)
+				broker.PublishSystemMessage("/server/notification/backup_failed",
+					fmt.Sprintf("Backup failed: %v", err))
+			}
+			continue
+		}
+		result.Tenants = append(result.Tenants, tenant)
+	}
+	if len(result.Tenants) == 0 {
+		return result, fmt.Errorf("no tenant could be backed up")
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		return nil, fmt.Errorf("failed to complete backup: %w", err)
+	}
+	syncDir(root)
+	bm.logger.Printf("Backup %s written with %d tenants", result.Name, len(result.Tenants))
+
+	pruned, err := bm.pruneBackups(root, result.Name)
+	if err != nil {
+		bm.logger.Printf("Pruning backups failed: %v", err)
+	}
+	result.Pruned = pruned
+	return result, nil
+}
+
+// backupTenant copies one tenant's store into dir. Tenants without a
+// running broker are opened directly; GetOrCreateBroker waits for the copy
+// before loading such a tenant, while every other tenant carries on.
+func (bm *BrokerManager) backupTenant(tenant, dir string) error {
+	if broker := bm.allBrokers()[tenant]; broker != nil && broker.db != nil {
+		return broker.db.Backup(dir)
+	}
+
+	bm.mu.Lock()
+	if broker, loaded := bm.brokers[tenant]; loaded {
+		bm.mu.Unlock()
+		return broker.db.Backup(dir)
+	}
+	done := make(chan struct{})
+	bm.offlineBackups[tenant] = done
+	bm.mu.Unlock()
+
+	defer func() {
+		bm.mu.Lock()
+		delete(bm.offlineBackups, tenant)
+		bm.mu.Unlock()
+		close(done)
+	}()
+
+	if bm.dbConfig.BackendFor(tenant) == BackendMemory {
+		return fmt.Errorf("backups are not supported by this storage backend")
+	}
+	sourceDir := tenantDataDir(bm.dataDir, tenant)
+	if _, err := os.Stat(sourceDir); err != nil {
+		return fmt.Errorf("no data for tenant %s", tenant)
+	}
+
+	store, err := OpenStore(bm.dbConfig.BackendFor(tenant), sourceDir, bm.dbConfig.Sync)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	backup, ok := store.(backupStore)
+	if !ok {
+		return fmt.Errorf("backups are not supported by this storage backend")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return backup.Backup(dir)
+}
+
+// pruneBackups removes backups beyond BackupKeep and older than
+// BackupMaxAge, never the one just written, plus leftovers of failed runs
+func (bm *BrokerManager) pruneBackups(root, current string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			os.RemoveAll(filepath.Join(root, entry.Name()))
+		}
+	}
+
+	names, err := ListBackups(root)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	now := time.Now()
+	for i, name := range names {
+		if name == current {
+			continue
+		}
+		tooMany := bm.dbConfig.BackupKeep > 0 && i >= bm.dbConfig.BackupKeep
+		tooOld := false
+		if bm.dbConfig.BackupMaxAge > 0 {
+			taken, _ := time.ParseInLocation(backupTimeFormat, name, time.Local)
+			tooOld = now.Sub(taken) > bm.dbConfig.BackupMaxAge
+		}
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+			return pruned, fmt.Errorf("failed to remove backup %s: %w", name, err)
+		}
+		pruned = append(pruned, name)
+	}
+	if len(pruned) > 0 {
+		bm.logger.Printf("Pruned %d old backups", len(pruned))
+	}
+	return pruned, nil
+}
+
+// SuperviseBackups takes a backup of every tenant once per BackupInterval
+func (bm *BrokerManager) SuperviseBackups(ctx context.Context) {
+	interval := bm.dbConfig.BackupInterval
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := bm.Backup(nil); err != nil {
+				bm.logger.Printf("Scheduled backup failed: %v", err)
+			}
+		}
+	}
+}
+
+// RestoreTenant replaces a tenant's store with its copy in a backup, the
+// latest one holding the tenant if name is empty. The current store is
+// kept with a .pre-restore suffix. The server must not be running.
+func RestoreTenant(dbConfig DatabaseConfig, dataDir, tenant, name string) (string, error) {
+	fileName := storeFileName(dbConfig.BackendFor(tenant))
+	if fileName == "" {
+		return "", fmt.Errorf("backups are not supported by the %s backend", dbConfig.BackendFor(tenant))
+	}
+
+	root := backupRoot(dbConfig, dataDir)
+	names, err := ListBackups(root)
+	if err != nil {
+		return "", err
+	}
+
+	if name != "" && !contains(names, name) {
+		return "", fmt.Errorf("backup %s not found", name)
+	}
+
+	source := ""
+	for _, candidate := range names {
+		if name != "" && candidate != name {
+			continue
+		}
+		path := filepath.Join(tenantDataDir(filepath.Join(root, candidate), tenant), fileName)
+		if _, err := os.Stat(path); err == nil {
+			name, source = candidate, path
+			break
+		}
+	}
+	if source == "" {
+		if name != "" {
+			return "", fmt.Errorf("backup %s has no data for %s", name, tenant)
+		}
+		return "", fmt.Errorf("no backup has data for %s", tenant)
+	}
+
+	dir := tenantDataDir(dataDir, tenant)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer src.Close()
+
+	live := filepath.Join(dir, fileName)
+	if err := writeFileSync(live+".restore", src); err != nil {
+		os.Remove(live + ".restore")
+		return "", err
+	}
+	if _, err := os.Stat(live); err == nil {
+		if err := os.Rename(live, live+".pre-restore"); err != nil {
+			return "", fmt.Errorf("failed to keep current data: %w", err)
+		}
+	}
+	// A journal left next to the old database belongs to it, not to the restored one
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if _, err := os.Stat(live + suffix); err == nil {
+			os.Rename(live+suffix, live+".pre-restore"+suffix)
+		}
+	}
+	if err := os.Rename(live+".restore", live); err != nil {
+		return "", fmt.Errorf("failed to restore backup: %w", err)
+	}
+	syncDir(dir)
+	return name, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// newTestManager returns a broker manager over a fresh data directory with
+// one offline SQLite tenant, alice, holding /a
+func newTestManager(t *testing.T, dbConfig DatabaseConfig) *BrokerManager {
+	t.Helper()
+	dataDir := t.TempDir()
+	dbConfig.Backend = BackendSQLite
+	dbConfig.Sync = "normal"
+
+	dir := tenantDataDir(dataDir, "alice")
+	store, err := OpenStore(BackendSQLite, dir, dbConfig.Sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatabase(store, dir)
+	d.SaveValue("/a", "before")
+	if err := d.SaveAll(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	quotas, err := NewQuotaStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBrokerManager(log.New(io.Discard, "", 0), dataDir, false, dbConfig, quotas)
+}
+
+// loadTenant opens a tenant's database the way the export flag does
+func loadTenant(t *testing.T, bm *BrokerManager, tenant string) *Database {
+	t.Helper()
+	d, err := openTenantDatabase(bm.dbConfig, bm.dataDir, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	bm := newTestManager(t, DatabaseConfig{})
+
+	result, err := bm.Backup(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tenants) != 1 || result.Tenants[0] != "alice" || len(result.Failed) != 0 {
+		t.Fatalf("backup covered %v, failed %v", result.Tenants, result.Failed)
+	}
+
+	d := loadTenant(t, bm, "alice")
+	d.SaveValue("/a", "after")
+	d.SaveAll()
+	d.Close()
+
+	name, err := RestoreTenant(bm.dbConfig, bm.dataDir, "alice", "")
+	if err != nil || name != result.Name {
+		t.Fatalf("restored %s, %v, want %s", name, err, result.Name)
+	}
+	d = loadTenant(t, bm, "alice")
+	defer d.Close()
+	if value, _ := d.GetValue("/a"); value != `"before"` {
+		t.Errorf("restored value is %s, want the backed up one", value)
+	}
+}
+
+func TestBackupsInTheSameSecond(t *testing.T) {
+	bm := newTestManager(t, DatabaseConfig{BackupKeep: 2})
+
+	var names []string
+	for i := 0; i < 3; i++ {
+		result, err := bm.Backup([]string{"alice"})
+		if err != nil {
+			t.Fatalf("backup %d failed: %v", i, err)
+		}
+		names = append(names, result.Name)
+	}
+
+	listed, err := ListBackups(backupRoot(bm.dbConfig, bm.dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0] != names[2] || listed[1] != names[1] {
+		t.Errorf("kept backups %v, want the newest two of %v", listed, names)
+	}
+}
+
+func TestBackupNames(t *testing.T) {
+	for name, want := range map[string]bool{
+		"20250101-030000":         true,
+		"20250101-030000.123":     true,
+		"20250101-030000.123.tmp": false,
+		"latest":                  false,
+	} {
+		if got := isBackupName(name); got != want {
+			t.Errorf("isBackupName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestBackupUnknownTenant(t *testing.T) {
+	bm := newTestManager(t, DatabaseConfig{})
+	result, err := bm.Backup([]string{"bob"})
+	if err == nil || result.Failed["bob"] == "" {
+		t.Errorf("backup of a tenant without data got %+v, %v", result, err)
+	}
+	if _, err := RestoreTenant(bm.dbConfig, bm.dataDir, "alice", "19990101-000000"); err == nil {
+		t.Error("restore from a missing backup succeeded")
+	}
+}
+
+func TestOfflineBackupHoldsBackOnlyItsTenant(t *testing.T) {
+	bm := newTestManager(t, DatabaseConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := bm.InitializeDefault(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stand in for backupTenant copying alice
+	done := make(chan struct{})
+	bm.mu.Lock()
+	bm.offlineBackups["alice"] = done
+	bm.mu.Unlock()
+
+	loaded := make(chan *Broker)
+	go func() {
+		broker, _ := bm.GetOrCreateBroker("alice")
+		loaded <- broker
+	}()
+
+	if _, err := bm.GetOrCreateBroker("bob"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-loaded:
+		t.Fatal("tenant loaded while its backup was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bm.mu.Lock()
+	delete(bm.offlineBackups, "alice")
+	bm.mu.Unlock()
+	close(done)
+
+	select {
+	case broker := <-loaded:
+		if broker == nil || !broker.db.HasValue("/a") {
+			t.Error("tenant didn't load its data after the backup")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tenant still waiting after the backup")
+	}
+}
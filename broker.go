@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os/exec"
 	"regexp"
+	"regexp/syntax"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +27,8 @@ type Message struct {
 	UpdatedNiceDatetime string          `json:"updated_nicedatetime"`
 	Subscribers         map[string]bool `json:"subscribers"`
 	IP                  string          `json:"ip"`
+	Version             int64           `json:"version,omitempty"`
+	ExpiresAt           int64           `json:"expires_at,omitempty"`
 }
 
 // Client represents a connected subscriber
@@ -32,8 +39,57 @@ type Client struct {
 	LatestPickup             int64  `json:"LatestPickup"`
 	LatestPickupNiceDatetime string `json:"LatestPickupNiceDatetime"`
 	LatestSystemPickup       int64  `json:"LatestSystemPickup"`
+	SystemCursor             int64  `json:"SystemCursor"`
 	RequestCounter           int    `json:"RequestCounter"`
 	IP                       string `json:"IP"`
+	Paused                   bool   `json:"Paused"`
+	PauseMode                string `json:"PauseMode,omitempty"`
+	PausedUntil              int64  `json:"PausedUntil,omitempty"`
+	PausedUntilNiceDatetime  string `json:"PausedUntilNiceDatetime,omitempty"`
+}
+
+// systemMessage is an entry in the broker's system message log
+type systemMessage struct {
+	seq int64
+	msg *Message
+}
+
+// systemCursor is how far a client that isn't subscribed has read the
+// system message log, so it doesn't get the same messages again
+type systemCursor struct {
+	seq      int64
+	lastSeen int64
+}
+
+// Retention for system messages
+const (
+	maxSystemMessages         = 100
+	maxSystemMessageAge       = 1 * time.Hour
+	unknownClientSystemWindow = 5 * time.Minute // how far back unknown clients see system messages
+	maxSystemCursors          = 10000           // unknown clients whose system cursor is kept
+)
+
+// System topics announcing removed values
+const (
+	expiredValueTopic = "/server/notification/expired" // a key removed by its TTL
+	deletedValueTopic = "/server/notification/deleted" // JSON list of keys removed by DELVAL
+)
+
+// Pause modes decide what happens to messages published to a paused client
+const (
+	PauseModeBuffer = "buffer" // queue messages up to maxClientQueueSize
+	PauseModeDrop   = "drop"   // discard messages while paused
+)
+
+const (
+	defaultPauseDuration = 1 * time.Hour
+	maxPauseDuration     = 24 * time.Hour
+	maxClientQueueSize   = 10000 // messages buffered for a paused client
+)
+
+// isPaused reports whether delivery to the client is paused at the given time
+func (c *Client) isPaused(now int64) bool {
+	return c.Paused && now < c.PausedUntil
 }
 
 // Provider tracks message posters
@@ -62,6 +118,21 @@ type CrookInfo struct {
 	IsBanned           bool   `json:"IsBanned"`
 }
 
+// Limits on subscriptions, to keep a single tenant from stalling Publish
+const (
+	maxSubscribeTopics          = 100  // topics accepted in one SUBSCRIBE request
+	maxRegexSubscriptions       = 100  // distinct regex subscriptions per broker
+	maxRegexSubscriptionLength  = 256  // characters in a regex subscription
+	maxRegexSubscriptionProgram = 2000 // compiled instructions in a regex subscription
+	maxRegexMatchCacheSize      = 10000
+)
+
+// regexSubscription is a compiled regex subscription and its subscribers
+type regexSubscription struct {
+	re      *regexp.Regexp
+	clients []string
+}
+
 // Broker manages message routing and subscriptions
 type Broker struct {
 	mu                          sync.RWMutex
@@ -71,9 +142,13 @@ type Broker struct {
 	db                          *Database
 	debug                       bool
 	messageQueue                map[string]map[string][]*Message
-	systemMessageQueue          map[string][]*Message
+	systemMessageQueue          []*systemMessage
+	systemMessageSeq            int64
 	subscriptions               map[string][]string
+	regexSubscriptions          map[string]*regexSubscription
+	regexMatchCache             map[string][]string
 	clients                     map[string]*Client
+	systemCursors               map[string]*systemCursor // system cursors of unknown clients
 	providers                   map[string]*Provider
 	crooks                      map[string]*CrookInfo
 	topicExplosionCache         map[string][]string
@@ -94,6 +169,13 @@ type Broker struct {
 	minutePickupCountTimestamp  int64
 	minuteGetvalCountTimestamp  int64
 	messagesProcessed           int64
+	expiryNotifications         bool
+	watchers                    int // WATCHVAL waits in progress
+
+	// Quota, see quota.go. The database enforces the storage limits.
+	quota               Quota
+	quotaWindowStart    time.Time
+	quotaWindowMessages int
 }
 
 // NewBroker creates a new message broker
@@ -106,8 +188,11 @@ func NewBroker(logger *log.Logger, db *Database, debug bool) *Broker {
 		db:                  db,
 		debug:               debug,
 		messageQueue:        make(map[string]map[string][]*Message),
-		systemMessageQueue:  make(map[string][]*Message),
+		systemMessageQueue:  make([]*systemMessage, 0),
 		subscriptions:       make(map[string][]string),
+		regexSubscriptions:  make(map[string]*regexSubscription),
+		regexMatchCache:     make(map[string][]string),
+		systemCursors:       make(map[string]*systemCursor),
 		clients:             make(map[string]*Client),
 		providers:           make(map[string]*Provider),
 		crooks:              make(map[string]*CrookInfo),
@@ -126,6 +211,13 @@ func (b *Broker) SetUserLogger(userLogger *log.Logger, logPath string) {
 	b.userLogPath = logPath
 }
 
+// SetExpiryNotifications turns publishing of expired keys on expiredValueTopic on or off
+func (b *Broker) SetExpiryNotifications(enabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expiryNotifications = enabled
+}
+
 // LogUser logs to the user-specific log
 func (b *Broker) LogUser(format string, v ...interface{}) {
 	if b.userLogger != nil {
@@ -142,13 +234,54 @@ func (b *Broker) GetUserLogPath() string {
 
 // Subscribe adds a client subscription to a topic
 func (b *Broker) Subscribe(topic, clientName, ip string) error {
+	return b.SubscribeTopics([]string{topic}, false, clientName, ip)
+}
+
+// SubscribeTopics adds client subscriptions to several topics at once. When
+// regex is true every topic is a regular expression matched against the full
+// topic of each published message, the same way GETVALSBYREGEX matches keys.
+func (b *Broker) SubscribeTopics(topics []string, regex bool, clientName, ip string) error {
 	if clientName == "" {
 		return fmt.Errorf("client name cannot be empty")
 	}
+	if len(topics) == 0 {
+		return fmt.Errorf("no topics to subscribe to")
+	}
+	if len(topics) > maxSubscribeTopics {
+		return fmt.Errorf("too many topics in one request: %d (max %d)", len(topics), maxSubscribeTopics)
+	}
+
+	// Compile outside the lock, regexes can be slow to build
+	compiled := make(map[string]*regexp.Regexp)
+	if regex {
+		for _, pattern := range topics {
+			re, err := compileSubscriptionRegex(pattern)
+			if err != nil {
+				return err
+			}
+			compiled[pattern] = re
+		}
+	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if regex {
+		newPatterns := 0
+		for pattern := range compiled {
+			if _, exists := b.regexSubscriptions[pattern]; !exists {
+				newPatterns++
+			}
+		}
+		if len(b.regexSubscriptions)+newPatterns > maxRegexSubscriptions {
+			return fmt.Errorf("too many regex subscriptions (max %d)", maxRegexSubscriptions)
+		}
+	}
+
+	if err := b.checkSubscribeQuota(topics, regex, clientName); err != nil {
+		return err
+	}
+
 	now := time.Now().Unix()
 
 	if _, exists := b.clients[clientName]; !exists {
@@ -159,18 +292,37 @@ func (b *Broker) Subscribe(topic, clientName, ip string) error {
 			LatestPickup:             now,
 			LatestPickupNiceDatetime: formatNiceDateTime(now),
 			LatestSystemPickup:       now,
+			SystemCursor:             b.systemMessageSeq,
 			RequestCounter:           0,
 			IP:                       ip,
 		}
+		delete(b.systemCursors, clientName)
 		if b.debug {
 			b.logger.Printf("New client: %s from IP: %s", clientName, ip)
 		}
 		b.LogUser("New client: %s from IP: %s", clientName, ip)
 	}
 
-	if !contains(b.subscriptions[topic], clientName) {
-		b.subscriptions[topic] = append(b.subscriptions[topic], clientName)
-		b.LogUser("Client %s subscribed to topic: %s", clientName, topic)
+	for _, topic := range topics {
+		if regex {
+			sub, exists := b.regexSubscriptions[topic]
+			if !exists {
+				sub = &regexSubscription{re: compiled[topic]}
+				b.regexSubscriptions[topic] = sub
+				b.regexMatchCache = make(map[string][]string)
+			}
+			if !contains(sub.clients, clientName) {
+				sub.clients = append(sub.clients, clientName)
+				b.LogUser("Client %s subscribed to regex: %s", clientName, topic)
+			}
+		} else if !contains(b.subscriptions[topic], clientName) {
+			b.subscriptions[topic] = append(b.subscriptions[topic], clientName)
+			b.LogUser("Client %s subscribed to topic: %s", clientName, topic)
+		}
+
+		if b.debug {
+			b.logger.Printf("Added subscription %s for %s", topic, clientName)
+		}
 	}
 
 	if b.messageQueue[clientName] == nil {
@@ -182,18 +334,54 @@ func (b *Broker) Subscribe(topic, clientName, ip string) error {
 	client.LatestPickupNiceDatetime = formatNiceDateTime(now)
 	client.RequestCounter++
 
-	if b.debug {
-		b.logger.Printf("Added subscription %s for %s", topic, clientName)
+	return nil
+}
+
+// compileSubscriptionRegex compiles a regex subscription, rejecting patterns
+// that are too long or compile to too large a program
+func compileSubscriptionRegex(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("regex cannot be empty")
+	}
+	if len(pattern) > maxRegexSubscriptionLength {
+		return nil, fmt.Errorf("regex too long: %d characters (max %d)", len(pattern), maxRegexSubscriptionLength)
 	}
 
-	return nil
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	if len(prog.Inst) > maxRegexSubscriptionProgram {
+		return nil, fmt.Errorf("regex too complex: %d instructions (max %d)", len(prog.Inst), maxRegexSubscriptionProgram)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	return re, nil
 }
 
 // Publish publishes a message to a topic
 func (b *Broker) Publish(topic, message, from, ip string, updatedTime int64) error {
+	return b.PublishTTL(topic, message, from, ip, updatedTime, 0)
+}
+
+// PublishTTL publishes a message to a topic and keeps it as the topic's
+// stored value for ttl, zero meaning forever. A message over the tenant's
+// quota is neither delivered nor stored and gets a *QuotaExceededError.
+func (b *Broker) PublishTTL(topic, message, from, ip string, updatedTime int64, ttl time.Duration) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if err := b.checkMessageQuota(time.Now(), 1); err != nil {
+		return err
+	}
+
 	b.messagesProcessed++
 	b.messageCount++
 	if b.messageCount%1000 == 0 {
@@ -221,6 +409,17 @@ func (b *Broker) Publish(topic, message, from, ip string, updatedTime int64) err
 		IP:                  ip,
 	}
 
+	// Address the message before saving it so the stored value lists its
+	// subscribers, but queue it only once storage has taken it
+	to := b.address(topic, msg)
+	_, saveErr := b.db.SaveValueIf(topic, msg, ttl, nil)
+	var quotaErr *QuotaExceededError
+	if errors.As(saveErr, &quotaErr) {
+		return quotaErr
+	}
+	// Only messages the storage quota let through count against the rate
+	b.quotaWindowMessages++
+
 	provider, exists := b.providers[from]
 	if !exists {
 		provider = &Provider{
@@ -240,32 +439,170 @@ func (b *Broker) Publish(topic, message, from, ip string, updatedTime int64) err
 	provider.LatestPostNiceDatetime = formatNiceDateTime(updatedTime)
 	provider.MessageCount++
 
+	b.deliver(msg, to)
+
+	if saveErr != nil {
+		return fmt.Errorf("failed to save value: %w", saveErr)
+	}
+
+	b.recordSeries(topic, message, updatedTime)
+
+	return nil
+}
+
+// recipient is a client a message is queued for and the subscription it
+// matched
+type recipient struct {
+	client       string
+	subscription string
+}
+
+// address returns the clients subscribed to a message's topic by name,
+// wildcard or regex and marks them as its subscribers. A client matching
+// several subscriptions gets the message once, under the first one it
+// matched. Caller holds b.mu.
+func (b *Broker) address(topic string, msg *Message) []recipient {
 	topics := b.explodeTopic(topic)
 	topics = append(topics, "#")
 
+	var to []recipient
+	addressed := make(map[string]bool)
+	add := func(clientName, subscription string) {
+		if addressed[clientName] || !b.accepts(clientName) {
+			return
+		}
+		addressed[clientName] = true
+		to = append(to, recipient{client: clientName, subscription: subscription})
+		msg.Subscribers[clientName] = true
+	}
+
 	for _, wildcardTopic := range topics {
 
 		if clients, ok := b.subscriptions[wildcardTopic]; ok {
 
 			for _, clientName := range clients {
-				if b.messageQueue[clientName] == nil {
-					b.messageQueue[clientName] = make(map[string][]*Message)
-				}
-
-				b.messageQueue[clientName][wildcardTopic] = append(
-					b.messageQueue[clientName][wildcardTopic], msg)
-				msg.Subscribers[clientName] = true
+				add(clientName, wildcardTopic)
 			}
 		}
 	}
 
-	if err := b.db.SaveValue(topic, msg); err != nil {
-		return fmt.Errorf("failed to save value: %w", err)
+	for _, pattern := range b.matchRegexSubscriptions(topic) {
+		for _, clientName := range b.regexSubscriptions[pattern].clients {
+			add(clientName, pattern)
+		}
 	}
+	return to
+}
+
+// accepts reports whether a client takes a new message. Paused clients
+// either buffer up to maxClientQueueSize or drop it. Caller holds b.mu.
+func (b *Broker) accepts(clientName string) bool {
+	if client, exists := b.clients[clientName]; exists && client.isPaused(time.Now().Unix()) {
+		return client.PauseMode != PauseModeDrop && b.queuedMessages(clientName) < maxClientQueueSize
+	}
+	return true
+}
+
+// deliver queues a message for the recipients address returned. Caller
+// holds b.mu.
+func (b *Broker) deliver(msg *Message, to []recipient) {
+	for _, r := range to {
+		if b.messageQueue[r.client] == nil {
+			b.messageQueue[r.client] = make(map[string][]*Message)
+		}
 
+		b.messageQueue[r.client][r.subscription] = append(
+			b.messageQueue[r.client][r.subscription], msg)
+	}
+}
+
+// recordSeries records a published number as a point of its topic's time
+// series, if the topic is marked as one
+func (b *Broker) recordSeries(topic, message string, updatedTime int64) {
+	if n, ok := extractNumber(message); ok {
+		b.db.RecordSeries(topic, n, updatedTime)
+	}
+}
+
+// queuedMessages returns the number of messages waiting for a client
+func (b *Broker) queuedMessages(clientName string) int {
+	count := 0
+	for _, msgs := range b.messageQueue[clientName] {
+		count += len(msgs)
+	}
+	return count
+}
+
+// PauseClient stops delivery to a client without dropping its subscriptions.
+// Its queued messages are held back from pickups until it is resumed or the
+// pause expires, and it is not kicked for inactivity in the meantime.
+func (b *Broker) PauseClient(clientName, mode string, duration time.Duration) error {
+	if mode == "" {
+		mode = PauseModeBuffer
+	}
+	if mode != PauseModeBuffer && mode != PauseModeDrop {
+		return fmt.Errorf("invalid pause mode: %s", mode)
+	}
+	if duration <= 0 {
+		duration = defaultPauseDuration
+	}
+	if duration > maxPauseDuration {
+		return fmt.Errorf("pause duration too long: %v (max %v)", duration, maxPauseDuration)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, exists := b.clients[clientName]
+	if !exists {
+		return fmt.Errorf("unknown client: %s", clientName)
+	}
+
+	until := time.Now().Add(duration).Unix()
+	client.Paused = true
+	client.PauseMode = mode
+	client.PausedUntil = until
+	client.PausedUntilNiceDatetime = formatNiceDateTime(until)
+
+	b.LogUser("Paused client %s (%s) until %s", clientName, mode, client.PausedUntilNiceDatetime)
 	return nil
 }
 
+// ClientPaused reports whether delivery to a client is paused right now
+func (b *Broker) ClientPaused(clientName string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	client, exists := b.clients[clientName]
+	return exists && client.isPaused(time.Now().Unix())
+}
+
+// ResumeClient resumes delivery to a paused client
+func (b *Broker) ResumeClient(clientName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, exists := b.clients[clientName]
+	if !exists {
+		return fmt.Errorf("unknown client: %s", clientName)
+	}
+
+	b.resumeClient(client)
+	b.LogUser("Resumed client %s", clientName)
+	return nil
+}
+
+func (b *Broker) resumeClient(client *Client) {
+	now := time.Now().Unix()
+	client.Paused = false
+	client.PauseMode = ""
+	client.PausedUntil = 0
+	client.PausedUntilNiceDatetime = ""
+	// Restart the inactivity clock so the client isn't kicked right after a pause
+	client.LatestPickup = now
+	client.LatestPickupNiceDatetime = formatNiceDateTime(now)
+}
+
 // PublishSystemMessage publishes a system message that will be delivered to all clients
 func (b *Broker) PublishSystemMessage(topic, message string) {
 	b.mu.Lock()
@@ -282,7 +619,9 @@ func (b *Broker) PublishSystemMessage(topic, message string) {
 		IP:                  "127.0.0.1",
 	}
 
-	b.systemMessageQueue[topic] = append(b.systemMessageQueue[topic], msg)
+	b.systemMessageSeq++
+	b.systemMessageQueue = append(b.systemMessageQueue, &systemMessage{seq: b.systemMessageSeq, msg: msg})
+	b.trimSystemMessages(now)
 
 	if b.debug {
 		b.logger.Printf("Published system message to topic: %s", topic)
@@ -292,6 +631,16 @@ func (b *Broker) PublishSystemMessage(topic, message string) {
 
 // Pickup retrieves messages for a client
 func (b *Broker) Pickup(clientName, ip string) (map[string][]*Message, error) {
+	messages, _, err := b.PickupLimited(clientName, ip, 0, 0)
+	return messages, err
+}
+
+// PickupLimited retrieves at most maxMessages messages, or roughly maxBytes of
+// encoded messages, for a client and leaves the rest queued. Zero means no
+// limit. At least one message is always returned so a client can't get stuck
+// behind a single large message. It also returns the number of messages
+// still pending.
+func (b *Broker) PickupLimited(clientName, ip string, maxMessages, maxBytes int) (map[string][]*Message, int, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -302,9 +651,15 @@ func (b *Broker) Pickup(clientName, ip string) (map[string][]*Message, error) {
 	}
 	b.minutePickupCount++
 
-	normalMessages := b.messageQueue[clientName]
-
-	b.messageQueue[clientName] = make(map[string][]*Message)
+	// A paused client keeps its buffered messages until it is resumed or
+	// the pause runs out, only system messages get through
+	var normalMessages map[string][]*Message
+	var pending int
+	if client, exists := b.clients[clientName]; exists && client.isPaused(time.Now().Unix()) {
+		pending = b.queuedMessages(clientName)
+	} else {
+		normalMessages, pending = b.takeMessages(clientName, maxMessages, maxBytes)
+	}
 
 	systemMessages := b.getSystemMessages(clientName)
 
@@ -334,7 +689,116 @@ func (b *Broker) Pickup(clientName, ip string) (map[string][]*Message, error) {
 		}
 	}
 
-	return result, nil
+	return result, pending, nil
+}
+
+// takeMessages removes up to maxMessages/maxBytes messages from a client's
+// queue, oldest first across topics while keeping each topic in order, and
+// returns them with the number of messages left behind
+func (b *Broker) takeMessages(clientName string, maxMessages, maxBytes int) (map[string][]*Message, int) {
+	queue := b.messageQueue[clientName]
+
+	if maxMessages <= 0 && maxBytes <= 0 {
+		b.messageQueue[clientName] = make(map[string][]*Message)
+		return queue, 0
+	}
+
+	taken := make(map[string][]*Message)
+	count, size := 0, 0
+	for {
+		if maxMessages > 0 && count >= maxMessages {
+			break
+		}
+
+		// Pick the topic whose next message is the oldest
+		next := ""
+		for topic, msgs := range queue {
+			if len(msgs) == 0 {
+				continue
+			}
+			if next == "" || msgs[0].UpdatedTime < queue[next][0].UpdatedTime ||
+				(msgs[0].UpdatedTime == queue[next][0].UpdatedTime && topic < next) {
+				next = topic
+			}
+		}
+		if next == "" {
+			break
+		}
+
+		msg := queue[next][0]
+		if maxBytes > 0 {
+			encoded, err := json.Marshal(msg)
+			if err == nil {
+				if count > 0 && size+len(encoded) > maxBytes {
+					break
+				}
+				size += len(encoded)
+			}
+		}
+
+		taken[next] = append(taken[next], msg)
+		queue[next] = queue[next][1:]
+		if len(queue[next]) == 0 {
+			delete(queue, next)
+		}
+		count++
+	}
+
+	return taken, b.queuedMessages(clientName)
+}
+
+// QueuedMessage is a pending message together with the subscription it was queued under
+type QueuedMessage struct {
+	Subscription string `json:"subscription"`
+	*Message
+}
+
+// QueuePeek is a read-only view of the messages waiting for a client
+type QueuePeek struct {
+	Client   string           `json:"client"`
+	Total    int              `json:"total"`
+	Topics   map[string]int   `json:"topics"`
+	Messages []*QueuedMessage `json:"messages"`
+}
+
+// PeekQueue returns per-subscription counts and the oldest limit messages
+// queued for a client without removing them from the queue
+func (b *Broker) PeekQueue(clientName string, limit int) (*QueuePeek, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	queue, exists := b.messageQueue[clientName]
+	if !exists {
+		if _, known := b.clients[clientName]; !known {
+			return nil, fmt.Errorf("unknown client: %s", clientName)
+		}
+	}
+
+	peek := &QueuePeek{
+		Client:   clientName,
+		Topics:   make(map[string]int),
+		Messages: []*QueuedMessage{},
+	}
+
+	for subscription, msgs := range queue {
+		peek.Topics[subscription] = len(msgs)
+		peek.Total += len(msgs)
+		for _, msg := range msgs {
+			peek.Messages = append(peek.Messages, &QueuedMessage{Subscription: subscription, Message: msg})
+		}
+	}
+
+	sort.SliceStable(peek.Messages, func(i, j int) bool {
+		if peek.Messages[i].UpdatedTime != peek.Messages[j].UpdatedTime {
+			return peek.Messages[i].UpdatedTime < peek.Messages[j].UpdatedTime
+		}
+		return peek.Messages[i].Subscription < peek.Messages[j].Subscription
+	})
+	if limit > 0 && len(peek.Messages) > limit {
+		peek.Messages = peek.Messages[:limit]
+	}
+
+	return peek, nil
 }
 
 // GetValue retrieves a stored value by key
@@ -349,7 +813,7 @@ func (b *Broker) GetValue(key string) (*Message, error) {
 	}
 	b.minuteGetvalCount++
 
-	value, err := b.db.GetValue(key)
+	value, version, err := b.db.GetValueWithVersion(key)
 	if err != nil {
 		return nil, err
 	}
@@ -358,25 +822,38 @@ func (b *Broker) GetValue(key string) (*Message, error) {
 	if err := json.Unmarshal([]byte(value), &msg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal value: %w", err)
 	}
+	msg.Version = version
 
 	return &msg, nil
 }
 
 // GetValuesByRegex retrieves values matching a regex pattern
 func (b *Broker) GetValuesByRegex(pattern string) (map[string]*Message, error) {
+	values, _, err := b.GetValuesPage(pattern, "", "", 0)
+	return values, err
+}
+
+// GetValuesPage retrieves values whose keys start with prefix and match
+// pattern, either of which may be empty, in key order after cursor. With
+// limit > 0 it returns at most limit values and the cursor of the next page.
+func (b *Broker) GetValuesPage(pattern, prefix, cursor string, limit int) (map[string]*Message, string, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, fmt.Errorf("invalid regex: %w", err)
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid regex: %w", err)
+		}
 	}
 
-	keys := b.db.GetKeysByRegex(re)
+	keys, next := b.db.ScanKeys(prefix, cursor, re, limit)
 	result := make(map[string]*Message)
 
 	for _, key := range keys {
-		value, err := b.db.GetValue(key)
+		value, version, err := b.db.GetValueWithVersion(key)
 		if err != nil {
 			continue
 		}
@@ -385,15 +862,158 @@ func (b *Broker) GetValuesByRegex(pattern string) (map[string]*Message, error) {
 		if err := json.Unmarshal([]byte(value), &msg); err != nil {
 			continue
 		}
+		msg.Version = version
+
+		result[key] = &msg
+	}
+
+	return result, next, nil
+}
+
+// maxWatchers caps the watches of a tenant waiting at once, each holding
+// one of the server's connections
+const maxWatchers = 100
+
+// errTooManyWatchers is returned when a tenant already has maxWatchers
+// watches waiting
+var errTooManyWatchers = errors.New("too many watchers")
+
+// startWatch counts a watch that is about to wait, or returns
+// errTooManyWatchers
+func (b *Broker) startWatch() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watchers >= maxWatchers {
+		return errTooManyWatchers
+	}
+	b.watchers++
+	return nil
+}
+
+// endWatch stops counting a watch startWatch let through
+func (b *Broker) endWatch() {
+	b.mu.Lock()
+	b.watchers--
+	b.mu.Unlock()
+}
+
+// WatchValue waits until key is at another version than since, or ctx is
+// done. It returns the current value, nil if the key doesn't exist, its
+// version and whether it changed.
+func (b *Broker) WatchValue(ctx context.Context, key string, since int64) (*Message, int64, bool, error) {
+	if err := b.startWatch(); err != nil {
+		return nil, 0, false, err
+	}
+	defer b.endWatch()
+
+	value, version, changed := b.db.WatchValue(ctx, key, since)
+	if version == 0 {
+		return nil, 0, changed, nil
+	}
+
+	var msg Message
+	if err := json.Unmarshal([]byte(value), &msg); err != nil {
+		return nil, 0, false, fmt.Errorf("failed to unmarshal value: %w", err)
+	}
+	msg.Version = version
+	return &msg, version, changed, nil
+}
+
+// WatchValuesByRegex waits until keys matching pattern are written after
+// the write sequence number since, or ctx is done. It returns those values
+// and the sequence number to pass on the next call.
+func (b *Broker) WatchValuesByRegex(ctx context.Context, pattern string, since int64) (map[string]*Message, int64, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid regex: %w", err)
+	}
+	if err := b.startWatch(); err != nil {
+		return nil, 0, err
+	}
+	defer b.endWatch()
 
+	rows, seq := b.db.WatchKeys(ctx, re, since)
+	result := make(map[string]*Message, len(rows))
+	for key, row := range rows {
+		var msg Message
+		if err := json.Unmarshal([]byte(row.Value), &msg); err != nil {
+			continue
+		}
+		msg.Version = row.Version
 		result[key] = &msg
 	}
+	return result, seq, nil
+}
+
+// ValueHistoryEntry is one recorded write of a stored value
+type ValueHistoryEntry struct {
+	Version             int64    `json:"version"`
+	From                string   `json:"from"`
+	UpdatedTime         int64    `json:"updated_time"`
+	UpdatedNiceDatetime string   `json:"updated_nicedatetime"`
+	Value               *Message `json:"value"`
+}
+
+// GetValueHistory returns the latest limit writes of a key, newest first
+func (b *Broker) GetValueHistory(key string, limit int) ([]*ValueHistoryEntry, error) {
+	records, err := b.db.GetHistory(key, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*ValueHistoryEntry, 0, len(records))
+	for _, record := range records {
+		var msg Message
+		if err := json.Unmarshal([]byte(record.Value), &msg); err != nil {
+			continue
+		}
+		history = append(history, &ValueHistoryEntry{
+			Version:             record.Version,
+			From:                record.From,
+			UpdatedTime:         record.UpdatedTime,
+			UpdatedNiceDatetime: formatNiceDateTime(record.UpdatedTime),
+			Value:               &msg,
+		})
+	}
+	return history, nil
+}
 
-	return result, nil
+// GetValueAt returns the value a key had at the given unix time
+func (b *Broker) GetValueAt(key string, at int64) (*Message, error) {
+	record, err := b.db.GetValueAt(key, at)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalHistoryRecord(record)
+}
+
+// GetValueVersion returns a specific recorded version of a key
+func (b *Broker) GetValueVersion(key string, version int64) (*Message, error) {
+	record, err := b.db.GetValueVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalHistoryRecord(record)
+}
+
+func unmarshalHistoryRecord(record *HistoryRecord) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal([]byte(record.Value), &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal value: %w", err)
+	}
+	return &msg, nil
 }
 
 // PutValue stores a value
 func (b *Broker) PutValue(valname, val, message, from string, updatedTime int64) error {
+	_, err := b.PutValueIf(valname, val, message, from, updatedTime, 0, nil)
+	return err
+}
+
+// PutValueIf stores a value if cond holds (nil means unconditionally) and
+// returns its new version. A ttl above zero makes the value expire. On a
+// mismatch it returns a *VersionConflictError carrying the current version.
+func (b *Broker) PutValueIf(valname, val, message, from string, updatedTime int64, ttl time.Duration, cond *WriteCondition) (int64, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -408,7 +1028,201 @@ func (b *Broker) PutValue(valname, val, message, from string, updatedTime int64)
 		From:                from,
 	}
 
-	return b.db.SaveValue(valname, msg)
+	return b.db.SaveValueIf(valname, msg, ttl, cond)
+}
+
+// IncrValue atomically adds delta to an integer value, starting from 0 if
+// the key is missing, and returns the new value and version
+func (b *Broker) IncrValue(key string, delta int64, from string, updatedTime int64) (string, int64, error) {
+	return b.incrValue(key, from, updatedTime, func(current string) (string, error) {
+		n := int64(0)
+		if current != "" {
+			var err error
+			if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+				return "", fmt.Errorf("not an integer: %q", current)
+			}
+		}
+		sum := n + delta
+		if (delta > 0 && sum < n) || (delta < 0 && sum > n) {
+			return "", fmt.Errorf("integer overflow")
+		}
+		return strconv.FormatInt(sum, 10), nil
+	})
+}
+
+// IncrValueFloat atomically adds delta to a floating point value, starting
+// from 0 if the key is missing, and returns the new value and version
+func (b *Broker) IncrValueFloat(key string, delta float64, from string, updatedTime int64) (string, int64, error) {
+	return b.incrValue(key, from, updatedTime, func(current string) (string, error) {
+		f := 0.0
+		if current != "" {
+			var err error
+			if f, err = strconv.ParseFloat(current, 64); err != nil {
+				return "", fmt.Errorf("not a number: %q", current)
+			}
+		}
+		sum := f + delta
+		if math.IsInf(sum, 0) || math.IsNaN(sum) {
+			return "", fmt.Errorf("float overflow")
+		}
+		return strconv.FormatFloat(sum, 'f', -1, 64), nil
+	})
+}
+
+// incrValue replaces a value with add(current) under the database lock. An
+// error from add is returned as an *InvalidValueError.
+func (b *Broker) incrValue(key, from string, updatedTime int64, add func(current string) (string, error)) (string, int64, error) {
+	var result string
+	version, err := b.db.UpdateValue(key, func(current string, exists bool) (interface{}, error) {
+		var msg Message
+		if exists {
+			if err := json.Unmarshal([]byte(current), &msg); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal value: %w", err)
+			}
+		}
+
+		value, err := add(strings.TrimSpace(msg.Message))
+		if err != nil {
+			return nil, &InvalidValueError{Key: key, Reason: err.Error()}
+		}
+		result = value
+
+		return &Message{
+			Message:             value,
+			UpdatedTime:         updatedTime,
+			UpdatedNiceDatetime: formatNiceDateTime(updatedTime),
+			From:                from,
+		}, nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return result, version, nil
+}
+
+// PatchValue applies a JSON merge patch or JSON patch to the JSON document
+// stored under key, atomically under the database lock, and delivers the
+// result to subscribers like a published message, counting against the
+// message quota. It returns the patched document and its version.
+func (b *Broker) PatchValue(key, patch, format, from, ip string, updatedTime int64) (string, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkMessageQuota(time.Now(), 1); err != nil {
+		return "", 0, err
+	}
+	if from == "" {
+		from = "UNKNOWN"
+	}
+
+	var msg *Message
+	var to []recipient
+	version, err := b.db.UpdateValue(key, func(current string, exists bool) (interface{}, error) {
+		if !exists {
+			return nil, errKeyNotFound
+		}
+		var stored Message
+		if err := json.Unmarshal([]byte(current), &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+
+		doc, err := decodeJSON(stored.Message)
+		if err != nil {
+			return nil, &InvalidValueError{Key: key, Reason: fmt.Sprintf("stored value is not JSON: %v", err)}
+		}
+		doc, err = applyPatch(doc, patch, format)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := encodeJSON(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal patched value: %w", err)
+		}
+
+		msg = &Message{
+			From:                from,
+			Topic:               key,
+			Message:             patched,
+			UpdatedTime:         updatedTime,
+			UpdatedNiceDatetime: formatNiceDateTime(updatedTime),
+			Subscribers:         make(map[string]bool),
+			IP:                  ip,
+		}
+		to = b.address(key, msg)
+		return msg, nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	b.quotaWindowMessages++
+
+	b.LogUser("Patched %s from %s (IP: %s)", key, from, ip)
+	b.deliver(msg, to)
+	b.recordSeries(key, msg.Message, updatedTime)
+	return msg.Message, version, nil
+}
+
+// ExportValues calls fn for every stored value in key order
+func (b *Broker) ExportValues(fn func(record *ExportRecord) error) error {
+	return b.db.Export(fn)
+}
+
+// ImportValues imports validated export records, see Database.Import
+func (b *Broker) ImportValues(records []*ExportRecord, mode string) (int, error) {
+	count, err := b.db.Import(records, mode)
+	if err != nil {
+		b.LogUser("Import failed after %d values: %v", count, err)
+		return count, err
+	}
+	b.LogUser("Imported %d values (%s)", count, mode)
+	return count, nil
+}
+
+// DeleteValue removes a stored value and reports whether it existed. With
+// dryRun nothing is removed.
+func (b *Broker) DeleteValue(key, from string, dryRun bool) bool {
+	if dryRun {
+		return b.db.HasValue(key)
+	}
+	// Only the delete that removed the key reports it and announces it
+	return len(b.deleteValues([]string{key}, from, false)) > 0
+}
+
+// DeleteValuesByRegex removes every value whose key matches pattern and
+// returns the removed keys. With dryRun it only returns what would go.
+func (b *Broker) DeleteValuesByRegex(pattern, from string, dryRun bool) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	return b.deleteValues(b.db.GetKeysByRegex(re), from, dryRun), nil
+}
+
+// DeleteValuesByPrefix removes every value whose key starts with prefix
+// and returns the removed keys. With dryRun it only returns what would go.
+func (b *Broker) DeleteValuesByPrefix(prefix, from string, dryRun bool) []string {
+	return b.deleteValues(b.db.GetKeysByPrefix(prefix), from, dryRun)
+}
+
+// deleteValues removes keys from the store and publishes the removed ones
+// on deletedValueTopic
+func (b *Broker) deleteValues(keys []string, from string, dryRun bool) []string {
+	if !dryRun {
+		keys = b.db.DeleteValues(keys)
+	}
+	sort.Strings(keys)
+	if dryRun || len(keys) == 0 {
+		return keys
+	}
+
+	if from == "" {
+		from = "UNKNOWN"
+	}
+	b.LogUser("Deleted %d values for %s", len(keys), from)
+
+	event, _ := json.Marshal(keys)
+	b.PublishSystemMessage(deletedValueTopic, string(event))
+	return keys
 }
 
 // GetStats returns broker statistics
@@ -441,8 +1255,10 @@ func (b *Broker) GetStats() map[string]interface{} {
 
 	// Count stored values
 	valuesCount := 0
+	unflushedCount := 0
 	if b.db != nil {
 		valuesCount = b.db.CountValues()
+		unflushedCount = b.db.UnflushedCount()
 	}
 
 	// Calculate per-second rates for last minute with safety checks to avoid division by zero
@@ -467,9 +1283,12 @@ func (b *Broker) GetStats() map[string]interface{} {
 		"started":              formatNiceDateTime(b.startedTime),
 		"memory_usage":         "N/A",
 		"subscription_count":   len(b.subscriptions),
+		"regex_subscriptions":  len(b.regexSubscriptions),
+		"system_messages":      len(b.systemMessageQueue),
 		"goroutines":           numGoroutines,
 		"average_request_time": b.serveTime / float64(b.requestCount),
 		"values":               valuesCount,
+		"unflushed_values":     unflushedCount,
 		"clients": map[string]interface{}{
 			"subscribers": len(b.messageQueue),
 			"posters":     len(b.providers),
@@ -502,6 +1321,14 @@ func (b *Broker) explodeTopic(topic string) []string {
 		return cached
 	}
 
+	result := explodeTopicPatterns(topic)
+	b.topicExplosionCache[topic] = result
+	return result
+}
+
+// explodeTopicPatterns returns the wildcard subscriptions matching topic,
+// uncached
+func explodeTopicPatterns(topic string) []string {
 	var patterns []string
 	sections := strings.Split(topic, "/")
 
@@ -548,39 +1375,126 @@ func (b *Broker) explodeTopic(topic string) []string {
 	// Perl pushar in i början, så vi måste prependa
 	result := []string{}
 	result = append(result, patterns...)
-
-	b.topicExplosionCache[topic] = result
 	return result
 }
 
+// matchRegexSubscriptions returns the regex subscriptions matching a topic.
+// Results are cached per topic until the set of regex subscriptions changes.
+func (b *Broker) matchRegexSubscriptions(topic string) []string {
+	if len(b.regexSubscriptions) == 0 {
+		return nil
+	}
+	if cached, exists := b.regexMatchCache[topic]; exists {
+		return cached
+	}
+
+	var matches []string
+	for pattern, sub := range b.regexSubscriptions {
+		if sub.re.MatchString(topic) {
+			matches = append(matches, pattern)
+		}
+	}
+
+	if len(b.regexMatchCache) >= maxRegexMatchCacheSize {
+		b.regexMatchCache = make(map[string][]string)
+	}
+	b.regexMatchCache[topic] = matches
+	return matches
+}
+
+// getSystemMessages returns the system messages a client hasn't seen yet and
+// advances its cursor. Unknown clients have no cursor and only get the
+// messages published within unknownClientSystemWindow.
 func (b *Broker) getSystemMessages(clientName string) map[string][]*Message {
 	result := make(map[string][]*Message)
 
+	var pending []*systemMessage
 	client, exists := b.clients[clientName]
 	if !exists {
-		// Okänd klient - ge alla systemmeddelanden
-		if b.debug {
-			b.logger.Printf("getSystemMessages: unknown client %s, returning all system messages", clientName)
+		// An unknown client gets the recent messages on its first pickup and
+		// only newer ones after that
+		now := time.Now()
+		cursor, known := b.systemCursors[clientName]
+		if known {
+			start := sort.Search(len(b.systemMessageQueue), func(i int) bool {
+				return b.systemMessageQueue[i].seq > cursor.seq
+			})
+			pending = b.systemMessageQueue[start:]
+		} else {
+			if b.debug {
+				b.logger.Printf("getSystemMessages: unknown client %s, returning recent system messages", clientName)
+			}
+			since := now.Add(-unknownClientSystemWindow).Unix()
+			start := sort.Search(len(b.systemMessageQueue), func(i int) bool {
+				return b.systemMessageQueue[i].msg.UpdatedTime >= since
+			})
+			pending = b.systemMessageQueue[start:]
+		}
+		if known || len(b.systemCursors) < maxSystemCursors {
+			b.systemCursors[clientName] = &systemCursor{seq: b.systemMessageSeq, lastSeen: now.Unix()}
 		}
-		return b.systemMessageQueue
+	} else {
+		start := sort.Search(len(b.systemMessageQueue), func(i int) bool {
+			return b.systemMessageQueue[i].seq > client.SystemCursor
+		})
+		pending = b.systemMessageQueue[start:]
+		client.SystemCursor = b.systemMessageSeq
 	}
 
-	getThoseNewerThan := client.LatestSystemPickup
-	client.LatestSystemPickup = time.Now().Unix()
+	for _, entry := range pending {
+		result[entry.msg.Topic] = append(result[entry.msg.Topic], entry.msg)
+	}
 
-	for topic, messages := range b.systemMessageQueue {
-		var deliver []*Message
-		for _, msg := range messages {
-			if msg.UpdatedTime > getThoseNewerThan {
-				deliver = append(deliver, msg)
-			}
-		}
-		if len(deliver) > 0 {
-			result[topic] = deliver
+	return result
+}
+
+// trimSystemMessages drops system messages older than maxSystemMessageAge
+// and keeps at most maxSystemMessages
+func (b *Broker) trimSystemMessages(now int64) {
+	drop := 0
+	if len(b.systemMessageQueue) > maxSystemMessages {
+		drop = len(b.systemMessageQueue) - maxSystemMessages
+	}
+	cutoff := now - int64(maxSystemMessageAge.Seconds())
+	for drop < len(b.systemMessageQueue) && b.systemMessageQueue[drop].msg.UpdatedTime < cutoff {
+		drop++
+	}
+	if drop > 0 {
+		b.systemMessageQueue = append([]*systemMessage(nil), b.systemMessageQueue[drop:]...)
+	}
+}
+
+// expireValues removes values whose TTL has run out and, when enabled,
+// announces each removed key on expiredValueTopic
+func (b *Broker) expireValues() {
+	b.db.ExpireValues()
+
+	b.mu.RLock()
+	notify := b.expiryNotifications
+	b.mu.RUnlock()
+
+	for _, key := range b.db.TakeExpired() {
+		b.LogUser("Value %s expired", key)
+		if notify {
+			b.PublishSystemMessage(expiredValueTopic, key)
 		}
 	}
+}
 
-	return result
+func (b *Broker) clearOldSystemMessages() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	b.trimSystemMessages(now)
+
+	// Past the age of the oldest system message a cursor holds nothing back
+	cutoff := now - int64(maxSystemMessageAge.Seconds())
+	for clientName, cursor := range b.systemCursors {
+		if cursor.lastSeen < cutoff {
+			delete(b.systemCursors, clientName)
+		}
+	}
 }
 
 // StartMaintenance starts background maintenance tasks
@@ -601,12 +1515,17 @@ func (b *Broker) StartMaintenance(ctx context.Context) {
 			return
 		case <-ticker.C:
 			counter++
+			b.expireValues()
 			if counter%4 == 0 {
 				if b.debug {
 					b.logger.Printf("Running maintenance cycle %d", counter)
 				}
 				b.kickInactiveClients()
 				b.clearOldPosters()
+				b.clearOldSystemMessages()
+				if err := b.db.PruneSeries(); err != nil {
+					b.logger.Printf("Pruning time series failed: %v", err)
+				}
 			}
 		}
 	}
@@ -620,6 +1539,13 @@ func (b *Broker) kickInactiveClients() {
 	toKick := []string{} // Samla först, kicka sedan
 
 	for clientName, client := range b.clients {
+		if client.Paused {
+			if client.isPaused(now) {
+				continue
+			}
+			b.resumeClient(client)
+			b.LogUser("Pause expired for client %s", clientName)
+		}
 		if now-client.LatestPickup > int64(b.messageQueueTimeout.Seconds()) {
 			toKick = append(toKick, clientName)
 		}
@@ -638,6 +1564,18 @@ func (b *Broker) kickInactiveClients() {
 				delete(b.subscriptions, topic)
 			}
 		}
+		for pattern, sub := range b.regexSubscriptions {
+			sub.clients = removeString(sub.clients, clientName)
+			if len(sub.clients) == 0 {
+				delete(b.regexSubscriptions, pattern)
+				b.regexMatchCache = make(map[string][]string)
+			}
+		}
+
+		// Keep its place in the system messages in case it comes back unsubscribed
+		if len(b.systemCursors) < maxSystemCursors {
+			b.systemCursors[clientName] = &systemCursor{seq: b.clients[clientName].SystemCursor, lastSeen: now}
+		}
 
 		delete(b.messageQueue, clientName)
 		delete(b.clients, clientName)
@@ -702,6 +1640,15 @@ func (b *Broker) GetTopics() []string {
 	return b.db.GetKeys()
 }
 
+// GetTopicsPage returns topics starting with prefix in order after cursor.
+// With limit > 0 it returns at most limit topics and the cursor of the next page.
+func (b *Broker) GetTopicsPage(prefix, cursor string, limit int) ([]string, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.db.ScanKeys(prefix, cursor, nil, limit)
+}
+
 // RecordInvalidRequest records an invalid request from an IP and bans if needed
 func (b *Broker) RecordInvalidRequest(ip string) {
 	b.mu.Lock()
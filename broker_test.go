@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBroker returns a broker on an in-memory database
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	return NewBroker(log.New(io.Discard, "", 0), NewDatabase(newMemoryStore(), t.Name()), false)
+}
+
+// countMessages returns the number of messages in a pickup result
+func countMessages(messages map[string][]*Message) int {
+	count := 0
+	for _, msgs := range messages {
+		count += len(msgs)
+	}
+	return count
+}
+
+func TestPublishDeliversOncePerClient(t *testing.T) {
+	b := newTestBroker(t)
+	if err := b.SubscribeTopics([]string{"/sensors/temp", "/sensors/+"}, false, "c1", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SubscribeTopics([]string{"^/sensors/"}, true, "c1", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe("/sensors/temp", "c2", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("/sensors/temp", "21", "test", "127.0.0.1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []string{"c1", "c2"} {
+		messages, err := b.Pickup(client, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countMessages(messages); n != 1 {
+			t.Errorf("%s got %d messages, want 1: %v", client, n, messages)
+		}
+	}
+}
+
+func TestPauseBufferHoldsMessagesUntilResume(t *testing.T) {
+	b := newTestBroker(t)
+	if err := b.Subscribe("/jobs", "worker", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PauseClient("worker", PauseModeBuffer, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !b.ClientPaused("worker") {
+		t.Fatal("client not paused")
+	}
+
+	b.Publish("/jobs", "one", "test", "127.0.0.1", 1)
+	b.PublishSystemMessage("/server/notice", "hello")
+
+	messages, pending, err := b.PickupLimited("worker", "127.0.0.1", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages["/jobs"]) != 0 || pending != 1 {
+		t.Errorf("paused pickup got %v with %d pending, want nothing with 1 pending", messages["/jobs"], pending)
+	}
+	if len(messages["/server/notice"]) != 1 {
+		t.Errorf("paused pickup got %d system messages, want 1", len(messages["/server/notice"]))
+	}
+
+	if err := b.ResumeClient("worker"); err != nil {
+		t.Fatal(err)
+	}
+	messages, pending, _ = b.PickupLimited("worker", "127.0.0.1", 0, 0)
+	if len(messages["/jobs"]) != 1 || pending != 0 {
+		t.Errorf("resumed pickup got %v with %d pending, want 1 message", messages["/jobs"], pending)
+	}
+}
+
+func TestPauseDropDiscardsMessages(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/jobs", "worker", "127.0.0.1")
+	if err := b.PauseClient("worker", PauseModeDrop, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Publish("/jobs", "one", "test", "127.0.0.1", 1)
+	b.ResumeClient("worker")
+	b.Publish("/jobs", "two", "test", "127.0.0.1", 2)
+
+	messages, _ := b.Pickup("worker", "127.0.0.1")
+	if msgs := messages["/jobs"]; len(msgs) != 1 || msgs[0].Message != "two" {
+		t.Errorf("got %v, want only the message published after resuming", msgs)
+	}
+}
+
+func TestPauseExpires(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/jobs", "worker", "127.0.0.1")
+	b.PauseClient("worker", PauseModeBuffer, time.Hour)
+	b.Publish("/jobs", "one", "test", "127.0.0.1", 1)
+
+	b.mu.Lock()
+	b.clients["worker"].PausedUntil = time.Now().Unix() - 1
+	b.mu.Unlock()
+
+	if b.ClientPaused("worker") {
+		t.Error("client still paused after the pause ran out")
+	}
+	messages, _ := b.Pickup("worker", "127.0.0.1")
+	if len(messages["/jobs"]) != 1 {
+		t.Errorf("got %v after the pause ran out, want the buffered message", messages["/jobs"])
+	}
+}
+
+func TestPauseRejectsInvalidRequests(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/jobs", "worker", "127.0.0.1")
+
+	if err := b.PauseClient("worker", "sleep", time.Hour); err == nil {
+		t.Error("invalid mode accepted")
+	}
+	if err := b.PauseClient("worker", PauseModeBuffer, maxPauseDuration+time.Hour); err == nil {
+		t.Error("pause past the maximum accepted")
+	}
+	if err := b.PauseClient("nobody", PauseModeBuffer, time.Hour); err == nil {
+		t.Error("unknown client paused")
+	}
+}
+
+func TestPickupLimitedPages(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.Subscribe("/b", "c1", "127.0.0.1")
+	for i, topic := range []string{"/a", "/b", "/a", "/b", "/a"} {
+		b.Publish(topic, strconv.Itoa(i), "test", "127.0.0.1", int64(i+1))
+	}
+
+	var got []string
+	for page := 0; ; page++ {
+		messages, pending, err := b.PickupLimited("c1", "127.0.0.1", 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countMessages(messages); n > 2 {
+			t.Fatalf("page %d has %d messages, want at most 2", page, n)
+		}
+		for _, msgs := range messages {
+			for _, msg := range msgs {
+				got = append(got, msg.Message)
+			}
+		}
+		if want := 5 - len(got); pending != want {
+			t.Fatalf("page %d reports %d pending, want %d", page, pending, want)
+		}
+		if pending == 0 {
+			break
+		}
+	}
+
+	sort.Strings(got)
+	if strings.Join(got, ",") != "0,1,2,3,4" {
+		t.Errorf("paged pickups returned %v, want every message once", got)
+	}
+}
+
+func TestPickupLimitedOldestFirst(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.Subscribe("/b", "c1", "127.0.0.1")
+	b.Publish("/b", "old", "test", "127.0.0.1", 1)
+	b.Publish("/a", "new", "test", "127.0.0.1", 2)
+
+	messages, pending, _ := b.PickupLimited("c1", "127.0.0.1", 1, 0)
+	if msgs := messages["/b"]; len(msgs) != 1 || msgs[0].Message != "old" || pending != 1 {
+		t.Errorf("got %v with %d pending, want the oldest message first", messages, pending)
+	}
+}
+
+func TestPickupLimitedReturnsOneLargeMessage(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.Publish("/a", strings.Repeat("x", 1000), "test", "127.0.0.1", 1)
+	b.Publish("/a", "small", "test", "127.0.0.1", 2)
+
+	messages, pending, _ := b.PickupLimited("c1", "127.0.0.1", 0, 10)
+	if n := countMessages(messages); n != 1 || pending != 1 {
+		t.Errorf("got %d messages with %d pending, want 1 with 1 pending", n, pending)
+	}
+}
+
+func TestSystemMessagesReachUnknownClientsOnce(t *testing.T) {
+	b := newTestBroker(t)
+	b.PublishSystemMessage("/server/notice", "first")
+
+	messages, _ := b.Pickup("stranger", "127.0.0.1")
+	if len(messages["/server/notice"]) != 1 {
+		t.Fatalf("first pickup got %v, want the recent system message", messages)
+	}
+	messages, _ = b.Pickup("stranger", "127.0.0.1")
+	if n := countMessages(messages); n != 0 {
+		t.Fatalf("second pickup got %d messages, want none", n)
+	}
+
+	b.PublishSystemMessage("/server/notice", "second")
+	messages, _ = b.Pickup("stranger", "127.0.0.1")
+	if msgs := messages["/server/notice"]; len(msgs) != 1 || msgs[0].Message != "second" {
+		t.Errorf("third pickup got %v, want only the new system message", msgs)
+	}
+}
+
+func TestSystemMessagesForSubscribersStartAtSubscription(t *testing.T) {
+	b := newTestBroker(t)
+	b.PublishSystemMessage("/server/notice", "before")
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.PublishSystemMessage("/server/notice", "after")
+
+	messages, _ := b.Pickup("c1", "127.0.0.1")
+	if msgs := messages["/server/notice"]; len(msgs) != 1 || msgs[0].Message != "after" {
+		t.Errorf("got %v, want only the system message published after subscribing", msgs)
+	}
+}
+
+func TestDeleteValue(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/cfg/a", "1", "", "test", 1)
+
+	if !b.DeleteValue("/cfg/a", "test", true) || !b.db.HasValue("/cfg/a") {
+		t.Fatal("dry run didn't report the key or removed it")
+	}
+	if !b.DeleteValue("/cfg/a", "test", false) {
+		t.Fatal("delete of an existing key reported nothing")
+	}
+	if b.DeleteValue("/cfg/a", "test", false) {
+		t.Error("second delete reported the key again")
+	}
+
+	messages, _ := b.Pickup("watcher", "127.0.0.1")
+	if msgs := messages[deletedValueTopic]; len(msgs) != 1 || msgs[0].Message != `["/cfg/a"]` {
+		t.Errorf("got delete announcements %v, want one for /cfg/a", msgs)
+	}
+}
+
+func TestDeleteValuesByPrefixAndRegex(t *testing.T) {
+	b := newTestBroker(t)
+	for _, key := range []string{"/cfg/a", "/cfg/b", "/other/a"} {
+		b.PutValue(key, "1", "", "test", 1)
+	}
+
+	if keys := b.DeleteValuesByPrefix("/cfg/", "test", false); strings.Join(keys, ",") != "/cfg/a,/cfg/b" {
+		t.Errorf("prefix delete removed %v", keys)
+	}
+	keys, err := b.DeleteValuesByRegex("^/other/", "test", false)
+	if err != nil || strings.Join(keys, ",") != "/other/a" {
+		t.Errorf("regex delete removed %v, %v", keys, err)
+	}
+	if _, err := b.DeleteValuesByRegex("(", "test", false); err == nil {
+		t.Error("invalid regex accepted")
+	}
+	if n := b.db.CountValues(); n != 0 {
+		t.Errorf("%d values left, want 0", n)
+	}
+}
+
+func TestPeekQueueLeavesMessagesQueued(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.Subscribe("/b/+", "c1", "127.0.0.1")
+	b.Publish("/b/x", "second", "test", "127.0.0.1", 2)
+	b.Publish("/a", "first", "test", "127.0.0.1", 1)
+	b.Publish("/a", "third", "test", "127.0.0.1", 3)
+
+	peek, err := b.PeekQueue("c1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peek.Total != 3 || peek.Topics["/a"] != 2 || peek.Topics["/b/+"] != 1 {
+		t.Errorf("got counts %d %v", peek.Total, peek.Topics)
+	}
+	if len(peek.Messages) != 2 || peek.Messages[0].Message.Message != "first" || peek.Messages[1].Subscription != "/b/+" {
+		t.Errorf("got the oldest messages %+v", peek.Messages)
+	}
+
+	messages, _ := b.Pickup("c1", "127.0.0.1")
+	if n := countMessages(messages); n != 3 {
+		t.Errorf("pickup after peeking got %d messages, want 3", n)
+	}
+
+	if _, err := b.PeekQueue("nobody", 0); err == nil {
+		t.Error("peeked at an unknown client")
+	}
+}
+
+func TestIncrValue(t *testing.T) {
+	b := newTestBroker(t)
+
+	if value, version, err := b.IncrValue("/seq", 5, "test", 1); err != nil || value != "5" || version != 1 {
+		t.Fatalf("got %s at version %d, %v", value, version, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.IncrValue("/seq", 1, "test", 2)
+		}()
+	}
+	wg.Wait()
+	if value, version, _ := b.IncrValue("/seq", -5, "test", 3); value != "50" || version != 52 {
+		t.Errorf("got %s at version %d after concurrent increments, want 50 at 52", value, version)
+	}
+
+	if value, _, err := b.IncrValueFloat("/temp", 0.5, "test", 1); err != nil || value != "0.5" {
+		t.Errorf("float increment got %s, %v", value, err)
+	}
+	if value, _, _ := b.IncrValueFloat("/seq", 0.25, "test", 1); value != "50.25" {
+		t.Errorf("float increment of an integer got %s", value)
+	}
+
+	var invalid *InvalidValueError
+	b.PutValue("/text", "abc", "", "test", 1)
+	if _, _, err := b.IncrValue("/text", 1, "test", 1); !errors.As(err, &invalid) {
+		t.Errorf("incrementing text got %v", err)
+	}
+	if _, _, err := b.IncrValue("/temp", 1, "test", 1); !errors.As(err, &invalid) {
+		t.Errorf("integer increment of a float got %v", err)
+	}
+	b.PutValue("/max", strconv.FormatInt(math.MaxInt64, 10), "", "test", 1)
+	if _, _, err := b.IncrValue("/max", 1, "test", 1); !errors.As(err, &invalid) {
+		t.Errorf("overflowing increment got %v", err)
+	}
+	if value, _ := b.GetValue("/max"); value.Version != 1 {
+		t.Errorf("failed increment wrote version %d", value.Version)
+	}
+}
+
+func TestStoredValueListsSubscribers(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	b.Subscribe("#", "c2", "127.0.0.1")
+	b.Publish("/a", "1", "test", "127.0.0.1", 1)
+
+	stored, err := b.GetValue("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Subscribers) != 2 || !stored.Subscribers["c1"] || !stored.Subscribers["c2"] {
+		t.Errorf("stored value lists subscribers %v, want c1 and c2", stored.Subscribers)
+	}
+}
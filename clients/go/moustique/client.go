@@ -1,18 +1,28 @@
 package moustique
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Default limits for a single pickup response
+const (
+	DefaultPickupMaxMessages = 500
+	maxPickupPages           = 100
+)
+
 type Client struct {
 	BaseURL    string
 	HTTPClient *http.Client
@@ -20,10 +30,77 @@ type Client struct {
 	Username   string
 	Password   string
 
+	// PickupMaxMessages and PickupMaxBytes bound each pickup response,
+	// 0 means no limit
+	PickupMaxMessages int
+	PickupMaxBytes    int
+
 	mu        sync.Mutex
 	callbacks map[string][]func(topic, message, from string)
 }
 
+// ErrNotFound is returned by GetVal when the value doesn't exist
+var ErrNotFound = errors.New("moustique: value not found")
+
+// ConflictError is returned by PutValIf when the stored value is at another
+// version than expected
+type ConflictError struct {
+	Topic   string
+	Current int64 // 0 when the value doesn't exist
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("putval conflict on %s: current version is %d", e.Topic, e.Current)
+}
+
+// QuotaError is returned when a request would take the tenant past one of
+// the quota limits set by the server admin. Nothing was changed.
+type QuotaError struct {
+	Limit   string // e.g. "max_keys" or "max_messages_per_minute"
+	Max     int64
+	Current int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s is %d, currently %d", e.Limit, e.Max, e.Current)
+}
+
+// quotaError returns a *QuotaError if the response reports an exceeded
+// quota, nil otherwise
+func quotaError(status int, body []byte) error {
+	if status != http.StatusForbidden && status != http.StatusTooManyRequests {
+		return nil
+	}
+	var result struct {
+		Status  string `json:"status"`
+		Limit   string `json:"limit"`
+		Max     int64  `json:"max"`
+		Current int64  `json:"current"`
+	}
+	if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil || result.Status != "quota_exceeded" {
+		return nil
+	}
+	return &QuotaError{Limit: result.Limit, Max: result.Max, Current: result.Current}
+}
+
+// Value is a stored value as returned by GetVal
+type Value struct {
+	Message     string `json:"message"`
+	From        string `json:"from"`
+	UpdatedTime int64  `json:"updated_time"`
+	Version     int64  `json:"version"`
+	ExpiresAt   int64  `json:"expires_at"` // unix time, 0 = never
+}
+
+// maxUpdateRetries bounds how often UpdateVal retries after a conflict
+const maxUpdateRetries = 10
+
+type pickupPage struct {
+	Messages map[string][]message `json:"messages"`
+	Pending  int                  `json:"pending"`
+	More     bool                 `json:"more"`
+}
+
 type message struct {
 	Topic   string `json:"topic"`
 	Message string `json:"message"`
@@ -57,6 +134,8 @@ func New(ip, port string, args ...string) *Client {
 		Username:   username,
 		Password:   password,
 		callbacks:  make(map[string][]func(topic, message, from string)),
+
+		PickupMaxMessages: DefaultPickupMaxMessages,
 	}
 }
 
@@ -69,6 +148,12 @@ func (c *Client) addAuth(payload url.Values) url.Values {
 }
 
 func (c *Client) Publish(topic, message string) error {
+	return c.PublishTTL(topic, message, 0)
+}
+
+// PublishTTL publishes a message whose stored value expires after ttl,
+// rounded down to whole seconds. Zero keeps it forever.
+func (c *Client) PublishTTL(topic, message string, ttl time.Duration) error {
 	payload := c.addAuth(url.Values{
 		"topic":                {Enc(topic)},
 		"message":              {Enc(message)},
@@ -76,6 +161,9 @@ func (c *Client) Publish(topic, message string) error {
 		"updated_nicedatetime": {Enc(NiceDateTime())},
 		"from":                 {Enc(c.ClientName)},
 	})
+	if ttl > 0 {
+		payload.Set("ttl", Enc(fmt.Sprintf("%d", int64(ttl/time.Second))))
+	}
 
 	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/POST", payload)
 	if err != nil {
@@ -84,6 +172,9 @@ func (c *Client) Publish(topic, message string) error {
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return err
+		}
 		return fmt.Errorf("publish failed: %d %s", resp.StatusCode, string(body))
 	}
 	fmt.Printf("Published to %s\n", topic)
@@ -91,6 +182,12 @@ func (c *Client) Publish(topic, message string) error {
 }
 
 func (c *Client) PutVal(topic, value string) error {
+	return c.PutValTTL(topic, value, 0)
+}
+
+// PutValTTL stores a value that expires after ttl, rounded down to whole
+// seconds. Zero keeps it forever.
+func (c *Client) PutValTTL(topic, value string, ttl time.Duration) error {
 	payload := c.addAuth(url.Values{
 		"valname":              {Enc(topic)},
 		"val":                  {Enc(value)},
@@ -98,6 +195,9 @@ func (c *Client) PutVal(topic, value string) error {
 		"updated_nicedatetime": {Enc(NiceDateTime())},
 		"from":                 {Enc(c.ClientName)},
 	})
+	if ttl > 0 {
+		payload.Set("ttl", Enc(fmt.Sprintf("%d", int64(ttl/time.Second))))
+	}
 
 	req, _ := http.NewRequest("PUT", c.BaseURL+"/PUTVAL", bytes.NewBufferString(payload.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -109,18 +209,803 @@ func (c *Client) PutVal(topic, value string) error {
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != 308 {
 		body, _ := io.ReadAll(resp.Body)
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return err
+		}
 		return fmt.Errorf("putval failed: %d %s", resp.StatusCode, string(body))
 	}
 	fmt.Printf("PutVal %s = %s\n", topic, value)
 	return nil
 }
 
-func (c *Client) Subscribe(topic string, callback func(topic, message, from string)) error {
+// GetVal fetches a stored value and its version
+func (c *Client) GetVal(topic string) (*Value, error) {
 	payload := c.addAuth(url.Values{
-		"topic":  {Enc(topic)},
-		"client": {Enc(c.ClientName)},
+		"topic": {Enc(topic)},
+	})
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/GETVAL", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getval failed: %d %s", resp.StatusCode, string(body))
+	}
+
+	var value Value
+	if err := json.Unmarshal([]byte(Dec(string(body))), &value); err != nil {
+		return nil, fmt.Errorf("getval: invalid response: %w", err)
+	}
+	return &value, nil
+}
+
+// PutValIf stores a value only if it is currently at ifVersion, where 0
+// means it must not exist yet. It returns the new version, or a
+// *ConflictError holding the current version when someone else got there first.
+func (c *Client) PutValIf(topic, value string, ifVersion int64) (int64, error) {
+	payload := c.addAuth(url.Values{
+		"valname":              {Enc(topic)},
+		"val":                  {Enc(value)},
+		"updated_time":         {Enc(fmt.Sprintf("%d", time.Now().Unix()))},
+		"updated_nicedatetime": {Enc(NiceDateTime())},
+		"from":                 {Enc(c.ClientName)},
+	})
+	if ifVersion == 0 {
+		payload.Set("if_absent", Enc("true"))
+	} else {
+		payload.Set("if_version", Enc(fmt.Sprintf("%d", ifVersion)))
+	}
+
+	req, _ := http.NewRequest("PUT", c.BaseURL+"/PUTVAL", bytes.NewBufferString(payload.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var result struct {
+		Version        int64 `json:"version"`
+		CurrentVersion int64 `json:"current_version"`
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return 0, fmt.Errorf("putval: invalid response: %w", err)
+		}
+		return result.Version, nil
+	case http.StatusConflict:
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return 0, fmt.Errorf("putval: invalid response: %w", err)
+		}
+		return 0, &ConflictError{Topic: topic, Current: result.CurrentVersion}
+	default:
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("putval failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// UpdateVal does a read-modify-write of a value. fn gets the current value
+// (nil if it doesn't exist) and returns the new one. The write is retried
+// with fresh data when another client changed the value in between.
+func (c *Client) UpdateVal(topic string, fn func(current *Value) (string, error)) error {
+	for attempt := 0; attempt < maxUpdateRetries; attempt++ {
+		current, err := c.GetVal(topic)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		var version int64
+		if current != nil {
+			version = current.Version
+		}
+
+		updated, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = c.PutValIf(topic, updated, version)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("updateval %s: gave up after %d conflicts", topic, maxUpdateRetries)
+}
+
+// WatchVal blocks until the value is at another version than version, or
+// timeout passes. It returns the current value (nil if it doesn't exist)
+// and whether it changed. Pass version 0 to wait for a value to appear.
+func (c *Client) WatchVal(topic string, version int64, timeout time.Duration) (*Value, bool, error) {
+	payload := c.addAuth(url.Values{
+		"topic":   {Enc(topic)},
+		"version": {Enc(strconv.FormatInt(version, 10))},
+		"timeout": {Enc(strconv.Itoa(int(timeout / time.Second)))},
 	})
 
+	// The server holds the request open for up to timeout
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = timeout + c.HTTPClient.Timeout
+
+	resp, err := httpClient.PostForm(c.BaseURL+"/WATCHVAL", payload)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("watchval failed: %d %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Changed bool   `json:"changed"`
+		Value   *Value `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+		return nil, false, fmt.Errorf("watchval: invalid response: %w", err)
+	}
+	return result.Value, result.Changed, nil
+}
+
+// Incr atomically adds delta to an integer value, creating it from 0 if it
+// doesn't exist, and returns the new value
+func (c *Client) Incr(topic string, delta int64) (int64, error) {
+	value, err := c.incr(topic, strconv.FormatInt(delta, 10), "int")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Decr atomically subtracts delta from an integer value and returns the new value
+func (c *Client) Decr(topic string, delta int64) (int64, error) {
+	return c.Incr(topic, -delta)
+}
+
+// IncrFloat atomically adds delta to a floating point value, creating it
+// from 0 if it doesn't exist, and returns the new value
+func (c *Client) IncrFloat(topic string, delta float64) (float64, error) {
+	value, err := c.incr(topic, strconv.FormatFloat(delta, 'f', -1, 64), "float")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func (c *Client) incr(topic, delta, mode string) (string, error) {
+	payload := c.addAuth(url.Values{
+		"valname":      {Enc(topic)},
+		"delta":        {Enc(delta)},
+		"mode":         {Enc(mode)},
+		"updated_time": {Enc(fmt.Sprintf("%d", time.Now().Unix()))},
+		"from":         {Enc(c.ClientName)},
+	})
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/INCRVAL", payload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var result struct {
+		Value string `json:"value"`
+		Error string `json:"error"`
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return "", fmt.Errorf("incrval: invalid response: %w", err)
+		}
+		return result.Value, nil
+	case http.StatusUnprocessableEntity:
+		json.Unmarshal([]byte(Dec(string(body))), &result)
+		return "", fmt.Errorf("incrval %s: %s", topic, result.Error)
+	default:
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("incrval failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// MergePatchVal applies an RFC 7386 JSON merge patch to a JSON document
+// stored under topic and returns the patched document
+func (c *Client) MergePatchVal(topic string, patch interface{}) (json.RawMessage, error) {
+	return c.patchVal(topic, patch, "merge")
+}
+
+// JSONPatchVal applies RFC 6902 operations (add, remove, replace and test)
+// to a JSON document stored under topic and returns the patched document.
+// Nothing is changed if any operation fails.
+func (c *Client) JSONPatchVal(topic string, operations []map[string]interface{}) (json.RawMessage, error) {
+	return c.patchVal(topic, operations, "json")
+}
+
+func (c *Client) patchVal(topic string, patch interface{}, format string) (json.RawMessage, error) {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	payload := c.addAuth(url.Values{
+		"valname":      {Enc(topic)},
+		"patch":        {Enc(string(data))},
+		"format":       {Enc(format)},
+		"updated_time": {Enc(fmt.Sprintf("%d", time.Now().Unix()))},
+		"from":         {Enc(c.ClientName)},
+	})
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/PATCHVAL", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var result struct {
+		Value json.RawMessage `json:"value"`
+		Error string          `json:"error"`
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return nil, fmt.Errorf("patchval: invalid response: %w", err)
+		}
+		return result.Value, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity:
+		json.Unmarshal([]byte(Dec(string(body))), &result)
+		return nil, fmt.Errorf("patchval %s: %s", topic, result.Error)
+	default:
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("patchval failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// QueryMatch is a value matched by Query
+type QueryMatch struct {
+	Key     string                 `json:"key"`
+	Version int64                  `json:"version"`
+	Fields  map[string]interface{} `json:"fields"`
+	Value   interface{}            `json:"value"`
+}
+
+// QueryResult is a page of query results. Cursor is set when more values
+// may follow; pass it back in QueryOptions to continue.
+type QueryResult struct {
+	Results  []QueryMatch `json:"results"`
+	Scanned  int          `json:"scanned"`
+	TimedOut bool         `json:"timed_out"`
+	Cursor   string       `json:"cursor"`
+}
+
+// QueryOptions describe a server-side query over JSON values
+type QueryOptions struct {
+	Pattern string        // key regex
+	Prefix  string        // key prefix
+	Where   string        // conditions joined with &&, e.g. `battery < 20 && room == "hall"`
+	Select  string        // comma separated paths to return, empty for whole values
+	Limit   int           // results per page, 0 for the server default
+	Timeout time.Duration // time the server may spend, 0 for its default
+	Cursor  string
+}
+
+// Query evaluates conditions over stored JSON values on the server and
+// returns the selected fields of the values that match
+func (c *Client) Query(opts QueryOptions) (*QueryResult, error) {
+	payload := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			payload.Set(name, Enc(value))
+		}
+	}
+	set("topic", opts.Pattern)
+	set("prefix", opts.Prefix)
+	set("where", opts.Where)
+	set("select", opts.Select)
+	set("cursor", opts.Cursor)
+	if opts.Limit > 0 {
+		set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Timeout > 0 {
+		set("timeout_ms", strconv.FormatInt(opts.Timeout.Milliseconds(), 10))
+	}
+	payload = c.addAuth(payload)
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/QUERY", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result QueryResult
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return nil, fmt.Errorf("query: invalid response: %w", err)
+		}
+		return &result, nil
+	case http.StatusBadRequest:
+		var result struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(Dec(string(body))), &result)
+		return nil, fmt.Errorf("query: %s", result.Error)
+	default:
+		return nil, fmt.Errorf("query failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// AggregateStats are the totals AGGREGATE computes. Min, Max, Avg and Last
+// are nil when no value had a number.
+type AggregateStats struct {
+	Count       int      `json:"count"`
+	Sum         float64  `json:"sum"`
+	Min         *float64 `json:"min"`
+	Max         *float64 `json:"max"`
+	Avg         *float64 `json:"avg"`
+	Last        *float64 `json:"last"`
+	LastKey     string   `json:"last_key"`
+	LastUpdated int64    `json:"last_updated"`
+}
+
+// AggregateResult holds the totals, or Groups when grouped. TimedOut is
+// set when the server only got through part of the keys.
+type AggregateResult struct {
+	AggregateStats
+	Groups   map[string]*AggregateStats `json:"groups"`
+	Skipped  int                        `json:"skipped"`
+	TimedOut bool                       `json:"timed_out"`
+}
+
+// AggregateOptions select the values to aggregate
+type AggregateOptions struct {
+	Pattern string        // key regex
+	Prefix  string        // key prefix
+	Field   string        // JSON path to the number, empty if the value is the number
+	GroupBy string        // e.g. /house/+/temperature to group per room
+	Timeout time.Duration // time the server may spend, 0 for its default
+}
+
+// Aggregate computes count, sum, min, max, avg and last over numeric values
+// on the server
+func (c *Client) Aggregate(opts AggregateOptions) (*AggregateResult, error) {
+	payload := url.Values{}
+	for name, value := range map[string]string{
+		"topic":    opts.Pattern,
+		"prefix":   opts.Prefix,
+		"field":    opts.Field,
+		"group_by": opts.GroupBy,
+	} {
+		if value != "" {
+			payload.Set(name, Enc(value))
+		}
+	}
+	if opts.Timeout > 0 {
+		payload.Set("timeout_ms", Enc(strconv.FormatInt(opts.Timeout.Milliseconds(), 10)))
+	}
+	payload = c.addAuth(payload)
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/AGGREGATE", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result AggregateResult
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return nil, fmt.Errorf("aggregate: invalid response: %w", err)
+		}
+		return &result, nil
+	case http.StatusBadRequest:
+		var result struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(Dec(string(body))), &result)
+		return nil, fmt.Errorf("aggregate: %s", result.Error)
+	default:
+		return nil, fmt.Errorf("aggregate failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// SeriesPoint summarises the numbers published to a time series topic
+// within one bucket of the chosen resolution
+type SeriesPoint struct {
+	Time  int64   `json:"t"` // unix time the bucket starts
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Last  float64 `json:"last"`
+}
+
+// SeriesOptions select the points SERIES returns
+type SeriesOptions struct {
+	Resolution string    // raw (default), 1m or 1h
+	From, To   time.Time // zero means the day before To, and now
+	Limit      int       // 0 for the server default of 1000
+}
+
+// Series returns the points of a time series topic, oldest first. more is
+// set when the range holds further points, continue from the last one.
+func (c *Client) Series(topic string, opts SeriesOptions) (points []SeriesPoint, more bool, err error) {
+	payload := url.Values{"topic": {Enc(topic)}}
+	if opts.Resolution != "" {
+		payload.Set("resolution", Enc(opts.Resolution))
+	}
+	if !opts.From.IsZero() {
+		payload.Set("from", Enc(strconv.FormatInt(opts.From.Unix(), 10)))
+	}
+	if !opts.To.IsZero() {
+		payload.Set("to", Enc(strconv.FormatInt(opts.To.Unix(), 10)))
+	}
+	if opts.Limit > 0 {
+		payload.Set("limit", Enc(strconv.Itoa(opts.Limit)))
+	}
+
+	var result struct {
+		Points []SeriesPoint `json:"points"`
+		More   bool          `json:"more"`
+	}
+	if err := c.seriesRequest("/SERIES", payload, &result); err != nil {
+		return nil, false, err
+	}
+	return result.Points, result.More, nil
+}
+
+// MarkSeries marks a topic pattern like /house/+/temperature as a time
+// series, so numbers published to matching topics are recorded
+func (c *Client) MarkSeries(pattern string) ([]string, error) {
+	return c.seriesPatterns(url.Values{"add": {Enc(pattern)}})
+}
+
+// UnmarkSeries stops recording a topic pattern; points already recorded
+// are kept until their retention ends
+func (c *Client) UnmarkSeries(pattern string) ([]string, error) {
+	return c.seriesPatterns(url.Values{"remove": {Enc(pattern)}})
+}
+
+// SeriesPatterns lists the topic patterns marked as time series
+func (c *Client) SeriesPatterns() ([]string, error) {
+	return c.seriesPatterns(url.Values{})
+}
+
+func (c *Client) seriesPatterns(payload url.Values) ([]string, error) {
+	var result struct {
+		Patterns []string `json:"patterns"`
+	}
+	if err := c.seriesRequest("/SERIESPATTERNS", payload, &result); err != nil {
+		return nil, err
+	}
+	return result.Patterns, nil
+}
+
+func (c *Client) seriesRequest(path string, payload url.Values, result interface{}) error {
+	payload = c.addAuth(payload)
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal([]byte(Dec(string(body))), result); err != nil {
+			return fmt.Errorf("series: invalid response: %w", err)
+		}
+		return nil
+	case http.StatusBadRequest:
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(Dec(string(body))), &failure)
+		return fmt.Errorf("series: %s", failure.Error)
+	default:
+		return fmt.Errorf("series failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// TxnCheck is a precondition of Txn, made with VersionCheck or ExistsCheck
+type TxnCheck struct {
+	Key     string `json:"key"`
+	Version *int64 `json:"version,omitempty"`
+	Exists  *bool  `json:"exists,omitempty"`
+}
+
+// VersionCheck requires a value to be at version, 0 meaning it must not exist
+func VersionCheck(key string, version int64) TxnCheck {
+	return TxnCheck{Key: key, Version: &version}
+}
+
+// ExistsCheck requires a value to exist, or not to
+func ExistsCheck(key string, exists bool) TxnCheck {
+	return TxnCheck{Key: key, Exists: &exists}
+}
+
+// TxnOp is a write of Txn, made with PutOp or DeleteOp
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"` // seconds
+}
+
+// PutOp stores a value
+func PutOp(key, value string) TxnOp {
+	return TxnOp{Op: "put", Key: key, Value: value}
+}
+
+// DeleteOp removes a value
+func DeleteOp(key string) TxnOp {
+	return TxnOp{Op: "delete", Key: key}
+}
+
+// TxnResult holds the new version of every put and the keys deleted
+type TxnResult struct {
+	Versions map[string]int64 `json:"versions"`
+	Deleted  []string         `json:"deleted"`
+}
+
+// TxnCheckError is returned by Txn when a check failed, nothing was written
+type TxnCheckError struct {
+	Check   int // index of the failed check
+	Key     string
+	Exists  bool
+	Current int64 // 0 when the value doesn't exist
+}
+
+func (e *TxnCheckError) Error() string {
+	return fmt.Sprintf("txn check %d failed on %s: current version is %d", e.Check, e.Key, e.Current)
+}
+
+// Txn applies ops atomically if every check holds. Subscribers only see the
+// writes once all of them are stored.
+func (c *Client) Txn(checks []TxnCheck, ops []TxnOp) (*TxnResult, error) {
+	checksJSON, err := json.Marshal(checks)
+	if err != nil {
+		return nil, err
+	}
+	opsJSON, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	payload := c.addAuth(url.Values{
+		"checks":       {Enc(string(checksJSON))},
+		"ops":          {Enc(string(opsJSON))},
+		"updated_time": {Enc(fmt.Sprintf("%d", time.Now().Unix()))},
+		"from":         {Enc(c.ClientName)},
+	})
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/TXN", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result TxnResult
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return nil, fmt.Errorf("txn: invalid response: %w", err)
+		}
+		return &result, nil
+	case http.StatusConflict:
+		var result struct {
+			Check          int    `json:"check"`
+			Key            string `json:"key"`
+			Exists         bool   `json:"exists"`
+			CurrentVersion int64  `json:"current_version"`
+		}
+		if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+			return nil, fmt.Errorf("txn: invalid response: %w", err)
+		}
+		return nil, &TxnCheckError{Check: result.Check, Key: result.Key, Exists: result.Exists, Current: result.CurrentVersion}
+	case http.StatusBadRequest:
+		var result struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(Dec(string(body))), &result)
+		return nil, fmt.Errorf("txn: %s", result.Error)
+	default:
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("txn failed: %d %s", resp.StatusCode, string(body))
+	}
+}
+
+// DelVal deletes a stored value. It returns ErrNotFound if there was none.
+func (c *Client) DelVal(topic string) error {
+	_, err := c.delVals("/DELVAL", url.Values{"topic": {Enc(topic)}}, false)
+	return err
+}
+
+// DelValsByRegex deletes every value whose key matches pattern and returns
+// the deleted keys. With dryRun nothing is deleted.
+func (c *Client) DelValsByRegex(pattern string, dryRun bool) ([]string, error) {
+	return c.delVals("/DELVALSBYREGEX", url.Values{"topic": {Enc(pattern)}}, dryRun)
+}
+
+// DelValsByPrefix deletes every value whose key starts with prefix and
+// returns the deleted keys. With dryRun nothing is deleted.
+func (c *Client) DelValsByPrefix(prefix string, dryRun bool) ([]string, error) {
+	return c.delVals("/DELVALSBYREGEX", url.Values{"prefix": {Enc(prefix)}}, dryRun)
+}
+
+func (c *Client) delVals(path string, payload url.Values, dryRun bool) ([]string, error) {
+	payload.Set("from", Enc(c.ClientName))
+	if dryRun {
+		payload.Set("dry_run", Enc("true"))
+	}
+	payload = c.addAuth(payload)
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("delete failed: %d %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Deleted []string `json:"deleted"`
+	}
+	if err := json.Unmarshal([]byte(Dec(string(body))), &result); err != nil {
+		return nil, fmt.Errorf("delete: invalid response: %w", err)
+	}
+	return result.Deleted, nil
+}
+
+// Export writes every value of the tenant to w as NDJSON, one record with
+// key, value, version and expires_at per line
+func (c *Client) Export(w io.Writer) error {
+	payload := c.addAuth(url.Values{})
+
+	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/EXPORT", payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("export failed: %d %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, Dec(scanner.Text())); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Import loads an NDJSON export from r. mode is "merge" to keep keys that
+// are not in the export or "replace" to remove them. Nothing is imported
+// unless every line is valid. The export is streamed to the server, which
+// takes requests up to 64 MiB; import larger ones with the server's
+// offline -import.
+func (c *Client) Import(r io.Reader, mode string) (int, error) {
+	form := c.addAuth(url.Values{"mode": {Enc(mode)}})
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeImportForm(writer, form, r))
+	}()
+	defer reader.Close()
+
+	resp, err := c.HTTPClient.Post(c.BaseURL+"/IMPORT", "application/x-www-form-urlencoded", reader)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var result struct {
+		Imported int    `json:"imported"`
+		Error    string `json:"error"`
+	}
+	json.Unmarshal([]byte(Dec(string(body))), &result)
+	if resp.StatusCode == http.StatusBadRequest && result.Error != "" {
+		return 0, fmt.Errorf("import rejected: %s", result.Error)
+	}
+	if err := quotaError(resp.StatusCode, body); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("import failed: %d %s", resp.StatusCode, string(body))
+	}
+	return result.Imported, nil
+}
+
+// writeImportForm writes form and then r encoded as its data field to w,
+// a slice of r at a time
+func writeImportForm(w io.Writer, form url.Values, r io.Reader) error {
+	if _, err := io.WriteString(w, form.Encode()+"&data="); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, queryEscaper{w})
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			rotateBytes(buf[:n])
+			if _, err := encoder.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return encoder.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) Subscribe(topic string, callback func(topic, message, from string)) error {
+	return c.subscribe(url.Values{"topic": {Enc(topic)}}, []string{topic}, callback)
+}
+
+// SubscribeTopics subscribes to several topics with a single request
+func (c *Client) SubscribeTopics(topics []string, callback func(topic, message, from string)) error {
+	list, err := json.Marshal(topics)
+	if err != nil {
+		return err
+	}
+	return c.subscribe(url.Values{"topics": {Enc(string(list))}}, topics, callback)
+}
+
+// SubscribeRegex subscribes to all topics matching a regular expression
+func (c *Client) SubscribeRegex(pattern string, callback func(topic, message, from string)) error {
+	return c.subscribe(url.Values{
+		"topic": {Enc(pattern)},
+		"regex": {Enc("true")},
+	}, []string{pattern}, callback)
+}
+
+func (c *Client) subscribe(payload url.Values, topics []string, callback func(topic, message, from string)) error {
+	payload.Set("client", Enc(c.ClientName))
+	payload = c.addAuth(payload)
+
 	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/SUBSCRIBE", payload)
 	if err != nil {
 		return err
@@ -128,45 +1013,78 @@ func (c *Client) Subscribe(topic string, callback func(topic, message, from stri
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if err := quotaError(resp.StatusCode, body); err != nil {
+			return err
+		}
 		return fmt.Errorf("subscribe failed: %d %s", resp.StatusCode, string(body))
 	}
 
 	c.mu.Lock()
-	c.callbacks[topic] = append(c.callbacks[topic], callback)
+	for _, topic := range topics {
+		c.callbacks[topic] = append(c.callbacks[topic], callback)
+	}
 	c.mu.Unlock()
 
-	fmt.Printf("%s subscribed to %s\n", c.ClientName, topic)
+	for _, topic := range topics {
+		fmt.Printf("%s subscribed to %s\n", c.ClientName, topic)
+	}
 	return nil
 }
 
+// Pickup fetches pending messages and dispatches them to the subscribed
+// callbacks. When the server has more queued than fits in one response the
+// continuation pages are fetched right away.
 func (c *Client) Pickup() error {
-	payload := c.addAuth(url.Values{
+	for page := 0; page < maxPickupPages; page++ {
+		more, err := c.pickup()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) pickup() (bool, error) {
+	payload := url.Values{
 		"client": {Enc(c.ClientName)},
-	})
+	}
+	limited := c.PickupMaxMessages > 0 || c.PickupMaxBytes > 0
+	if c.PickupMaxMessages > 0 {
+		payload.Set("max_messages", Enc(fmt.Sprintf("%d", c.PickupMaxMessages)))
+	}
+	if c.PickupMaxBytes > 0 {
+		payload.Set("max_bytes", Enc(fmt.Sprintf("%d", c.PickupMaxBytes)))
+	}
+	payload = c.addAuth(payload)
 
 	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/PICKUP", payload)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	decrypted := Dec(string(body))
 	if decrypted == "" {
-		return nil
+		return false, nil
 	}
 
-	// Parse JSON: map[string][]message
-	var data map[string][]message
-	if err := json.Unmarshal([]byte(decrypted), &data); err != nil {
+	// Parse JSON: map[string][]message, wrapped in a page when limited
+	var page pickupPage
+	if limited {
+		err = json.Unmarshal([]byte(decrypted), &page)
+	} else {
+		err = json.Unmarshal([]byte(decrypted), &page.Messages)
+	}
+	if err != nil {
 		fmt.Println("Raw pickup data:", decrypted) // fallback
-		return nil
+		return false, nil
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for topic, msgs := range data {
+	for topic, msgs := range page.Messages {
 		for _, msg := range msgs {
 			callbacks := c.callbacks[topic]
 			for _, cb := range callbacks {
@@ -174,7 +1092,7 @@ func (c *Client) Pickup() error {
 			}
 		}
 	}
-	return nil
+	return page.More, nil
 }
 
 func (c *Client) GetClientName() string {
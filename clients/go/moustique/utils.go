@@ -2,6 +2,8 @@ package moustique
 
 import (
 	"encoding/base64"
+	"io"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -39,6 +41,31 @@ func rotate(s string) string {
 	return b.String()
 }
 
+// rotateBytes applies rotate to ASCII text in place, byte by byte so it can
+// run over a stream
+func rotateBytes(p []byte) {
+	for i, c := range p {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			p[i] = 'A' + (c-'A'+13)%26
+		case c >= 'a' && c <= 'z':
+			p[i] = 'a' + (c-'a'+13)%26
+		}
+	}
+}
+
+// queryEscaper escapes what is written to it for a form value
+type queryEscaper struct {
+	w io.Writer
+}
+
+func (e queryEscaper) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(e.w, url.QueryEscape(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func NiceDateTime() string {
 	return time.Now().Format("2006-01-02 15:04:05")
 }
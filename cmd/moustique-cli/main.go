@@ -62,6 +62,12 @@ type Client struct {
 	callbacks  map[string][]func(topic, message, from string)
 }
 
+type pickupPage struct {
+	Messages map[string][]message `json:"messages"`
+	Pending  int                  `json:"pending"`
+	More     bool                 `json:"more"`
+}
+
 type message struct {
 	Topic   string `json:"topic"`
 	Message string `json:"message"`
@@ -162,30 +168,45 @@ func (c *Client) Subscribe(topic string, callback func(topic, message, from stri
 	return nil
 }
 
-func (c *Client) Pickup() error {
-	payload := c.addAuth(url.Values{
+// Pickup fetches one page of at most maxMessages/maxBytes messages (0 means
+// unlimited) and reports whether the server has more pending
+func (c *Client) Pickup(maxMessages, maxBytes int) (bool, error) {
+	payload := url.Values{
 		"client": {encode(c.ClientName)},
-	})
+	}
+	limited := maxMessages > 0 || maxBytes > 0
+	if maxMessages > 0 {
+		payload.Set("max_messages", encode(fmt.Sprintf("%d", maxMessages)))
+	}
+	if maxBytes > 0 {
+		payload.Set("max_bytes", encode(fmt.Sprintf("%d", maxBytes)))
+	}
+	payload = c.addAuth(payload)
 
 	resp, err := c.HTTPClient.PostForm(c.BaseURL+"/PICKUP", payload)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	decrypted := decode(string(body))
 	if decrypted == "" {
-		return nil
+		return false, nil
 	}
 
-	// Parse JSON: map[string][]message
-	var data map[string][]message
-	if err := json.Unmarshal([]byte(decrypted), &data); err != nil {
-		return nil
+	// Parse JSON: map[string][]message, wrapped in a page when limited
+	var page pickupPage
+	if limited {
+		err = json.Unmarshal([]byte(decrypted), &page)
+	} else {
+		err = json.Unmarshal([]byte(decrypted), &page.Messages)
+	}
+	if err != nil {
+		return false, nil
 	}
 
-	for topic, msgs := range data {
+	for topic, msgs := range page.Messages {
 		for _, msg := range msgs {
 			callbacks := c.callbacks[topic]
 			for _, cb := range callbacks {
@@ -193,7 +214,7 @@ func (c *Client) Pickup() error {
 			}
 		}
 	}
-	return nil
+	return page.More, nil
 }
 
 func main() {
@@ -206,6 +227,8 @@ func main() {
 	clientName := flag.String("n", "", "Client name (auto-generated if not provided)")
 	username := flag.String("u", "", "Username for authentication (optional)")
 	password := flag.String("pwd", "", "Password for authentication (optional)")
+	maxMessages := flag.Int("max-messages", 500, "Max messages per pickup (0 = unlimited)")
+	maxBytes := flag.Int("max-bytes", 0, "Max bytes per pickup (0 = unlimited)")
 	verbose := flag.Bool("v", false, "Verbose output")
 	help := flag.Bool("help", false, "Show help")
 
@@ -262,11 +285,16 @@ func main() {
 		// Poll for messages
 		fmt.Println("Listening for messages... (Ctrl+C to exit)")
 		for {
-			if err := client.Pickup(); err != nil {
+			more, err := client.Pickup(*maxMessages, *maxBytes)
+			if err != nil {
 				if *verbose {
 					fmt.Printf("Pickup error: %v\n", err)
 				}
 			}
+			// Fetch continuation pages right away
+			if more {
+				continue
+			}
 			time.Sleep(1 * time.Second)
 		}
 
@@ -301,6 +329,8 @@ func printHelp() {
 	fmt.Println("  -n string      Client name (auto-generated if not provided)")
 	fmt.Println("  -u string      Username for authentication (optional)")
 	fmt.Println("  -pwd string    Password for authentication (optional)")
+	fmt.Println("  -max-messages  Max messages per pickup when subscribing (default: 500, 0 = unlimited)")
+	fmt.Println("  -max-bytes     Max bytes per pickup when subscribing (default: 0 = unlimited)")
 	fmt.Println("  -v             Verbose output")
 	fmt.Println("  -help          Show this help message")
 	fmt.Println()
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -25,7 +26,49 @@ type ServerConfig struct {
 
 // DatabaseConfig represents database configuration
 type DatabaseConfig struct {
-	Path string `yaml:"path"`
+	Path           string        `yaml:"path"`
+	FlushInterval  time.Duration `yaml:"flush_interval"`   // how often dirty keys are written to SQLite
+	FlushBatchSize int           `yaml:"flush_batch_size"` // dirty keys that trigger an early write
+
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"` // how often every tenant database is saved in full, 0 = default, negative = never
+	CheckpointJitter   time.Duration `yaml:"checkpoint_jitter"`   // random delay added so tenants don't save at once
+	Sync               string        `yaml:"sync"`                // SQLite synchronous mode: off, normal, full or extra; the file backend only honours off
+
+	HistoryEnabled     bool          `yaml:"history_enabled"`      // record every write in kv_history
+	HistoryMaxVersions int           `yaml:"history_max_versions"` // versions kept per key, 0 = unlimited
+	HistoryMaxAge      time.Duration `yaml:"history_max_age"`      // age after which versions are pruned, 0 = forever
+
+	Series                *bool         `yaml:"series"`                  // record marked topics as time series, default on; not with encryption
+	SeriesRawRetention    time.Duration `yaml:"series_raw_retention"`    // how long raw time series points are kept, default 24h
+	SeriesMinuteRetention time.Duration `yaml:"series_minute_retention"` // how long 1-minute rollups are kept, default 7 days
+	SeriesHourRetention   time.Duration `yaml:"series_hour_retention"`   // how long 1-hour rollups are kept, default 365 days
+
+	ExpiryNotifications bool `yaml:"expiry_notifications"` // announce expired keys on /server/notification/expired
+
+	Backend        string            `yaml:"backend"`         // storage backend: sqlite, file or memory
+	TenantBackends map[string]string `yaml:"tenant_backends"` // backend per tenant, overrides backend
+
+	BackupPath     string        `yaml:"backup_path"`     // where backups are kept, default <path>/backups
+	BackupInterval time.Duration `yaml:"backup_interval"` // how often every tenant is backed up, 0 = only on request
+	BackupKeep     int           `yaml:"backup_keep"`     // backups kept, 0 = unlimited
+	BackupMaxAge   time.Duration `yaml:"backup_max_age"`  // age after which backups are removed, 0 = never
+
+	Encryption        bool   `yaml:"encryption"`          // encrypt stored values with a data key per tenant
+	MasterKey         string `yaml:"master_key"`          // base64 key wrapping the data keys, MOUSTIQUE_MASTER_KEY overrides it
+	PreviousMasterKey string `yaml:"previous_master_key"` // master key being replaced, data keys are rewrapped on open
+}
+
+// BackendFor returns the storage backend to use for a tenant
+func (c DatabaseConfig) BackendFor(tenant string) string {
+	if backend, ok := c.TenantBackends[tenant]; ok {
+		return backend
+	}
+	return c.Backend
+}
+
+// SeriesEnabled reports whether time series are recorded, on unless turned off
+func (c DatabaseConfig) SeriesEnabled() bool {
+	return c.Series == nil || *c.Series
 }
 
 // LoggingConfig represents logging configuration
@@ -66,6 +109,65 @@ func LoadConfig(path string) (*Config, error) {
 	if config.Database.Path == "" {
 		config.Database.Path = "./data"
 	}
+	if config.Database.FlushInterval == 0 {
+		config.Database.FlushInterval = DefaultFlushInterval
+	}
+	if config.Database.FlushBatchSize == 0 {
+		config.Database.FlushBatchSize = DefaultFlushBatchSize
+	}
+	// Zero is an unset interval, a negative one turns periodic checkpoints off
+	if config.Database.CheckpointInterval == 0 {
+		config.Database.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if config.Database.CheckpointJitter == 0 && config.Database.CheckpointInterval > 0 {
+		config.Database.CheckpointJitter = config.Database.CheckpointInterval / 10
+	}
+	if config.Database.Sync == "" {
+		config.Database.Sync = DefaultSyncMode
+	}
+	switch strings.ToLower(config.Database.Sync) {
+	case "off", "normal", "full", "extra":
+	default:
+		return nil, fmt.Errorf("invalid database sync mode: %s", config.Database.Sync)
+	}
+	if config.Database.Backend == "" {
+		config.Database.Backend = BackendSQLite
+	}
+	backends := []string{config.Database.Backend}
+	for _, backend := range config.Database.TenantBackends {
+		backends = append(backends, backend)
+	}
+	for _, backend := range backends {
+		switch backend {
+		case BackendSQLite, BackendFile, BackendMemory:
+		default:
+			return nil, fmt.Errorf("invalid database backend: %s", backend)
+		}
+	}
+	if config.Database.BackupKeep < 0 || config.Database.BackupInterval < 0 || config.Database.BackupMaxAge < 0 {
+		return nil, fmt.Errorf("backup settings must not be negative")
+	}
+	if config.Database.SeriesRawRetention < 0 || config.Database.SeriesMinuteRetention < 0 || config.Database.SeriesHourRetention < 0 {
+		return nil, fmt.Errorf("series retention must not be negative")
+	}
+	if config.Database.SeriesRawRetention == 0 {
+		config.Database.SeriesRawRetention = DefaultSeriesRawRetention
+	}
+	if config.Database.SeriesMinuteRetention == 0 {
+		config.Database.SeriesMinuteRetention = DefaultSeriesMinuteRetention
+	}
+	if config.Database.SeriesHourRetention == 0 {
+		config.Database.SeriesHourRetention = DefaultSeriesHourRetention
+	}
+	if config.Database.Encryption {
+		if _, _, err := config.Database.masterKeys(); err != nil {
+			return nil, err
+		}
+		// Series are rolled up in plain numbers by SQLite, which encryption can't cover
+		if config.Database.SeriesEnabled() {
+			return nil, fmt.Errorf("time series can't be encrypted: set series: false to use encryption")
+		}
+	}
 	if config.Logging.Level == "" {
 		config.Logging.Level = "info"
 	}
@@ -76,6 +178,7 @@ func LoadConfig(path string) (*Config, error) {
 // GenerateDefaultConfig generates a default configuration file
 func GenerateDefaultConfig(path string) error {
 	defaultAllowPublic := false
+	defaultSeries := true
 	config := Config{
 		Server: ServerConfig{
 			Port:        33334,
@@ -83,7 +186,19 @@ func GenerateDefaultConfig(path string) error {
 			AllowPublic: &defaultAllowPublic,
 		},
 		Database: DatabaseConfig{
-			Path: "./data",
+			Path:           "./data",
+			FlushInterval:  DefaultFlushInterval,
+			FlushBatchSize: DefaultFlushBatchSize,
+
+			CheckpointInterval: DefaultCheckpointInterval,
+			CheckpointJitter:   DefaultCheckpointInterval / 10,
+			Sync:               DefaultSyncMode,
+			Backend:            BackendSQLite,
+
+			Series:                &defaultSeries,
+			SeriesRawRetention:    DefaultSeriesRawRetention,
+			SeriesMinuteRetention: DefaultSeriesMinuteRetention,
+			SeriesHourRetention:   DefaultSeriesHourRetention,
 		},
 		Logging: LoggingConfig{
 			Level: "info",
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads a config file with the given contents
+func loadTestConfig(t *testing.T, contents string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigCheckpoints(t *testing.T) {
+	tests := []struct {
+		contents         string
+		interval, jitter time.Duration
+	}{
+		{"database:\n  path: ./data\n", DefaultCheckpointInterval, DefaultCheckpointInterval / 10},
+		{"database:\n  checkpoint_interval: 0s\n", DefaultCheckpointInterval, DefaultCheckpointInterval / 10},
+		{"database:\n  checkpoint_interval: 1m\n", time.Minute, 6 * time.Second},
+		{"database:\n  checkpoint_interval: 1m\n  checkpoint_jitter: 1s\n", time.Minute, time.Second},
+		{"database:\n  checkpoint_interval: -1s\n", -time.Second, 0},
+	}
+	for _, test := range tests {
+		config, err := loadTestConfig(t, test.contents)
+		if err != nil {
+			t.Fatalf("%q: %v", test.contents, err)
+		}
+		if config.Database.CheckpointInterval != test.interval || config.Database.CheckpointJitter != test.jitter {
+			t.Errorf("%q: got interval %v and jitter %v, want %v and %v", test.contents,
+				config.Database.CheckpointInterval, config.Database.CheckpointJitter, test.interval, test.jitter)
+		}
+	}
+}
+
+func TestLoadConfigSyncMode(t *testing.T) {
+	if _, err := loadTestConfig(t, "database:\n  sync: sometimes\n"); err == nil {
+		t.Error("invalid sync mode accepted")
+	}
+	config, err := loadTestConfig(t, "database:\n  sync: FULL\n")
+	if err != nil || config.Database.Sync != "FULL" {
+		t.Errorf("got %v, %v", config, err)
+	}
+}
@@ -1,156 +1,455 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
+)
 
-	_ "github.com/mattn/go-sqlite3"
+// Defaults for the background writer and checkpoints
+const (
+	DefaultFlushInterval      = 1 * time.Second
+	DefaultFlushBatchSize     = 500
+	DefaultCheckpointInterval = 5 * time.Minute
+	DefaultSyncMode           = "normal"
 )
 
-// Database handles persistent storage
-type Database struct {
-	mu     sync.RWMutex
-	db     *sql.DB
-	values map[string]string
-	dbPath string
+// WriteCondition is a precondition for a conditional write
+type WriteCondition struct {
+	IfAbsent  bool  // the key must not exist
+	IfVersion int64 // the key must be at this version, used when IfAbsent is false
 }
 
-// NewDatabase creates a new database instance
-func NewDatabase(path string) (*Database, error) {
-	// Skapa katalogen om den inte finns (t.ex. för "data/app.db" skapar den "data/")
-	if dir := filepath.Dir(path); dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create database directory: %w", err)
-		}
-	}
+// VersionConflictError is returned when a conditional write finds the key
+// at another version than expected
+type VersionConflictError struct {
+	Key     string
+	Current int64 // 0 when the key doesn't exist
+}
 
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict for key %s: current version is %d", e.Key, e.Current)
+}
 
-	// Create table if not exists
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	)`)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
-	}
+// InvalidValueError is returned when an update can't be applied to the
+// value currently stored, e.g. incrementing a value that isn't a number
+type InvalidValueError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid value for key %s: %s", e.Key, e.Reason)
+}
+
+// Database keeps a tenant's values in memory and persists them to a Store
+type Database struct {
+	mu       sync.RWMutex
+	store    Store
+	values   map[string]string
+	index    *keyIndex        // keys of values in sorted order
+	versions map[string]int64 // bumped on every write, starting at 1, kept when a key is removed
+	expires  map[string]int64 // unix time a key expires, only for keys with a TTL
+	dbPath   string
+
+	// Storage quota, see quota.go
+	valueBytes    int64 // length of all values together
+	maxKeys       int
+	maxValueBytes int64
+
+	// Keys changed or removed in memory but not yet written to the store
+	dirty          map[string]bool
+	deleted        map[string]bool
+	flushBatchSize int
+	flushSignal    chan struct{}
+	flushMu        sync.Mutex // serialises writes to the store
+
+	// Value history, see history.go
+	historyEnabled bool
+	pendingHistory []HistoryRecord
+
+	// Time series, see series.go
+	seriesEnabled  bool
+	seriesPatterns []string
+	pendingSeries  []SeriesPoint
+
+	// Keys removed because their TTL ran out, drained by TakeExpired
+	expired []string
+
+	// Change notification for watchers, see watch.go
+	changed   chan struct{}
+	writeSeq  int64
+	writeSeqs map[string]int64 // writeSeq of each key's latest write
+
+	// Outcome of the latest full checkpoint
+	lastCheckpoint         time.Time
+	lastCheckpointDuration time.Duration
+	lastCheckpointError    string
+}
 
+// NewDatabase creates a database on top of a store. name identifies it in
+// log messages, usually the tenant's data directory.
+func NewDatabase(store Store, name string) *Database {
 	return &Database{
-		db:     db,
-		values: make(map[string]string),
-		dbPath: path,
-	}, nil
+		store:       store,
+		values:      make(map[string]string),
+		index:       newKeyIndex(),
+		versions:    make(map[string]int64),
+		expires:     make(map[string]int64),
+		dbPath:      name,
+		dirty:       make(map[string]bool),
+		deleted:     make(map[string]bool),
+		flushSignal: make(chan struct{}, 1),
+		changed:     make(chan struct{}),
+		writeSeqs:   make(map[string]int64),
+	}
 }
 
-// LoadAll loads all values from database into memory
+// LoadAll loads all values from the store into memory
 func (d *Database) LoadAll() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	rows, err := d.db.Query("SELECT key, value FROM kv")
-	if err != nil {
-		return fmt.Errorf("failed to query database: %w", err)
-	}
-	defer rows.Close()
-
+	now := time.Now().Unix()
 	count := 0
-	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
+	err := d.store.Iterate(func(key string, value StoredValue) error {
+		// Keys that expired while the server was down are dropped on the next flush
+		if value.ExpiresAt > 0 && value.ExpiresAt <= now {
+			d.deleted[key] = true
+			d.versions[key] = value.Version
+			d.expired = append(d.expired, key)
+			return nil
+		}
+		d.values[key] = value.Value
+		d.valueBytes += int64(len(value.Value))
+		d.versions[key] = value.Version
+		if value.ExpiresAt > 0 {
+			d.expires[key] = value.ExpiresAt
 		}
-		d.values[key] = value
 		count++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Loaded %d keys from SQLite\n", count)
-	return rows.Err()
+	keys := make([]string, 0, len(d.values))
+	for key := range d.values {
+		keys = append(keys, key)
+	}
+	d.index.Reset(keys)
+
+	fmt.Printf("Loaded %d keys from %s\n", count, d.dbPath)
+	return nil
 }
 
-// SaveAll saves all in-memory values to database
+// SaveAll saves all in-memory values to the store
 func (d *Database) SaveAll() error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
 
-	tx, err := d.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+	// Snapshot under the lock so writers aren't blocked while the store works
+	d.mu.Lock()
+	snapshot := make(map[string]StoredValue, len(d.values))
+	for key, value := range d.values {
+		snapshot[key] = StoredValue{Value: value, Version: d.versions[key], ExpiresAt: d.expires[key]}
+	}
+	dirty := d.dirty
+	d.dirty = make(map[string]bool)
+	deleted := d.deleted
+	d.deleted = make(map[string]bool)
+	history := d.pendingHistory
+	d.pendingHistory = nil
+	series := d.pendingSeries
+	d.pendingSeries = nil
+	d.mu.Unlock()
+
+	if err := d.store.Write(&StoreBatch{Puts: snapshot, Deletes: deleted, History: history, Series: series}); err != nil {
+		d.markDirty(dirty, deleted, history, series)
+		return err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)")
+	fmt.Printf("Saved %d keys to %s\n", len(snapshot), d.dbPath)
+	return nil
+}
+
+// Checkpoint saves every value with SaveAll and records when it ran, how
+// long it took and whether it failed
+func (d *Database) Checkpoint() error {
+	start := time.Now()
+	err := d.SaveAll()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastCheckpoint = start
+	d.lastCheckpointDuration = time.Since(start)
+	d.lastCheckpointError = ""
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		d.lastCheckpointError = err.Error()
 	}
-	defer stmt.Close()
+	return err
+}
 
-	count := 0
-	for key, value := range d.values {
-		if _, err := stmt.Exec(key, value); err != nil {
-			return fmt.Errorf("failed to insert key %s: %w", key, err)
+// CheckpointStatus returns the time, duration and error of the latest checkpoint
+func (d *Database) CheckpointStatus() (time.Time, time.Duration, string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.lastCheckpoint, d.lastCheckpointDuration, d.lastCheckpointError
+}
+
+// Flush writes the keys changed since the last flush to the store in a single
+// batch and returns how many were written
+func (d *Database) Flush() (int, error) {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	if len(d.dirty) == 0 && len(d.deleted) == 0 && len(d.pendingHistory) == 0 && len(d.pendingSeries) == 0 {
+		d.mu.Unlock()
+		return 0, nil
+	}
+	batch := make(map[string]StoredValue, len(d.dirty))
+	for key := range d.dirty {
+		batch[key] = StoredValue{Value: d.values[key], Version: d.versions[key], ExpiresAt: d.expires[key]}
+	}
+	dirty := d.dirty
+	d.dirty = make(map[string]bool)
+	deleted := d.deleted
+	d.deleted = make(map[string]bool)
+	history := d.pendingHistory
+	d.pendingHistory = nil
+	series := d.pendingSeries
+	d.pendingSeries = nil
+	d.mu.Unlock()
+
+	if err := d.store.Write(&StoreBatch{Puts: batch, Deletes: deleted, History: history, Series: series}); err != nil {
+		// Keep the keys dirty so the next flush retries them
+		d.markDirty(dirty, deleted, history, series)
+		return 0, err
+	}
+
+	return len(batch) + len(deleted), nil
+}
+
+// markDirty flags keys, removals, history records and series points as
+// needing a write to the store. Keys that were written or removed again in
+// the meantime keep their newer state.
+func (d *Database) markDirty(keys, deleted map[string]bool, history []HistoryRecord, series []SeriesPoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key := range keys {
+		if _, exists := d.values[key]; exists {
+			d.dirty[key] = true
+		}
+	}
+	for key := range deleted {
+		if _, exists := d.values[key]; !exists {
+			d.deleted[key] = true
 		}
-		count++
 	}
+	d.pendingHistory = append(history, d.pendingHistory...)
+	d.pendingSeries = append(series, d.pendingSeries...)
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+// StartWriter persists dirty keys in the background every interval, or as
+// soon as batchSize keys are dirty, and does a final flush when ctx is done
+func (d *Database) StartWriter(ctx context.Context, interval time.Duration, batchSize int) {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultFlushBatchSize
 	}
 
-	fmt.Printf("Saved %d keys to SQLite\n", count)
-	return nil
+	d.mu.Lock()
+	d.flushBatchSize = batchSize
+	d.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := d.Flush(); err != nil {
+				fmt.Printf("Final flush of %s failed: %v\n", d.dbPath, err)
+			}
+			return
+		case <-ticker.C:
+		case <-d.flushSignal:
+		}
+
+		if _, err := d.Flush(); err != nil {
+			fmt.Printf("Flush of %s failed: %v\n", d.dbPath, err)
+		}
+	}
 }
 
-// SaveValue saves a single value (in-memory and DB)
+// SaveValue saves a single value in memory and queues it for the background writer
 func (d *Database) SaveValue(key string, value interface{}) error {
+	_, err := d.SaveValueIf(key, value, 0, nil)
+	return err
+}
+
+// SaveValueIf saves a value if cond holds, nil means unconditionally, and
+// returns the key's new version. A ttl above zero makes the key expire,
+// zero keeps it forever. A *VersionConflictError is returned when the
+// condition fails.
+func (d *Database) SaveValueIf(key string, value interface{}, ttl time.Duration, cond *WriteCondition) (int64, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	jsonData, err := json.Marshal(value)
+	now := time.Now()
+	if d.isExpired(key, now.Unix()) {
+		d.expireKey(key)
+	}
+
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+
+	_, exists := d.values[key]
+	var current int64
+	if exists {
+		current = d.versions[key]
+	}
+	if cond != nil {
+		if (cond.IfAbsent && exists) || (!cond.IfAbsent && current != cond.IfVersion) {
+			return 0, &VersionConflictError{Key: key, Current: current}
+		}
+	}
+
+	return d.storeValue(key, value, expiresAt)
+}
+
+// UpdateValue atomically replaces a value with what fn returns. fn gets the
+// current stored JSON, or exists false when the key is missing. The key
+// keeps its expiry. The new version is returned, or fn's error unchanged.
+func (d *Database) UpdateValue(key string, fn func(current string, exists bool) (interface{}, error)) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isExpired(key, time.Now().Unix()) {
+		d.expireKey(key)
+	}
+
+	current, exists := d.values[key]
+	value, err := fn(current, exists)
 	if err != nil {
-		return fmt.Errorf("failed to marshal value: %w", err)
+		return 0, err
 	}
 
-	d.values[key] = string(jsonData)
+	return d.storeValue(key, value, d.expires[key])
+}
 
-	// Also persist to DB immediately for important updates
-	/*_, err = d.db.Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)",
-		key, string(jsonData))
+// storeValue writes a value with the next version and queues it for the
+// background writer. Caller holds d.mu.
+func (d *Database) storeValue(key string, value interface{}, expiresAt int64) (int64, error) {
+	version := d.versions[key] + 1
+	msg, isMessage := value.(*Message)
+	jsonData, err := marshalValue(value, version, expiresAt)
 	if err != nil {
-		return fmt.Errorf("failed to save to db: %w", err)
-	}*/
+		return 0, err
+	}
 
-	return nil
+	if err := d.checkStoreValue(key, string(jsonData)); err != nil {
+		return 0, err
+	}
+
+	d.setValue(key, string(jsonData))
+	d.versions[key] = version
+	d.dirty[key] = true
+	delete(d.deleted, key)
+	if expiresAt > 0 {
+		d.expires[key] = expiresAt
+	} else {
+		delete(d.expires, key)
+	}
+
+	d.writeSeq++
+	d.writeSeqs[key] = d.writeSeq
+	d.notifyChange()
+
+	if isMessage && d.historyEnabled {
+		d.pendingHistory = append(d.pendingHistory, HistoryRecord{
+			Key:         key,
+			Version:     version,
+			Value:       string(jsonData),
+			From:        msg.From,
+			UpdatedTime: msg.UpdatedTime,
+		})
+	}
+
+	// Wake the writer early once a full batch is waiting
+	if d.flushBatchSize > 0 && len(d.dirty) >= d.flushBatchSize {
+		select {
+		case d.flushSignal <- struct{}{}:
+		default:
+		}
+	}
+
+	return version, nil
 }
 
-// GetValue retrieves a value by key
-func (d *Database) GetValue(key string) (string, error) {
+// marshalValue encodes a value for storage. A *Message is stamped with the
+// version and expiry it is stored under.
+func marshalValue(value interface{}, version, expiresAt int64) ([]byte, error) {
+	if msg, ok := value.(*Message); ok {
+		msg.Version = version
+		msg.ExpiresAt = expiresAt
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return jsonData, nil
+}
+
+// UnflushedCount returns the number of keys not yet written to the store
+func (d *Database) UnflushedCount() int {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
+	return len(d.dirty)
+}
+
+// GetValue retrieves a value by key
+func (d *Database) GetValue(key string) (string, error) {
+	value, _, err := d.GetValueWithVersion(key)
+	return value, err
+}
+
+// GetValueWithVersion retrieves a value and its current version by key.
+// An expired key is removed and reported as not found.
+func (d *Database) GetValueWithVersion(key string) (string, int64, error) {
+	d.mu.RLock()
 	value, exists := d.values[key]
+	version := d.versions[key]
+	expired := exists && d.isExpired(key, time.Now().Unix())
+	d.mu.RUnlock()
+
+	if expired {
+		d.removeIfExpired(key)
+		exists = false
+	}
 	if !exists {
-		return "", fmt.Errorf("key not found: %s", key)
+		return "", 0, fmt.Errorf("key not found: %s", key)
 	}
 
-	return value, nil
+	return value, version, nil
 }
 
 // HasValue checks if a key exists
 func (d *Database) HasValue(key string) bool {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	_, exists := d.values[key]
-	return exists
+	_, _, err := d.GetValueWithVersion(key)
+	return err == nil
 }
 
 // CountValues returns the number of stored values
@@ -158,36 +457,198 @@ func (d *Database) CountValues() int {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	return len(d.values)
+	count := len(d.values)
+	now := time.Now().Unix()
+	for key := range d.expires {
+		if d.isExpired(key, now) {
+			count--
+		}
+	}
+	return count
 }
 
-// GetKeys returns all keys
+// GetKeys returns all keys in order
 func (d *Database) GetKeys() []string {
+	keys, _ := d.ScanKeys("", "", nil, 0)
+	return keys
+}
+
+// GetKeysByRegex returns keys matching a regex pattern, in order
+func (d *Database) GetKeysByRegex(re *regexp.Regexp) []string {
+	keys, _ := d.ScanKeys("", "", re, 0)
+	return keys
+}
+
+// GetKeysByPrefix returns keys starting with prefix, in order
+func (d *Database) GetKeysByPrefix(prefix string) []string {
+	keys, _ := d.ScanKeys(prefix, "", nil, 0)
+	return keys
+}
+
+// ScanKeys returns the keys that start with prefix, come after cursor and
+// match re if given, in order. A regex anchored with ^ only scans the keys
+// under its literal prefix. With limit > 0 at most limit keys are returned
+// together with the cursor of the next page, which is empty on the last.
+func (d *Database) ScanKeys(prefix, cursor string, re *regexp.Regexp, limit int) ([]string, string) {
+	return d.scanKeys(prefix, cursor, re, limit, 0)
+}
+
+// scanKeys is ScanKeys that also stops after looking at maxScanned keys of
+// the index when maxScanned > 0, returning the last key looked at as the
+// cursor, so callers can bound the work of a sparse regex scan
+func (d *Database) scanKeys(prefix, cursor string, re *regexp.Regexp, limit, maxScanned int) ([]string, string) {
+	if re != nil {
+		literal := regexLiteralPrefix(re)
+		switch {
+		case strings.HasPrefix(literal, prefix):
+			prefix = literal
+		case !strings.HasPrefix(prefix, literal):
+			// No key can have both prefixes
+			return []string{}, ""
+		}
+	}
+
+	from := prefix
+	if cursor > from {
+		from = cursor
+	}
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	keys := make([]string, 0, len(d.values))
-	for key := range d.values {
+	now := time.Now().Unix()
+	keys := []string{}
+	next := ""
+	scanned, last := 0, ""
+	d.index.Ascend(from, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if key == cursor {
+			return true
+		}
+		if maxScanned > 0 && scanned == maxScanned {
+			next = last
+			return false
+		}
+		scanned++
+		last = key
+		if d.isExpired(key, now) || (re != nil && !re.MatchString(key)) {
+			return true
+		}
+		if limit > 0 && len(keys) == limit {
+			next = keys[len(keys)-1]
+			return false
+		}
 		keys = append(keys, key)
+		return true
+	})
+	return keys, next
+}
+
+// isExpired reports whether a key's TTL has run out. Caller holds d.mu.
+func (d *Database) isExpired(key string, now int64) bool {
+	expiresAt, ok := d.expires[key]
+	return ok && expiresAt <= now
+}
+
+// removeIfExpired removes a key found expired on read, unless it was
+// written again in the meantime
+func (d *Database) removeIfExpired(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isExpired(key, time.Now().Unix()) {
+		d.expireKey(key)
 	}
-	return keys
 }
 
-// GetKeysByRegex returns keys matching a regex pattern
-func (d *Database) GetKeysByRegex(re *regexp.Regexp) []string {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+// expireKey removes an expired key and records it for TakeExpired.
+// Caller holds d.mu.
+func (d *Database) expireKey(key string) {
+	d.removeKey(key)
+	d.expired = append(d.expired, key)
+}
 
-	var matches []string
-	for key := range d.values {
-		if re.MatchString(key) {
-			matches = append(matches, key)
+// setValue sets a key's stored JSON, keeping the key index and the byte
+// count up to date. Caller holds d.mu.
+func (d *Database) setValue(key, value string) {
+	old, exists := d.values[key]
+	if !exists {
+		d.index.Insert(key)
+	}
+	d.valueBytes += int64(len(value) - len(old))
+	d.values[key] = value
+}
+
+// removeKey removes a key from memory and queues its removal from the store.
+// Its version stays behind as a tombstone so a later write of the key gets a
+// higher version and conditional writes and watchers can't mistake it for
+// the removed value. Tombstones last until a restart, after which tenants
+// with history continue from the versions recorded there. Caller holds d.mu.
+func (d *Database) removeKey(key string) {
+	d.valueBytes -= int64(len(d.values[key]))
+	delete(d.values, key)
+	d.index.Delete(key)
+	delete(d.expires, key)
+	delete(d.dirty, key)
+	delete(d.writeSeqs, key)
+	d.deleted[key] = true
+	d.notifyChange()
+}
+
+// DeleteValues removes the given keys and returns the ones that existed
+func (d *Database) DeleteValues(keys []string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	var removed []string
+	for _, key := range keys {
+		if _, exists := d.values[key]; !exists {
+			continue
+		}
+		if d.isExpired(key, now) {
+			d.expireKey(key)
+			continue
+		}
+		d.removeKey(key)
+		removed = append(removed, key)
+	}
+
+	if d.flushBatchSize > 0 && len(d.deleted) >= d.flushBatchSize {
+		select {
+		case d.flushSignal <- struct{}{}:
+		default:
 		}
 	}
-	return matches
+	return removed
+}
+
+// ExpireValues removes every key whose TTL has run out
+func (d *Database) ExpireValues() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	for key := range d.expires {
+		if d.isExpired(key, now) {
+			d.expireKey(key)
+		}
+	}
+}
+
+// TakeExpired returns the keys removed by expiry since the last call
+func (d *Database) TakeExpired() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expired := d.expired
+	d.expired = nil
+	return expired
 }
 
-// Close closes the database connection
+// Close closes the store
 func (d *Database) Close() error {
-	return d.db.Close()
+	return d.store.Close()
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a database on an in-memory store
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	return NewDatabase(newMemoryStore(), t.Name())
+}
+
+func TestSaveValueIfVersion(t *testing.T) {
+	d := newTestDatabase(t)
+
+	version, err := d.SaveValueIf("k", "one", 0, nil)
+	if err != nil || version != 1 {
+		t.Fatalf("got version %d, %v, want 1", version, err)
+	}
+	version, err = d.SaveValueIf("k", "two", 0, &WriteCondition{IfVersion: 1})
+	if err != nil || version != 2 {
+		t.Fatalf("got version %d, %v, want 2", version, err)
+	}
+
+	_, err = d.SaveValueIf("k", "stale", 0, &WriteCondition{IfVersion: 1})
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) || conflict.Current != 2 {
+		t.Fatalf("got %v, want a conflict at version 2", err)
+	}
+	if value, _ := d.GetValue("k"); value != `"two"` {
+		t.Errorf("conflicting write changed the value to %s", value)
+	}
+
+	_, err = d.SaveValueIf("missing", "x", 0, &WriteCondition{IfVersion: 1})
+	if !errors.As(err, &conflict) || conflict.Current != 0 {
+		t.Errorf("got %v, want a conflict at version 0 for a missing key", err)
+	}
+}
+
+func TestSaveValueIfAbsent(t *testing.T) {
+	d := newTestDatabase(t)
+
+	if _, err := d.SaveValueIf("k", "first", 0, &WriteCondition{IfAbsent: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := d.SaveValueIf("k", "second", 0, &WriteCondition{IfAbsent: true})
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) || conflict.Current != 1 {
+		t.Fatalf("got %v, want a conflict at version 1", err)
+	}
+	if value, _ := d.GetValue("k"); value != `"first"` {
+		t.Errorf("got %s, want the first value kept", value)
+	}
+}
+
+// expireNow makes a key's TTL run out without waiting for it
+func expireNow(d *Database, key string) {
+	d.mu.Lock()
+	d.expires[key] = time.Now().Unix() - 1
+	d.mu.Unlock()
+}
+
+func TestTTLExpiry(t *testing.T) {
+	d := newTestDatabase(t)
+
+	if _, err := d.SaveValueIf("session", "abc", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !d.HasValue("session") {
+		t.Fatal("value with a TTL missing before it expired")
+	}
+
+	expireNow(d, "session")
+	if d.HasValue("session") {
+		t.Fatal("expired value still readable")
+	}
+	if expired := d.TakeExpired(); len(expired) != 1 || expired[0] != "session" {
+		t.Errorf("got expired keys %v, want [session]", expired)
+	}
+
+	d.SaveValueIf("swept", "x", time.Hour, nil)
+	expireNow(d, "swept")
+	d.ExpireValues()
+	if d.CountValues() != 0 {
+		t.Errorf("%d values left after the sweep, want 0", d.CountValues())
+	}
+}
+
+func TestTTLClearedByWriteWithoutTTL(t *testing.T) {
+	d := newTestDatabase(t)
+	d.SaveValueIf("k", "temporary", time.Hour, nil)
+	d.SaveValue("k", "forever")
+
+	d.mu.RLock()
+	_, expires := d.expires["k"]
+	d.mu.RUnlock()
+	if expires {
+		t.Error("write without a TTL kept the old expiry")
+	}
+}
+
+func TestVersionSurvivesExpiryAndDelete(t *testing.T) {
+	d := newTestDatabase(t)
+
+	d.SaveValueIf("k", "one", time.Hour, nil)
+	d.SaveValueIf("k", "two", time.Hour, nil)
+	expireNow(d, "k")
+
+	version, err := d.SaveValueIf("k", "three", 0, &WriteCondition{IfAbsent: true})
+	if err != nil {
+		t.Fatalf("re-creating an expired key failed: %v", err)
+	}
+	if version != 3 {
+		t.Errorf("re-created key got version %d, want 3", version)
+	}
+
+	d.DeleteValues([]string{"k"})
+	if version, _ := d.SaveValueIf("k", "four", 0, nil); version != 4 {
+		t.Errorf("key written after a delete got version %d, want 4", version)
+	}
+
+	_, err = d.SaveValueIf("k", "stale", 0, &WriteCondition{IfVersion: 2})
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("write conditioned on a removed version got %v, want a conflict", err)
+	}
+}
+
+// flakyStore is a memory store whose batch writes fail while fail is set
+type flakyStore struct {
+	*memoryStore
+	fail bool
+}
+
+func (s *flakyStore) Write(batch *StoreBatch) error {
+	if s.fail {
+		return fmt.Errorf("disk full")
+	}
+	return s.memoryStore.Write(batch)
+}
+
+func TestFlushWritesChangedKeys(t *testing.T) {
+	store := &flakyStore{memoryStore: newMemoryStore()}
+	d := NewDatabase(store, t.Name())
+	d.SaveValue("/a", 1)
+	d.SaveValue("/b", 2)
+
+	if _, found, _ := store.Get("/a"); found {
+		t.Fatal("value written through before a flush")
+	}
+	if n, err := d.Flush(); err != nil || n != 2 {
+		t.Fatalf("flushed %d keys, %v, want 2", n, err)
+	}
+	if d.UnflushedCount() != 0 {
+		t.Errorf("%d keys still unflushed", d.UnflushedCount())
+	}
+
+	d.DeleteValues([]string{"/a"})
+	d.SaveValue("/b", 3)
+	store.fail = true
+	if _, err := d.Flush(); err == nil {
+		t.Fatal("flush to a failing store succeeded")
+	}
+	store.fail = false
+	if n, err := d.Flush(); err != nil || n != 2 {
+		t.Fatalf("retried flush wrote %d keys, %v, want 2", n, err)
+	}
+	if _, found, _ := store.Get("/a"); found {
+		t.Error("retried flush lost the delete")
+	}
+	if value, _, _ := store.Get("/b"); value.Value != "3" || value.Version != 2 {
+		t.Errorf("retried flush stored %+v", value)
+	}
+}
+
+func TestWriterFlushesFullBatchEarly(t *testing.T) {
+	store := newMemoryStore()
+	d := NewDatabase(store, t.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		d.StartWriter(ctx, time.Hour, 2)
+		close(stopped)
+	}()
+
+	// Wait for the writer to pick up its batch size
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		d.mu.RLock()
+		ready := d.flushBatchSize == 2
+		d.mu.RUnlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writer didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.SaveValue("/a", 1)
+	d.SaveValue("/b", 2)
+	for deadline := time.Now().Add(5 * time.Second); d.UnflushedCount() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("full batch not flushed before the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.SaveValue("/c", 3)
+	cancel()
+	<-stopped
+	if _, found, _ := store.Get("/c"); !found {
+		t.Error("writer didn't flush on shutdown")
+	}
+}
+
+func TestCheckpointStatus(t *testing.T) {
+	store := &flakyStore{memoryStore: newMemoryStore()}
+	d := NewDatabase(store, t.Name())
+	d.SaveValue("/a", 1)
+
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	at, _, errMsg := d.CheckpointStatus()
+	if at.IsZero() || errMsg != "" {
+		t.Errorf("got checkpoint at %v with error %q", at, errMsg)
+	}
+
+	store.fail = true
+	if err := d.Checkpoint(); err == nil {
+		t.Fatal("checkpoint to a failing store succeeded")
+	}
+	if _, _, errMsg := d.CheckpointStatus(); errMsg != "disk full" {
+		t.Errorf("got checkpoint error %q", errMsg)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// dataLockName is the lock file in the data directory. A running server
+// and the offline commands that change tenant data hold it, so they never
+// write the same stores at once.
+const dataLockName = "moustique.lock"
+
+// errDataLocked is returned when another process holds the data lock
+var errDataLocked = errors.New("locked by another process")
+
+// lockDataDir takes the lock on dataDir and returns a function releasing
+// it. The lock also goes when the process exits.
+func lockDataDir(dataDir string) (func(), error) {
+	file, err := openLockFile(filepath.Join(dataDir, dataLockName))
+	if errors.Is(err, errDataLocked) {
+		return nil, fmt.Errorf("%s is in use by a running server or another command", dataDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", dataDir, err)
+	}
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables that override the master keys in the config
+const (
+	masterKeyEnv         = "MOUSTIQUE_MASTER_KEY"
+	previousMasterKeyEnv = "MOUSTIQUE_PREVIOUS_MASTER_KEY"
+)
+
+// keyringKey is the reserved store key holding a tenant's wrapped data
+// keys. It travels with the data into backups and is hidden from the Database.
+const keyringKey = "\x00moustique/keyring"
+
+// encryptedPrefix starts every encrypted value, followed by the id of the
+// data key and the base64 nonce and ciphertext. Stored values are JSON, so
+// plaintext never starts with it.
+const encryptedPrefix = "enc:"
+
+// GenerateMasterKey returns a new random master key, base64 encoded
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// masterKeys returns the master key and the previous one, if any. The
+// environment takes precedence over the config.
+func (c DatabaseConfig) masterKeys() (current, previous []byte, err error) {
+	parse := func(name, value string) ([]byte, error) {
+		if value == "" {
+			return nil, nil
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must be 32 bytes, base64 encoded", name)
+		}
+		return key, nil
+	}
+
+	currentValue, previousValue := c.MasterKey, c.PreviousMasterKey
+	if env := os.Getenv(masterKeyEnv); env != "" {
+		currentValue = env
+	}
+	if env := os.Getenv(previousMasterKeyEnv); env != "" {
+		previousValue = env
+	}
+
+	if current, err = parse("master key", currentValue); err != nil {
+		return nil, nil, err
+	}
+	if current == nil {
+		return nil, nil, fmt.Errorf("encryption needs a master key in master_key or %s", masterKeyEnv)
+	}
+	if previous, err = parse("previous master key", previousValue); err != nil {
+		return nil, nil, err
+	}
+	return current, previous, nil
+}
+
+// openTenantStore opens a tenant's store, encrypted when the config asks
+// for it. Values of an unencrypted store are encrypted on first open.
+func openTenantStore(dbConfig DatabaseConfig, dataDir, tenant string) (Store, error) {
+	backend := dbConfig.BackendFor(tenant)
+	store, err := OpenStore(backend, dataDir, dbConfig.Sync)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing of the memory backend reaches the disk
+	if !dbConfig.Encryption || backend == BackendMemory {
+		return store, nil
+	}
+
+	master, previous, err := dbConfig.masterKeys()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	encrypted, err := newEncryptedStore(store, master, previous)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to open encrypted store for %s: %w", tenant, err)
+	}
+	return encrypted, nil
+}
+
+// sealAES encrypts with AES-256-GCM and returns the nonce followed by the
+// ciphertext
+func sealAES(key, plaintext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// openAES decrypts what sealAES returned
+func openAES(key, sealed, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyring is the stored form of a tenant's data keys, each wrapped with
+// the master key. Older keys are kept to read history recorded under them.
+type keyring struct {
+	Current int            `json:"current"`
+	Keys    map[int]string `json:"keys"` // id -> base64 wrapped key
+}
+
+// wrapAAD binds a wrapped data key to its id
+func wrapAAD(id int) []byte {
+	return []byte("moustique data key " + strconv.Itoa(id))
+}
+
+// encryptedStore encrypts the values of the store it wraps with the
+// tenant's data key. Keys stay readable so lookups and prefix scans work.
+// Time series are not kept for encrypted tenants.
+type encryptedStore struct {
+	Store
+	master  []byte
+	keys    map[int][]byte
+	current int
+}
+
+// newEncryptedStore unlocks the data keys of store with the master key,
+// falling back to the previous master key and rewrapping with the current
+// one. A store without data keys gets one and its values are encrypted.
+func newEncryptedStore(store Store, master, previous []byte) (*encryptedStore, error) {
+	s := &encryptedStore{Store: store, master: master, keys: make(map[int][]byte)}
+
+	stored, exists, err := store.Get(keyringKey)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return s, s.migrate()
+	}
+
+	var ring keyring
+	if err := json.Unmarshal([]byte(stored.Value), &ring); err != nil {
+		return nil, fmt.Errorf("invalid keyring: %w", err)
+	}
+	rewrap := false
+	for id, wrapped := range ring.Keys {
+		sealed, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data key %d: %w", id, err)
+		}
+		key, err := openAES(master, sealed, wrapAAD(id))
+		if err != nil && previous != nil {
+			key, err = openAES(previous, sealed, wrapAAD(id))
+			rewrap = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("data key %d doesn't open with the master key", id)
+		}
+		s.keys[id] = key
+	}
+	if _, ok := s.keys[ring.Current]; !ok {
+		return nil, fmt.Errorf("current data key %d is missing", ring.Current)
+	}
+	s.current = ring.Current
+
+	if rewrap {
+		batch, err := s.keyringBatch()
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Write(batch); err != nil {
+			return nil, fmt.Errorf("failed to rewrap data keys: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// keyringBatch returns a batch storing the data keys wrapped with the
+// current master key
+func (s *encryptedStore) keyringBatch() (*StoreBatch, error) {
+	ring := keyring{Current: s.current, Keys: make(map[int]string, len(s.keys))}
+	for id, key := range s.keys {
+		sealed, err := sealAES(s.master, key, wrapAAD(id))
+		if err != nil {
+			return nil, err
+		}
+		ring.Keys[id] = base64.StdEncoding.EncodeToString(sealed)
+	}
+	data, err := json.Marshal(ring)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreBatch{
+		Puts:    map[string]StoredValue{keyringKey: {Value: string(data)}},
+		Deletes: make(map[string]bool),
+	}, nil
+}
+
+// newDataKey adds a random data key and makes it current
+func (s *encryptedStore) newDataKey() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	s.current++
+	for s.keys[s.current] != nil {
+		s.current++
+	}
+	s.keys[s.current] = key
+	return nil
+}
+
+// compactStore is implemented by stores that can rewrite their files so
+// replaced values don't linger on disk
+type compactStore interface {
+	Compact() error
+}
+
+// historyRewriter is implemented by stores whose recorded history can be
+// rewritten in place
+type historyRewriter interface {
+	RewriteHistory(fn func(key, value string) (string, error)) error
+}
+
+// migrate gives a store its first data key and encrypts its plaintext
+// values, together in one batch, and then its recorded history
+func (s *encryptedStore) migrate() error {
+	if err := s.newDataKey(); err != nil {
+		return err
+	}
+	if _, err := s.reencrypt(); err != nil {
+		return err
+	}
+	if history, ok := s.Store.(historyRewriter); ok {
+		err := history.RewriteHistory(func(key, value string) (string, error) {
+			if strings.HasPrefix(value, encryptedPrefix) {
+				return value, nil
+			}
+			return s.encrypt(key, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.compact()
+}
+
+// compact drops the replaced values from the store's files
+func (s *encryptedStore) compact() error {
+	if store, ok := s.Store.(compactStore); ok {
+		return store.Compact()
+	}
+	return nil
+}
+
+// RotateKey makes a new data key current and re-encrypts every value with
+// it. It returns the number of values re-encrypted.
+func (s *encryptedStore) RotateKey() (int, error) {
+	if err := s.newDataKey(); err != nil {
+		return 0, err
+	}
+	count, err := s.reencrypt()
+	if err != nil {
+		return 0, err
+	}
+	return count, s.compact()
+}
+
+// reencrypt writes every value encrypted with the current data key, along
+// with the keyring, in one batch, and returns how many there were
+func (s *encryptedStore) reencrypt() (int, error) {
+	batch, err := s.keyringBatch()
+	if err != nil {
+		return 0, err
+	}
+	err = s.Iterate(func(key string, value StoredValue) error {
+		sealed, err := s.encrypt(key, value.Value)
+		if err != nil {
+			return err
+		}
+		value.Value = sealed
+		batch.Puts[key] = value
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.Store.Write(batch); err != nil {
+		return 0, fmt.Errorf("failed to write encrypted values: %w", err)
+	}
+	return len(batch.Puts) - 1, nil
+}
+
+// encrypt seals a value with the current data key, bound to its store key
+func (s *encryptedStore) encrypt(key, value string) (string, error) {
+	sealed, err := sealAES(s.keys[s.current], []byte(value), []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt %s: %w", key, err)
+	}
+	return encryptedPrefix + strconv.Itoa(s.current) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a value sealed by encrypt. Plaintext is returned as is.
+func (s *encryptedStore) decrypt(key, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(value[len(encryptedPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid encrypted value for %s", key)
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || s.keys[id] == nil {
+		return "", fmt.Errorf("unknown data key %s for %s", parts[0], key)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value for %s: %w", key, err)
+	}
+	plaintext, err := openAES(s.keys[id], sealed, []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", key, err)
+	}
+	return string(plaintext), nil
+}
+
+func (s *encryptedStore) Get(key string) (StoredValue, bool, error) {
+	if key == keyringKey {
+		return StoredValue{}, false, nil
+	}
+	value, exists, err := s.Store.Get(key)
+	if err != nil || !exists {
+		return value, exists, err
+	}
+	value.Value, err = s.decrypt(key, value.Value)
+	return value, err == nil, err
+}
+
+func (s *encryptedStore) Put(key string, value StoredValue) error {
+	return s.Write(&StoreBatch{Puts: map[string]StoredValue{key: value}})
+}
+
+func (s *encryptedStore) Delete(key string) error {
+	if key == keyringKey {
+		return nil
+	}
+	return s.Store.Delete(key)
+}
+
+func (s *encryptedStore) Scan(prefix string, fn func(key string, value StoredValue) error) error {
+	return s.Store.Scan(prefix, s.decrypting(fn))
+}
+
+func (s *encryptedStore) Iterate(fn func(key string, value StoredValue) error) error {
+	return s.Store.Iterate(s.decrypting(fn))
+}
+
+// decrypting wraps a scan callback to skip the keyring and decrypt values
+func (s *encryptedStore) decrypting(fn func(key string, value StoredValue) error) func(string, StoredValue) error {
+	return func(key string, value StoredValue) error {
+		if key == keyringKey {
+			return nil
+		}
+		plaintext, err := s.decrypt(key, value.Value)
+		if err != nil {
+			return err
+		}
+		value.Value = plaintext
+		return fn(key, value)
+	}
+}
+
+// Write encrypts the values and history of a batch and passes it on. The
+// caller's batch is left as is, it may be retried. Time series points are
+// rolled up in plain numbers, so a batch carrying any is refused.
+func (s *encryptedStore) Write(batch *StoreBatch) error {
+	if len(batch.Series) > 0 {
+		return errSeriesUnsupported
+	}
+
+	sealed := &StoreBatch{
+		Puts:    make(map[string]StoredValue, len(batch.Puts)),
+		Deletes: make(map[string]bool, len(batch.Deletes)),
+		History: make([]HistoryRecord, len(batch.History)),
+	}
+	for key, deleted := range batch.Deletes {
+		if key != keyringKey {
+			sealed.Deletes[key] = deleted
+		}
+	}
+	for key, value := range batch.Puts {
+		if key == keyringKey {
+			continue
+		}
+		var err error
+		if value.Value, err = s.encrypt(key, value.Value); err != nil {
+			return err
+		}
+		sealed.Puts[key] = value
+	}
+	for i, record := range batch.History {
+		var err error
+		if record.Value, err = s.encrypt(record.Key, record.Value); err != nil {
+			return err
+		}
+		sealed.History[i] = record
+	}
+	return s.Store.Write(sealed)
+}
+
+// EnableHistory passes on to the wrapped store if it keeps history
+func (s *encryptedStore) EnableHistory(maxVersions int, maxAge time.Duration) (map[string]int64, error) {
+	store, ok := s.Store.(historyStore)
+	if !ok {
+		return nil, fmt.Errorf("value history is not supported by this storage backend")
+	}
+	return store.EnableHistory(maxVersions, maxAge)
+}
+
+func (s *encryptedStore) History(key string, limit int) ([]HistoryRecord, error) {
+	records, err := s.Store.(historyStore).History(key, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].Value, err = s.decrypt(key, records[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (s *encryptedStore) HistoryAt(key string, at int64) (*HistoryRecord, error) {
+	return s.decryptRecord(s.Store.(historyStore).HistoryAt(key, at))
+}
+
+func (s *encryptedStore) HistoryVersion(key string, version int64) (*HistoryRecord, error) {
+	return s.decryptRecord(s.Store.(historyStore).HistoryVersion(key, version))
+}
+
+func (s *encryptedStore) decryptRecord(record *HistoryRecord, err error) (*HistoryRecord, error) {
+	if err != nil || record == nil {
+		return record, err
+	}
+	record.Value, err = s.decrypt(record.Key, record.Value)
+	return record, err
+}
+
+// Backup copies the wrapped store as it is, encrypted and with its keyring
+func (s *encryptedStore) Backup(dir string) error {
+	store, ok := s.Store.(backupStore)
+	if !ok {
+		return fmt.Errorf("backups are not supported by this storage backend")
+	}
+	return store.Backup(dir)
+}
+
+// RotateTenantKey gives a tenant a new data key and re-encrypts its values,
+// with the server stopped. History recorded earlier stays readable with the
+// older keys kept in the keyring.
+func RotateTenantKey(dbConfig DatabaseConfig, dataDir, tenant string) (int, error) {
+	if !dbConfig.Encryption {
+		return 0, fmt.Errorf("encryption is not enabled")
+	}
+	dir := tenantDataDir(dataDir, tenant)
+	if _, err := os.Stat(dir); err != nil {
+		return 0, fmt.Errorf("no data for tenant %s", tenant)
+	}
+
+	store, err := openTenantStore(dbConfig, dir, tenant)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	encrypted, ok := store.(*encryptedStore)
+	if !ok {
+		return 0, fmt.Errorf("the %s storage backend is not encrypted", dbConfig.BackendFor(tenant))
+	}
+	return encrypted.RotateKey()
+}
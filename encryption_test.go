@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newEncryptionConfig returns a file backend config encrypted with a new
+// master key, clearing any master key in the environment
+func newEncryptionConfig(t *testing.T) DatabaseConfig {
+	t.Helper()
+	t.Setenv(masterKeyEnv, "")
+	t.Setenv(previousMasterKeyEnv, "")
+	key, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DatabaseConfig{Backend: BackendFile, Sync: "off", Encryption: true, MasterKey: key}
+}
+
+// readTenant returns a tenant's values and its store file as on disk
+func readTenant(t *testing.T, dbConfig DatabaseConfig, dataDir string) (map[string]string, string) {
+	t.Helper()
+	d, err := openTenantDatabase(dbConfig, dataDir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	values := make(map[string]string)
+	for _, key := range d.GetKeys() {
+		values[key], _ = d.GetValue(key)
+	}
+	raw, err := os.ReadFile(filepath.Join(tenantDataDir(dataDir, "alice"), storeFileName(BackendFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values, string(raw)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dbConfig := newEncryptionConfig(t)
+	dataDir := t.TempDir()
+
+	// A tenant stored in plaintext is encrypted when first opened
+	plain := dbConfig
+	plain.Encryption = false
+	d, err := openTenantDatabase(plain, dataDir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SaveValue("/old", "plaintext secret")
+	d.SaveAll()
+	d.Close()
+
+	d, err = openTenantDatabase(dbConfig, dataDir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SaveValue("/new", "encrypted secret")
+	d.SaveAll()
+	d.Close()
+
+	values, raw := readTenant(t, dbConfig, dataDir)
+	if values["/old"] != `"plaintext secret"` || values["/new"] != `"encrypted secret"` || len(values) != 2 {
+		t.Errorf("read back %v", values)
+	}
+	if strings.Contains(raw, "secret") {
+		t.Error("store file holds plaintext")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dbConfig := newEncryptionConfig(t)
+	dataDir := t.TempDir()
+
+	d, err := openTenantDatabase(dbConfig, dataDir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SaveValue("/a", "one")
+	d.SaveValue("/b", "two")
+	d.SaveAll()
+	d.Close()
+
+	count, err := RotateTenantKey(dbConfig, dataDir, "alice")
+	if err != nil || count != 2 {
+		t.Fatalf("rotation re-encrypted %d values, %v, want 2", count, err)
+	}
+	values, raw := readTenant(t, dbConfig, dataDir)
+	if values["/a"] != `"one"` || values["/b"] != `"two"` {
+		t.Errorf("read back %v after rotation", values)
+	}
+	if strings.Contains(raw, encryptedPrefix+"1:") || !strings.Contains(raw, encryptedPrefix+"2:") {
+		t.Error("values not re-encrypted with the new data key")
+	}
+}
+
+func TestEncryptionMasterKeyChange(t *testing.T) {
+	dbConfig := newEncryptionConfig(t)
+	dataDir := t.TempDir()
+
+	d, err := openTenantDatabase(dbConfig, dataDir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SaveValue("/a", "one")
+	d.SaveAll()
+	d.Close()
+
+	wrong := dbConfig
+	wrong.MasterKey, _ = GenerateMasterKey()
+	if _, err := openTenantDatabase(wrong, dataDir, "alice"); err == nil {
+		t.Fatal("opened with the wrong master key")
+	}
+
+	// The previous key opens the data keys once, which are then rewrapped
+	changed := wrong
+	changed.PreviousMasterKey = dbConfig.MasterKey
+	if values, _ := readTenant(t, changed, dataDir); values["/a"] != `"one"` {
+		t.Fatalf("read back %v with the previous master key", values)
+	}
+	if values, _ := readTenant(t, wrong, dataDir); values["/a"] != `"one"` {
+		t.Errorf("read back %v with only the new master key", values)
+	}
+}
+
+func TestEncryptionMasterKeyErrors(t *testing.T) {
+	t.Setenv(masterKeyEnv, "")
+	t.Setenv(previousMasterKeyEnv, "")
+	for name, dbConfig := range map[string]DatabaseConfig{
+		"missing":      {Encryption: true},
+		"short":        {Encryption: true, MasterKey: "c2hvcnQ="},
+		"not base64":   {Encryption: true, MasterKey: "not a key!"},
+		"bad previous": {Encryption: true, MasterKey: strings.Repeat("A", 43) + "=", PreviousMasterKey: "c2hvcnQ="},
+	} {
+		if _, _, err := dbConfig.masterKeys(); err == nil {
+			t.Errorf("%s master key accepted", name)
+		}
+	}
+}
+
+func TestEncryptionRefusesTimeSeries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("database:\n  encryption: true\n  master_key: "+strings.Repeat("A", 43)+"=\n"), 0600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("encryption accepted with time series on")
+	}
+
+	os.WriteFile(path, []byte("database:\n  encryption: true\n  series: false\n  master_key: "+strings.Repeat("A", 43)+"=\n"), 0600)
+	if _, err := LoadConfig(path); err != nil {
+		t.Errorf("encryption without time series refused: %v", err)
+	}
+}
+
+func TestEncryptedWriteKeepsBatch(t *testing.T) {
+	inner := newMemoryStore()
+	s, err := newEncryptedStore(inner, make([]byte, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &StoreBatch{
+		Puts:    map[string]StoredValue{"/a": {Value: `"secret"`, Version: 1}},
+		Deletes: map[string]bool{"/b": true, keyringKey: true},
+	}
+	if err := s.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Puts["/a"].Value != `"secret"` || !batch.Deletes[keyringKey] {
+		t.Errorf("write changed the caller's batch to %+v", batch)
+	}
+	if _, found, _ := inner.Get(keyringKey); !found {
+		t.Error("write deleted the keyring")
+	}
+
+	if err := s.Write(&StoreBatch{Series: []SeriesPoint{{Topic: "/t", Value: 1}}}); err != errSeriesUnsupported {
+		t.Errorf("batch with series points got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ExportRecord is one line of a tenant export in NDJSON
+type ExportRecord struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Version   int64           `json:"version,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"` // unix time, 0 = never
+}
+
+// Import modes
+const (
+	ImportMerge   = "merge"   // add and overwrite the imported keys, keep the rest
+	ImportReplace = "replace" // also remove every key not in the import
+)
+
+// maxImportLineSize bounds a single NDJSON line on import
+const maxImportLineSize = 16 * 1024 * 1024
+
+// tenantDataDir returns the data directory of a tenant, "public" being the
+// unauthenticated broker
+func tenantDataDir(dataDir, tenant string) string {
+	if tenant == "public" {
+		return filepath.Join(dataDir, "public")
+	}
+	return filepath.Join(dataDir, "users", tenant)
+}
+
+// Export calls fn for every live key in key order
+func (d *Database) Export(fn func(record *ExportRecord) error) error {
+	d.mu.RLock()
+	now := time.Now().Unix()
+	records := make([]*ExportRecord, 0, len(d.values))
+	for key, value := range d.values {
+		if d.isExpired(key, now) {
+			continue
+		}
+		records = append(records, &ExportRecord{
+			Key:       key,
+			Value:     json.RawMessage(value),
+			Version:   d.versions[key],
+			ExpiresAt: d.expires[key],
+		})
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadExport parses and validates an NDJSON export. Nothing is returned
+// unless every line is valid.
+func ReadExport(r io.Reader) ([]*ExportRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+
+	var records []*ExportRecord
+	seen := make(map[string]bool)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var record ExportRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := record.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if seen[record.Key] {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line, record.Key)
+		}
+		seen[record.Key] = true
+		records = append(records, &record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", line+1, err)
+	}
+	return records, nil
+}
+
+func (r *ExportRecord) validate() error {
+	if r.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if len(r.Value) == 0 {
+		return fmt.Errorf("missing value for key %s", r.Key)
+	}
+	var msg Message
+	if err := json.Unmarshal(r.Value, &msg); err != nil {
+		return fmt.Errorf("invalid value for key %s: %w", r.Key, err)
+	}
+	if r.Version < 0 || r.ExpiresAt < 0 {
+		return fmt.Errorf("invalid metadata for key %s", r.Key)
+	}
+	return nil
+}
+
+// Import applies validated records in one step and saves the database in
+// full with SaveAll. Imported versions are kept unless the key already has
+// a newer one, which is then bumped so conditional writes notice the
+// change. Records that have already expired are skipped. It returns the
+// number of keys imported.
+func (d *Database) Import(records []*ExportRecord, mode string) (int, error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return 0, fmt.Errorf("invalid import mode: %s", mode)
+	}
+
+	now := time.Now().Unix()
+	values := make([]string, len(records))
+	for i, record := range records {
+		var compact bytes.Buffer
+		json.Compact(&compact, record.Value)
+		values[i] = compact.String()
+	}
+
+	d.mu.Lock()
+	if err := d.checkImportStorage(records, values, mode == ImportReplace, now); err != nil {
+		d.mu.Unlock()
+		return 0, err
+	}
+
+	// Removed keys keep their versions, so a replaced key still comes back
+	// at a higher version below
+	if mode == ImportReplace {
+		for key := range d.values {
+			d.removeKey(key)
+		}
+	}
+
+	imported := 0
+	for i, record := range records {
+		if record.ExpiresAt > 0 && record.ExpiresAt <= now {
+			continue
+		}
+
+		version := record.Version
+		if current := d.versions[record.Key]; current >= version {
+			version = current + 1
+		}
+
+		d.setValue(record.Key, values[i])
+		d.versions[record.Key] = version
+		if record.ExpiresAt > 0 {
+			d.expires[record.Key] = record.ExpiresAt
+		} else {
+			delete(d.expires, record.Key)
+		}
+		d.dirty[record.Key] = true
+		delete(d.deleted, record.Key)
+		d.writeSeq++
+		d.writeSeqs[record.Key] = d.writeSeq
+		imported++
+	}
+	d.notifyChange()
+	d.mu.Unlock()
+
+	if err := d.SaveAll(); err != nil {
+		return imported, fmt.Errorf("imported %d keys but failed to save: %w", imported, err)
+	}
+	return imported, nil
+}
+
+// openTenantDatabase opens and loads a tenant database outside a running
+// server, for the export and import command line flags
+func openTenantDatabase(dbConfig DatabaseConfig, dataDir, tenant string) (*Database, error) {
+	dir := tenantDataDir(dataDir, tenant)
+	store, err := openTenantStore(dbConfig, dir, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewDatabase(store, dir)
+	if err := db.LoadAll(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ExportTenant writes a tenant's values as NDJSON to path
+func ExportTenant(dbConfig DatabaseConfig, dataDir, tenant, path string) (int, error) {
+	// Opening the store would create an empty database for a missing tenant
+	if _, err := os.Stat(tenantDataDir(dataDir, tenant)); err != nil {
+		return 0, fmt.Errorf("no data for tenant %s", tenant)
+	}
+
+	db, err := openTenantDatabase(dbConfig, dataDir, tenant)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	count := 0
+	err = db.Export(func(record *ExportRecord) error {
+		count++
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to write export: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write export: %w", err)
+	}
+	return count, file.Sync()
+}
+
+// ImportTenant reads an NDJSON export from path into a tenant's database
+func ImportTenant(dbConfig DatabaseConfig, dataDir, tenant, path, mode string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer file.Close()
+
+	records, err := ReadExport(file)
+	if err != nil {
+		return 0, fmt.Errorf("invalid import file: %w", err)
+	}
+
+	db, err := openTenantDatabase(dbConfig, dataDir, tenant)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	return db.Import(records, mode)
+}
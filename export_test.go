@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportNDJSON exports a database the way ExportTenant writes it
+func exportNDJSON(t *testing.T, d *Database) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if err := d.Export(func(record *ExportRecord) error { return encoder.Encode(record) }); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := newTestDatabase(t)
+	src.SaveValue("/a", &Message{Message: "one"})
+	src.SaveValue("/a", &Message{Message: "two"})
+	src.SaveValueIf("/b", &Message{Message: "temporary"}, time.Hour, nil)
+
+	records, err := ReadExport(exportNDJSON(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestDatabase(t)
+	if n, err := dst.Import(records, ImportMerge); err != nil || n != 2 {
+		t.Fatalf("imported %d keys, %v, want 2", n, err)
+	}
+
+	for _, key := range []string{"/a", "/b"} {
+		want, wantVersion, _ := src.GetValueWithVersion(key)
+		got, gotVersion, err := dst.GetValueWithVersion(key)
+		if err != nil || got != want || gotVersion != wantVersion {
+			t.Errorf("%s imported as %s at version %d, %v, want %s at version %d", key, got, gotVersion, err, want, wantVersion)
+		}
+	}
+	if dst.expires["/b"] != src.expires["/b"] {
+		t.Errorf("expiry imported as %d, want %d", dst.expires["/b"], src.expires["/b"])
+	}
+}
+
+func TestImportReplaceKeepsVersionsRising(t *testing.T) {
+	d := newTestDatabase(t)
+	for i := 0; i < 3; i++ {
+		d.SaveValue("/a", &Message{Message: "local"})
+	}
+	d.SaveValue("/local", &Message{Message: "not in the import"})
+
+	records := []*ExportRecord{{Key: "/a", Value: json.RawMessage(`{"message":"imported"}`), Version: 1}}
+	if _, err := d.Import(records, ImportReplace); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, version, _ := d.GetValueWithVersion("/a"); version != 4 {
+		t.Errorf("replaced key got version %d, want 4", version)
+	}
+	if d.HasValue("/local") {
+		t.Error("replace kept a key missing from the import")
+	}
+}
+
+func TestImportSkipsExpiredRecords(t *testing.T) {
+	d := newTestDatabase(t)
+	records := []*ExportRecord{
+		{Key: "/old", Value: json.RawMessage(`{}`), ExpiresAt: time.Now().Unix() - 1},
+		{Key: "/new", Value: json.RawMessage(`{}`)},
+	}
+	if n, err := d.Import(records, ImportMerge); err != nil || n != 1 {
+		t.Errorf("imported %d keys, %v, want 1", n, err)
+	}
+	if _, err := d.Import(records, "upsert"); err == nil {
+		t.Error("invalid import mode accepted")
+	}
+}
+
+func TestReadExportRejectsInvalidLines(t *testing.T) {
+	for name, input := range map[string]string{
+		"not json":      `{"key":`,
+		"missing key":   `{"value":{}}`,
+		"missing value": `{"key":"/a"}`,
+		"bad version":   `{"key":"/a","value":{},"version":-1}`,
+		"duplicate key": "{\"key\":\"/a\",\"value\":{}}\n{\"key\":\"/a\",\"value\":{}}",
+	} {
+		if _, err := ReadExport(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestExportMissingTenant(t *testing.T) {
+	dataDir := t.TempDir()
+	config := DatabaseConfig{Backend: BackendSQLite, Sync: "normal"}
+	if _, err := ExportTenant(config, dataDir, "nobody", filepath.Join(dataDir, "out.ndjson")); err == nil {
+		t.Error("export of a missing tenant succeeded")
+	}
+	if _, err := os.Stat(tenantDataDir(dataDir, "nobody")); !os.IsNotExist(err) {
+		t.Error("export created a directory for the missing tenant")
+	}
+}
+
+func TestDataDirLock(t *testing.T) {
+	dataDir := t.TempDir()
+	release, err := lockDataDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockDataDir(dataDir); err == nil {
+		t.Fatal("data directory locked twice")
+	}
+	release()
+
+	release, err = lockDataDir(dataDir)
+	if err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	release()
+}
@@ -9,4 +9,4 @@ require (
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require github.com/google/uuid v1.6.0 // indirect
+require github.com/google/uuid v1.6.0
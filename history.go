@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// HistoryRecord is one recorded write of a key
+type HistoryRecord struct {
+	Key         string
+	Version     int64
+	Value       string
+	From        string
+	UpdatedTime int64
+}
+
+// historyStore is implemented by stores that can record value history.
+// Records reach it through StoreBatch.History.
+type historyStore interface {
+	// EnableHistory prepares storage for history with the given retention
+	// and returns the latest recorded version of every key
+	EnableHistory(maxVersions int, maxAge time.Duration) (map[string]int64, error)
+	// History returns the newest limit records of a key, newest first
+	History(key string, limit int) ([]HistoryRecord, error)
+	// HistoryAt returns the latest record of a key at or before a unix time
+	HistoryAt(key string, at int64) (*HistoryRecord, error)
+	// HistoryVersion returns a specific record of a key
+	HistoryVersion(key string, version int64) (*HistoryRecord, error)
+}
+
+// EnableHistory turns on recording of every write. Each key keeps at most
+// maxVersions records no older than maxAge, zero means no limit. Only
+// stores implementing historyStore, i.e. SQLite, support it.
+func (d *Database) EnableHistory(maxVersions int, maxAge time.Duration) error {
+	store, ok := d.store.(historyStore)
+	if !ok {
+		return fmt.Errorf("value history is not supported by this storage backend")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	latest, err := store.EnableHistory(maxVersions, maxAge)
+	if err != nil {
+		return err
+	}
+
+	// Never hand out a version that is already in the history
+	for key, version := range latest {
+		if version > d.versions[key] {
+			d.versions[key] = version
+		}
+	}
+
+	d.historyEnabled = true
+	return nil
+}
+
+// HistoryEnabled reports whether writes are being recorded
+func (d *Database) HistoryEnabled() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.historyEnabled
+}
+
+// GetHistory returns the newest limit recorded writes of a key, newest first
+func (d *Database) GetHistory(key string, limit int) ([]HistoryRecord, error) {
+	store, err := d.prepareHistoryRead()
+	if err != nil {
+		return nil, err
+	}
+	return store.History(key, limit)
+}
+
+// GetValueAt returns the value a key had at the given unix time
+func (d *Database) GetValueAt(key string, at int64) (*HistoryRecord, error) {
+	store, err := d.prepareHistoryRead()
+	if err != nil {
+		return nil, err
+	}
+	return store.HistoryAt(key, at)
+}
+
+// GetValueVersion returns a specific recorded version of a key
+func (d *Database) GetValueVersion(key string, version int64) (*HistoryRecord, error) {
+	store, err := d.prepareHistoryRead()
+	if err != nil {
+		return nil, err
+	}
+	return store.HistoryVersion(key, version)
+}
+
+// prepareHistoryRead checks that history is on and writes out pending
+// records so queries see every write
+func (d *Database) prepareHistoryRead() (historyStore, error) {
+	if !d.HistoryEnabled() {
+		return nil, fmt.Errorf("value history is not enabled")
+	}
+	if _, err := d.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush history: %w", err)
+	}
+	return d.store.(historyStore), nil
+}
+
+// EnableHistory creates the kv_history table and returns the latest
+// recorded version of every key
+func (s *sqliteStore) EnableHistory(maxVersions int, maxAge time.Duration) (map[string]int64, error) {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS kv_history (
+		key TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		value TEXT,
+		author TEXT,
+		updated_time INTEGER,
+		PRIMARY KEY (key, version)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create history table: %w", err)
+	}
+	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS kv_history_time ON kv_history (updated_time)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create history index: %w", err)
+	}
+
+	// Continue numbering where the stored history left off
+	rows, err := s.db.Query("SELECT key, MAX(version) FROM kv_history GROUP BY key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	latest := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var version int64
+		if err := rows.Scan(&key, &version); err != nil {
+			return nil, fmt.Errorf("failed to scan history row: %w", err)
+		}
+		latest[key] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.historyMaxVersions = maxVersions
+	s.historyMaxAge = maxAge
+	s.mu.Unlock()
+	return latest, nil
+}
+
+// writeHistory inserts history records and applies retention for the keys
+// they touch. Called from Write inside its transaction.
+func (s *sqliteStore) writeHistory(tx *sql.Tx, history []HistoryRecord) error {
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO kv_history
+		(key, version, value, author, updated_time) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare history statement: %w", err)
+	}
+	defer stmt.Close()
+
+	latest := make(map[string]int64)
+	for _, record := range history {
+		if _, err := stmt.Exec(record.Key, record.Version, record.Value, record.From, record.UpdatedTime); err != nil {
+			return fmt.Errorf("failed to insert history for key %s: %w", record.Key, err)
+		}
+		if record.Version > latest[record.Key] {
+			latest[record.Key] = record.Version
+		}
+	}
+
+	s.mu.RLock()
+	maxVersions, maxAge := s.historyMaxVersions, s.historyMaxAge
+	s.mu.RUnlock()
+
+	if maxVersions > 0 {
+		for key, version := range latest {
+			if _, err := tx.Exec("DELETE FROM kv_history WHERE key = ? AND version <= ?",
+				key, version-int64(maxVersions)); err != nil {
+				return fmt.Errorf("failed to prune history for key %s: %w", key, err)
+			}
+		}
+	}
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge).Unix()
+		if _, err := tx.Exec("DELETE FROM kv_history WHERE updated_time < ?", cutoff); err != nil {
+			return fmt.Errorf("failed to prune old history: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// History returns the newest limit records of a key, newest first
+func (s *sqliteStore) History(key string, limit int) ([]HistoryRecord, error) {
+	rows, err := s.db.Query(`SELECT version, value, author, updated_time FROM kv_history
+		WHERE key = ? ORDER BY version DESC LIMIT ?`, key, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	records := []HistoryRecord{}
+	for rows.Next() {
+		record := HistoryRecord{Key: key}
+		if err := rows.Scan(&record.Version, &record.Value, &record.From, &record.UpdatedTime); err != nil {
+			return nil, fmt.Errorf("failed to scan history row: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// HistoryAt returns the record a key had at the given unix time
+func (s *sqliteStore) HistoryAt(key string, at int64) (*HistoryRecord, error) {
+	return s.queryHistoryRecord(key, `SELECT version, value, author, updated_time FROM kv_history
+		WHERE key = ? AND updated_time <= ? ORDER BY version DESC LIMIT 1`, key, at)
+}
+
+// HistoryVersion returns a specific record of a key
+func (s *sqliteStore) HistoryVersion(key string, version int64) (*HistoryRecord, error) {
+	return s.queryHistoryRecord(key, `SELECT version, value, author, updated_time FROM kv_history
+		WHERE key = ? AND version = ?`, key, version)
+}
+
+func (s *sqliteStore) queryHistoryRecord(key, query string, args ...interface{}) (*HistoryRecord, error) {
+	record := &HistoryRecord{Key: key}
+	err := s.db.QueryRow(query, args...).Scan(&record.Version, &record.Value, &record.From, &record.UpdatedTime)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no history for key: %s", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	return record, nil
+}
+
+// RewriteHistory replaces the value of every history record with what fn
+// returns, in one transaction. A database without history is left alone.
+func (s *sqliteStore) RewriteHistory(fn func(key, value string) (string, error)) error {
+	var tables int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'kv_history'").Scan(&tables); err != nil {
+		return fmt.Errorf("failed to look for history: %w", err)
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT key, version, value FROM kv_history")
+	if err != nil {
+		return fmt.Errorf("failed to query history: %w", err)
+	}
+	var records []HistoryRecord
+	for rows.Next() {
+		var record HistoryRecord
+		if err := rows.Scan(&record.Key, &record.Version, &record.Value); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan history row: %w", err)
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE kv_history SET value = ? WHERE key = ? AND version = ?")
+	if err != nil {
+		return fmt.Errorf("failed to prepare history statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, record := range records {
+		value, err := fn(record.Key, record.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(value, record.Key, record.Version); err != nil {
+			return fmt.Errorf("failed to rewrite history for key %s: %w", record.Key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
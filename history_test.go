@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+// openHistoryBroker opens a broker with history on over the SQLite store in dir
+func openHistoryBroker(t *testing.T, dir string, maxVersions int) *Broker {
+	t.Helper()
+	store, err := OpenStore(BackendSQLite, dir, "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatabase(store, dir)
+	if err := d.LoadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.EnableHistory(maxVersions, 0); err != nil {
+		t.Fatal(err)
+	}
+	return NewBroker(log.New(io.Discard, "", 0), d, false)
+}
+
+func TestValueHistory(t *testing.T) {
+	b := openHistoryBroker(t, t.TempDir(), 0)
+	defer b.db.Close()
+	for i, value := range []string{"one", "two", "three"} {
+		b.PutValue("/k", value, "", "test", int64(100*(i+1)))
+	}
+
+	history, err := b.GetValueHistory("/k", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Version != 3 || history[1].Value.Message != "two" {
+		t.Errorf("got history %+v", history)
+	}
+
+	if msg, err := b.GetValueAt("/k", 250); err != nil || msg.Message != "two" {
+		t.Errorf("value at 250 is %+v, %v", msg, err)
+	}
+	if _, err := b.GetValueAt("/k", 50); err == nil {
+		t.Error("found a value before the first write")
+	}
+	if msg, err := b.GetValueVersion("/k", 1); err != nil || msg.Message != "one" {
+		t.Errorf("version 1 is %+v, %v", msg, err)
+	}
+}
+
+func TestValueHistoryRetention(t *testing.T) {
+	b := openHistoryBroker(t, t.TempDir(), 2)
+	defer b.db.Close()
+	for i := 1; i <= 4; i++ {
+		b.PutValue("/k", "v", "", "test", int64(i))
+	}
+	if history, _ := b.GetValueHistory("/k", 10); len(history) != 2 || history[1].Version != 3 {
+		t.Errorf("kept history %+v, want versions 4 and 3", history)
+	}
+}
+
+func TestValueHistoryVersionsContinueAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := openHistoryBroker(t, dir, 0)
+	b.PutValue("/k", "one", "", "test", 1)
+	b.PutValue("/k", "two", "", "test", 2)
+	b.DeleteValue("/k", "test", false)
+	if err := b.db.SaveAll(); err != nil {
+		t.Fatal(err)
+	}
+	b.db.Close()
+
+	b = openHistoryBroker(t, dir, 0)
+	defer b.db.Close()
+	version, err := b.PutValueIf("/k", "three", "", "test", 3, 0, &WriteCondition{IfAbsent: true})
+	if err != nil || version != 3 {
+		t.Errorf("re-created key got version %d, %v, want 3", version, err)
+	}
+}
+
+func TestValueHistoryNeedsSQLite(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.EnableHistory(0, 0); err == nil {
+		t.Error("history enabled on the memory backend")
+	}
+	if _, err := d.GetHistory("/k", 1); err == nil {
+		t.Error("history read without history enabled")
+	}
+}
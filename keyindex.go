@@ -0,0 +1,154 @@
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// keyIndexBlockSize is the number of keys a block of the index grows to
+// before it is split
+const keyIndexBlockSize = 512
+
+// keyIndex keeps keys in sorted order for prefix scans and pagination. Keys
+// live in sorted blocks of bounded size, so an insert or delete only shifts
+// one block.
+type keyIndex struct {
+	blocks [][]string
+	count  int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{}
+}
+
+// Len returns the number of keys in the index
+func (ix *keyIndex) Len() int {
+	return ix.count
+}
+
+// Reset replaces the contents of the index with keys, in any order
+func (ix *keyIndex) Reset(keys []string) {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	ix.blocks = nil
+	for start := 0; start < len(sorted); start += keyIndexBlockSize / 2 {
+		end := start + keyIndexBlockSize/2
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		ix.blocks = append(ix.blocks, append([]string(nil), sorted[start:end]...))
+	}
+	ix.count = len(sorted)
+}
+
+// block returns the index of the block key belongs in
+func (ix *keyIndex) block(key string) int {
+	i := sort.Search(len(ix.blocks), func(i int) bool {
+		block := ix.blocks[i]
+		return block[len(block)-1] >= key
+	})
+	if i == len(ix.blocks) && i > 0 {
+		i--
+	}
+	return i
+}
+
+// Insert adds key unless it is already present
+func (ix *keyIndex) Insert(key string) {
+	if len(ix.blocks) == 0 {
+		ix.blocks = [][]string{{key}}
+		ix.count = 1
+		return
+	}
+
+	b := ix.block(key)
+	block := ix.blocks[b]
+	i := sort.SearchStrings(block, key)
+	if i < len(block) && block[i] == key {
+		return
+	}
+	block = append(block, "")
+	copy(block[i+1:], block[i:])
+	block[i] = key
+	ix.count++
+
+	if len(block) <= keyIndexBlockSize {
+		ix.blocks[b] = block
+		return
+	}
+
+	// Split a full block in two
+	half := len(block) / 2
+	left := append([]string(nil), block[:half]...)
+	right := append([]string(nil), block[half:]...)
+	ix.blocks = append(ix.blocks, nil)
+	copy(ix.blocks[b+2:], ix.blocks[b+1:])
+	ix.blocks[b] = left
+	ix.blocks[b+1] = right
+}
+
+// Delete removes key if present
+func (ix *keyIndex) Delete(key string) {
+	if len(ix.blocks) == 0 {
+		return
+	}
+
+	b := ix.block(key)
+	block := ix.blocks[b]
+	i := sort.SearchStrings(block, key)
+	if i == len(block) || block[i] != key {
+		return
+	}
+	ix.count--
+
+	if len(block) == 1 {
+		ix.blocks = append(ix.blocks[:b], ix.blocks[b+1:]...)
+		return
+	}
+	ix.blocks[b] = append(block[:i], block[i+1:]...)
+}
+
+// Ascend calls fn for each key at or after from, in order, until fn
+// returns false
+func (ix *keyIndex) Ascend(from string, fn func(key string) bool) {
+	if len(ix.blocks) == 0 {
+		return
+	}
+
+	b := ix.block(from)
+	i := sort.SearchStrings(ix.blocks[b], from)
+	for ; b < len(ix.blocks); b++ {
+		for _, key := range ix.blocks[b][i:] {
+			if !fn(key) {
+				return
+			}
+		}
+		i = 0
+	}
+}
+
+// regexLiteralPrefix returns the literal text every key matching re must
+// start with. Only patterns anchored with ^ have one, since an unanchored
+// match can begin anywhere in the key.
+func regexLiteralPrefix(re *regexp.Regexp) string {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op != syntax.OpConcat || len(parsed.Sub) < 2 || parsed.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+
+	var prefix strings.Builder
+	for _, sub := range parsed.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix.WriteString(string(sub.Rune))
+	}
+	return prefix.String()
+}
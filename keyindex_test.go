@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ascendAll returns every key of the index at or after from
+func ascendAll(ix *keyIndex, from string) []string {
+	keys := []string{}
+	ix.Ascend(from, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestKeyIndexMatchesSortedKeys(t *testing.T) {
+	ix := newKeyIndex()
+	live := make(map[string]bool)
+	rng := rand.New(rand.NewSource(1))
+
+	// Enough keys to split and empty blocks several times over
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("/k/%04d", rng.Intn(3000))
+		if rng.Intn(3) == 0 {
+			ix.Delete(key)
+			delete(live, key)
+		} else {
+			ix.Insert(key)
+			live[key] = true
+		}
+	}
+
+	want := make([]string, 0, len(live))
+	for key := range live {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	if ix.Len() != len(want) {
+		t.Fatalf("Len is %d, want %d", ix.Len(), len(want))
+	}
+	if got := ascendAll(ix, ""); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatal("index keys differ from the sorted live keys")
+	}
+
+	from := "/k/1500"
+	start := sort.SearchStrings(want, from)
+	if got := ascendAll(ix, from); strings.Join(got, ",") != strings.Join(want[start:], ",") {
+		t.Errorf("Ascend from %s returned %d keys, want %d", from, len(got), len(want)-start)
+	}
+
+	ix.Reset(want[:10])
+	if got := ascendAll(ix, ""); ix.Len() != 10 || strings.Join(got, ",") != strings.Join(want[:10], ",") {
+		t.Errorf("Reset left %v", got)
+	}
+}
+
+func TestKeyIndexAscendStops(t *testing.T) {
+	ix := newKeyIndex()
+	for _, key := range []string{"c", "a", "b", "a"} {
+		ix.Insert(key)
+	}
+	var got []string
+	ix.Ascend("", func(key string) bool {
+		got = append(got, key)
+		return key != "b"
+	})
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("got %v, want a,b", got)
+	}
+}
+
+func TestRegexLiteralPrefix(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"^/sensors/temp": "/sensors/temp",
+		"^/sensors/.*":   "/sensors/",
+		"^/a(b|c)":       "/a",
+		"/sensors/":      "",
+		"^(?i)/sensors":  "",
+		"^.*":            "",
+	} {
+		if got := regexLiteralPrefix(regexp.MustCompile(pattern)); got != want {
+			t.Errorf("regexLiteralPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestScanKeysPages(t *testing.T) {
+	d := newTestDatabase(t)
+	for i := 0; i < 25; i++ {
+		d.SaveValue(fmt.Sprintf("/a/%02d", i), i)
+	}
+	d.SaveValue("/b/00", 0)
+	d.SaveValue("/a", 0)
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging didn't end")
+		}
+		keys, next := d.ScanKeys("/a/", cursor, nil, 10)
+		got = append(got, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(got) != 25 || got[0] != "/a/00" || got[24] != "/a/24" {
+		t.Errorf("pages returned %d keys from %v", len(got), got)
+	}
+
+	keys, next := d.ScanKeys("", "", regexp.MustCompile(`^/a/1`), 0)
+	if len(keys) != 10 || next != "" {
+		t.Errorf("regex scan returned %v, %q", keys, next)
+	}
+	if keys, _ := d.ScanKeys("/b/", "", regexp.MustCompile(`^/a/`), 0); len(keys) != 0 {
+		t.Errorf("disjoint prefix and regex returned %v", keys)
+	}
+}
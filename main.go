@@ -27,6 +27,14 @@ func main() {
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	addUser := flag.String("add-user", "", "Add user (format: username:password)")
 	listUsers := flag.Bool("list-users", false, "List all users")
+	exportTenant := flag.String("export", "", "Export a tenant's values as NDJSON to -file (\"public\" for the public broker)")
+	importTenant := flag.String("import", "", "Import NDJSON from -file into a tenant")
+	importMode := flag.String("import-mode", ImportMerge, "Import mode: merge or replace")
+	transferFile := flag.String("file", "", "File for -export and -import")
+	restoreTenant := flag.String("restore", "", "Restore a tenant from a backup (\"public\" for the public broker)")
+	restoreBackup := flag.String("backup", "", "Backup to restore from, default the latest one holding the tenant")
+	rotateKey := flag.String("rotate-key", "", "Give a tenant (\"public\", or \"all\") a new data key and re-encrypt its values")
+	generateMasterKey := flag.Bool("generate-master-key", false, "Print a new random master key for encryption")
 	flag.Parse()
 
 	// Generate config if requested
@@ -38,6 +46,15 @@ func main() {
 		return
 	}
 
+	if *generateMasterKey {
+		key, err := GenerateMasterKey()
+		if err != nil {
+			log.Fatalf("Failed to generate master key: %v", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
 	if _, err := os.Stat("/etc/moustique/config.yaml"); err == nil {
 		*configPath = "/etc/moustique/config.yaml"
 	}
@@ -88,6 +105,63 @@ func main() {
 		logger.Fatalf("Failed to create data directory: %v", err)
 	}
 
+	// Commands that work on tenant data offline hold the data lock, which a
+	// running server has too
+	if *exportTenant != "" || *importTenant != "" || *restoreTenant != "" || *rotateKey != "" {
+		releaseLock, err := lockDataDir(dataDir)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer releaseLock()
+	}
+
+	// Export or import a tenant and exit
+	if *exportTenant != "" || *importTenant != "" {
+		if *transferFile == "" {
+			log.Fatalf("-file is required with -export and -import")
+		}
+		if *exportTenant != "" {
+			count, err := ExportTenant(config.Database, dataDir, *exportTenant, *transferFile)
+			if err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+			log.Printf("Exported %d values from %s to %s", count, *exportTenant, *transferFile)
+		} else {
+			count, err := ImportTenant(config.Database, dataDir, *importTenant, *transferFile, *importMode)
+			if err != nil {
+				log.Fatalf("Import failed: %v", err)
+			}
+			log.Printf("Imported %d values into %s (%s)", count, *importTenant, *importMode)
+		}
+		return
+	}
+
+	// Roll a tenant back to a backup and exit, with the server stopped
+	if *restoreTenant != "" {
+		name, err := RestoreTenant(config.Database, dataDir, *restoreTenant, *restoreBackup)
+		if err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		log.Printf("Restored %s from backup %s", *restoreTenant, name)
+		return
+	}
+
+	// Rotate data keys and exit, with the server stopped
+	if *rotateKey != "" {
+		tenants := []string{*rotateKey}
+		if *rotateKey == "all" {
+			tenants = storedTenants(config.Database, dataDir)
+		}
+		for _, tenant := range tenants {
+			count, err := RotateTenantKey(config.Database, dataDir, tenant)
+			if err != nil {
+				log.Fatalf("Key rotation of %s failed: %v", tenant, err)
+			}
+			log.Printf("Rotated the data key of %s, re-encrypted %d values", tenant, count)
+		}
+		return
+	}
+
 	// Check if public access is allowed
 	allowPublic := false
 	if config.Server.AllowPublic != nil {
@@ -104,6 +178,7 @@ func main() {
 		fileVersion,
 		allowPublic,
 		config.Security.AllowedPeers,
+		config.Database,
 	)
 	if err != nil {
 		logger.Fatalf("Failed to create server: %v", err)
@@ -140,6 +215,13 @@ func main() {
 		logger.Println("Debug mode: Added demo users (demo/demo123, alice/alice123, bob/bob123)")
 	}
 
+	// Keep offline commands off the data while serving
+	releaseLock, err := lockDataDir(dataDir)
+	if err != nil {
+		logger.Fatalf("Failed to start server: %v", err)
+	}
+	defer releaseLock()
+
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch formats accepted by PATCHVAL
+const (
+	PatchMerge = "merge" // RFC 7386 JSON merge patch
+	PatchJSON  = "json"  // RFC 6902 JSON patch limited to add, remove, replace and test
+)
+
+// errKeyNotFound is returned when patching a key that doesn't exist
+var errKeyNotFound = errors.New("key not found")
+
+// PatchError is returned for a patch that is malformed or can't be applied
+// to the stored document
+type PatchError struct {
+	Reason    string
+	Malformed bool // the patch itself is invalid, otherwise it didn't apply
+}
+
+func (e *PatchError) Error() string {
+	return e.Reason
+}
+
+// decodeJSON parses a JSON document keeping numbers as written
+func decodeJSON(data string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+// applyPatch applies a patch in the given format to a parsed document and
+// returns the patched document. doc may be modified.
+func applyPatch(doc interface{}, patch, format string) (interface{}, error) {
+	switch format {
+	case PatchMerge:
+		parsed, err := decodeJSON(patch)
+		if err != nil {
+			return nil, &PatchError{Reason: fmt.Sprintf("invalid merge patch: %v", err), Malformed: true}
+		}
+		return mergePatch(doc, parsed), nil
+	case PatchJSON:
+		return applyJSONPatch(doc, patch)
+	default:
+		return nil, &PatchError{Reason: fmt.Sprintf("unknown patch format: %s", format), Malformed: true}
+	}
+}
+
+// mergePatch applies an RFC 7386 merge patch: objects are merged key by
+// key, null removes a key and anything else replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// jsonPatchOperation is one operation of an RFC 6902 patch
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations of an RFC 6902 patch in order. The
+// caller discards the document if any of them fails.
+func applyJSONPatch(doc interface{}, patch string) (interface{}, error) {
+	var operations []jsonPatchOperation
+	if err := json.Unmarshal([]byte(patch), &operations); err != nil {
+		return nil, &PatchError{Reason: fmt.Sprintf("invalid JSON patch: %v", err), Malformed: true}
+	}
+
+	for i, operation := range operations {
+		malformed := func(reason string) error {
+			return &PatchError{Reason: fmt.Sprintf("operation %d: %s", i, reason), Malformed: true}
+		}
+
+		switch operation.Op {
+		case "add", "remove", "replace", "test":
+		case "move", "copy":
+			return nil, malformed(fmt.Sprintf("op %q is not supported", operation.Op))
+		default:
+			return nil, malformed(fmt.Sprintf("unknown op %q", operation.Op))
+		}
+
+		tokens, err := parseJSONPointer(operation.Path)
+		if err != nil {
+			return nil, malformed(err.Error())
+		}
+
+		var value interface{}
+		if operation.Op != "remove" {
+			if len(operation.Value) == 0 {
+				return nil, malformed("missing value")
+			}
+			if value, err = decodeJSON(string(operation.Value)); err != nil {
+				return nil, malformed(fmt.Sprintf("invalid value: %v", err))
+			}
+		}
+
+		doc, err = applyJSONPatchOperation(doc, tokens, operation.Op, value)
+		if err != nil {
+			return nil, &PatchError{Reason: fmt.Sprintf("operation %d (%s %s): %v", i, operation.Op, operation.Path, err)}
+		}
+	}
+	return doc, nil
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into unescaped tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// applyJSONPatchOperation applies one operation at the location given by
+// tokens below doc and returns the updated doc
+func applyJSONPatchOperation(doc interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		switch op {
+		case "add", "replace":
+			return value, nil
+		case "test":
+			return doc, testJSONValue(doc, value)
+		default:
+			return nil, fmt.Errorf("cannot remove the whole document")
+		}
+	}
+
+	token, last := tokens[0], len(tokens) == 1
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		current, exists := container[token]
+		if !last {
+			if !exists {
+				return nil, fmt.Errorf("path not found")
+			}
+			child, err := applyJSONPatchOperation(current, tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[token] = child
+			return container, nil
+		}
+		if !exists && op != "add" {
+			return nil, fmt.Errorf("path not found")
+		}
+		switch op {
+		case "add", "replace":
+			container[token] = value
+		case "remove":
+			delete(container, token)
+		case "test":
+			return container, testJSONValue(current, value)
+		}
+		return container, nil
+
+	case []interface{}:
+		if last && op == "add" && token == "-" {
+			return append(container, value), nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+			return nil, fmt.Errorf("invalid array index %q", token)
+		}
+		if last && op == "add" {
+			if index > len(container) {
+				return nil, fmt.Errorf("array index %d out of range", index)
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		if index >= len(container) {
+			return nil, fmt.Errorf("array index %d out of range", index)
+		}
+		if !last {
+			child, err := applyJSONPatchOperation(container[index], tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			container[index] = child
+			return container, nil
+		}
+		switch op {
+		case "replace":
+			container[index] = value
+		case "remove":
+			container = append(container[:index], container[index+1:]...)
+		case "test":
+			return container, testJSONValue(container[index], value)
+		}
+		return container, nil
+
+	default:
+		return nil, fmt.Errorf("path not found")
+	}
+}
+
+// testJSONValue fails unless two parsed JSON values are equal
+func testJSONValue(actual, expected interface{}) error {
+	if !reflect.DeepEqual(normalizeJSON(actual), normalizeJSON(expected)) {
+		return fmt.Errorf("test failed")
+	}
+	return nil
+}
+
+// normalizeJSON turns numbers into float64 so 1 and 1.0 compare equal
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v.String()
+		}
+		return f
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = normalizeJSON(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeJSON(item)
+		}
+		return normalized
+	default:
+		return v
+	}
+}
+
+// encodeJSON marshals a patched document without escaping HTML characters
+func encodeJSON(doc interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// patchJSON applies a patch to a JSON document and returns the result
+func patchJSON(document, patch, format string) (string, error) {
+	doc, err := decodeJSON(document)
+	if err != nil {
+		return "", err
+	}
+	doc, err = applyPatch(doc, patch, format)
+	if err != nil {
+		return "", err
+	}
+	return encodeJSON(doc)
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":1,"b":{"c":2,"d":3}}`, `{"b":{"c":null,"e":4}}`, `{"a":1,"b":{"d":3,"e":4}}`},
+		{`{"a":1}`, `{"a":null}`, `{}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `"text"`, `"text"`},
+		{`[1,2]`, `{"a":1.50}`, `{"a":1.50}`},
+		{`{"a":"<b>"}`, `{}`, `{"a":"<b>"}`},
+	}
+	for _, test := range tests {
+		got, err := patchJSON(test.doc, test.patch, PatchMerge)
+		if err != nil || got != test.want {
+			t.Errorf("merge %s into %s = %s, %v, want %s", test.patch, test.doc, got, err, test.want)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{`{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`},
+		{`{"a":1,"b":2}`, `[{"op":"remove","path":"/b"}]`, `{"a":1}`},
+		{`{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":[true]}]`, `{"a":{"b":[true]}}`},
+		{`{"a/b":1,"c~d":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/c~0d"}]`, `{}`},
+		{`{"n":1}`, `[{"op":"test","path":"/n","value":1.0},{"op":"replace","path":"/n","value":2}]`, `{"n":2}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+	for _, test := range tests {
+		got, err := patchJSON(test.doc, test.patch, PatchJSON)
+		if err != nil || got != test.want {
+			t.Errorf("patch %s on %s = %s, %v, want %s", test.patch, test.doc, got, err, test.want)
+		}
+	}
+}
+
+func TestPatchErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, format string
+		malformed                bool
+	}{
+		{"unknown format", `{}`, `{}`, "xml", true},
+		{"invalid merge patch", `{}`, `{"a":`, PatchMerge, true},
+		{"not a list", `{}`, `{"op":"add"}`, PatchJSON, true},
+		{"unknown op", `{}`, `[{"op":"frob","path":"/a"}]`, PatchJSON, true},
+		{"move", `{"a":1}`, `[{"op":"move","from":"/a","path":"/b"}]`, PatchJSON, true},
+		{"relative path", `{}`, `[{"op":"add","path":"a","value":1}]`, PatchJSON, true},
+		{"missing value", `{}`, `[{"op":"add","path":"/a"}]`, PatchJSON, true},
+		{"missing path", `{"a":1}`, `[{"op":"replace","path":"/b","value":1}]`, PatchJSON, false},
+		{"missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`, PatchJSON, false},
+		{"index out of range", `{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, PatchJSON, false},
+		{"leading zero", `{"a":[1,2]}`, `[{"op":"remove","path":"/a/01"}]`, PatchJSON, false},
+		{"failed test", `{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, PatchJSON, false},
+		{"remove document", `{}`, `[{"op":"remove","path":""}]`, PatchJSON, false},
+	}
+	for _, test := range tests {
+		_, err := patchJSON(test.doc, test.patch, test.format)
+		var patchErr *PatchError
+		if !errors.As(err, &patchErr) {
+			t.Errorf("%s: got %v, want a *PatchError", test.name, err)
+			continue
+		}
+		if patchErr.Malformed != test.malformed {
+			t.Errorf("%s: malformed is %v, want %v", test.name, patchErr.Malformed, test.malformed)
+		}
+	}
+}
+
+func TestPatchValue(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/doc", "c1", "127.0.0.1")
+	b.PutValue("/doc", `{"a":1}`, "", "test", 1)
+
+	patched, version, err := b.PatchValue("/doc", `{"b":2}`, PatchMerge, "test", "127.0.0.1", 2)
+	if err != nil || patched != `{"a":1,"b":2}` || version != 2 {
+		t.Fatalf("got %s at version %d, %v", patched, version, err)
+	}
+	messages, _ := b.Pickup("c1", "127.0.0.1")
+	if msgs := messages["/doc"]; len(msgs) != 1 || msgs[0].Message != patched {
+		t.Errorf("subscriber got %v, want the patched document", msgs)
+	}
+
+	// A failing operation leaves the document as it was
+	_, _, err = b.PatchValue("/doc", `[{"op":"remove","path":"/a"},{"op":"remove","path":"/zz"}]`, PatchJSON, "test", "127.0.0.1", 3)
+	var patchErr *PatchError
+	if !errors.As(err, &patchErr) {
+		t.Fatalf("got %v, want a *PatchError", err)
+	}
+	stored, _ := b.GetValue("/doc")
+	if stored.Message != patched || stored.Version != 2 {
+		t.Errorf("failed patch changed the value to %s at version %d", stored.Message, stored.Version)
+	}
+
+	if _, _, err := b.PatchValue("/missing", `{}`, PatchMerge, "test", "127.0.0.1", 4); !errors.Is(err, errKeyNotFound) {
+		t.Errorf("patching a missing key got %v", err)
+	}
+	b.PutValue("/text", "not json", "", "test", 5)
+	var invalid *InvalidValueError
+	if _, _, err := b.PatchValue("/text", `{}`, PatchMerge, "test", "127.0.0.1", 6); !errors.As(err, &invalid) {
+		t.Errorf("patching a value that isn't JSON got %v", err)
+	}
+}
+
+func TestPatchValueListsSubscribers(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/doc", `{"a":1}`, "", "test", 1)
+	b.Subscribe("/doc", "c1", "127.0.0.1")
+	if _, _, err := b.PatchValue("/doc", `{"b":2}`, PatchMerge, "test", "127.0.0.1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := b.GetValue("/doc"); !stored.Subscribers["c1"] {
+		t.Errorf("patched value lists subscribers %v, want c1", stored.Subscribers)
+	}
+}
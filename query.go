@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of QUERY
+const (
+	defaultQueryLimit   = 100
+	defaultQueryTimeout = time.Second
+	maxQueryTimeout     = 10 * time.Second
+	queryScanBatch      = 256 // index keys looked at between deadline checks
+)
+
+// querySelection is a field of a query's select list
+type querySelection struct {
+	name string
+	path jsonPath
+}
+
+// pathStep is one step of a JSON path: an object key, an array index or
+// a wildcard over all members
+type pathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// jsonPath selects values inside a JSON document, written as
+// $.devices[0].name or just devices[0].name; [*] and .* match all members
+type jsonPath []pathStep
+
+// parseJSONPath parses a dotted JSON path with bracket indexes
+func parseJSONPath(expr string) (jsonPath, error) {
+	rest := strings.TrimSpace(expr)
+	rest = strings.TrimPrefix(rest, "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	var path jsonPath
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", expr)
+			}
+			if name == "*" {
+				path = append(path, pathStep{wildcard: true})
+			} else {
+				path = append(path, pathStep{key: name})
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: missing ]", expr)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				path = append(path, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				path = append(path, pathStep{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid path %q: bad index %q", expr, inner)
+				}
+				path = append(path, pathStep{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("invalid path %q", expr)
+		}
+	}
+	return path, nil
+}
+
+// eval returns every value the path selects in doc
+func (p jsonPath) eval(doc interface{}) []interface{} {
+	current := []interface{}{doc}
+	for _, step := range p {
+		var next []interface{}
+		for _, value := range current {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					for _, member := range v {
+						next = append(next, member)
+					}
+				} else if member, ok := v[step.key]; ok && !step.isIndex {
+					next = append(next, member)
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, v...)
+				} else if step.isIndex && step.index < len(v) {
+					next = append(next, v[step.index])
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// queryCondition is a predicate like battery < 20. Without an operator it
+// only requires the path to exist.
+type queryCondition struct {
+	path  jsonPath
+	op    string
+	value interface{}
+}
+
+var queryConditionPattern = regexp.MustCompile(`^\s*(.+?)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*$`)
+
+// parseQueryConditions parses conditions joined with &&. Literals are JSON:
+// numbers, "strings", true, false or null.
+func parseQueryConditions(expr string) ([]queryCondition, error) {
+	var conditions []queryCondition
+	for _, part := range splitOutsideQuotes(expr, "&&") {
+		if strings.TrimSpace(part) == "" {
+			return nil, fmt.Errorf("empty condition in %q", expr)
+		}
+
+		m := queryConditionPattern.FindStringSubmatch(part)
+		if m == nil {
+			path, err := parseJSONPath(part)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, queryCondition{path: path})
+			continue
+		}
+
+		path, err := parseJSONPath(m[1])
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeJSON(m[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid literal %s, strings must be quoted", m[3])
+		}
+		conditions = append(conditions, queryCondition{path: path, op: m[2], value: normalizeJSON(value)})
+	}
+	return conditions, nil
+}
+
+// splitOutsideQuotes splits s at sep where sep isn't inside a "string"
+func splitOutsideQuotes(s, sep string) []string {
+	var parts []string
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && inQuotes:
+			escaped = true
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// matches reports whether any value selected by the path satisfies the condition
+func (c queryCondition) matches(doc interface{}) bool {
+	for _, value := range c.path.eval(doc) {
+		if c.op == "" || compareJSON(normalizeJSON(value), c.op, c.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareJSON compares normalized JSON values. Ordering only applies to two
+// numbers or two strings.
+func compareJSON(a interface{}, op string, b interface{}) bool {
+	switch op {
+	case "==":
+		return reflect.DeepEqual(a, b)
+	case "!=":
+		return !reflect.DeepEqual(a, b)
+	}
+
+	var cmp int
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(x, y)
+	default:
+		return false
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// Query selects JSON values by key and content
+type Query struct {
+	Pattern string // key regex, optional
+	Prefix  string // key prefix, optional
+	Cursor  string // continue after this key
+	Where   string // conditions joined with &&
+	Select  string // comma separated paths to return, empty for the whole value
+	Limit   int
+	Timeout time.Duration
+}
+
+// QueryMatch is one value matched by a query
+type QueryMatch struct {
+	Key     string                 `json:"key"`
+	Version int64                  `json:"version"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	Value   interface{}            `json:"value,omitempty"`
+}
+
+// QueryResult holds the values a query matched. Cursor is set when the
+// limit or the time ran out, to continue with the next key.
+type QueryResult struct {
+	Results  []QueryMatch `json:"results"`
+	Scanned  int          `json:"scanned"`
+	TimedOut bool         `json:"timed_out,omitempty"`
+	Cursor   string       `json:"cursor,omitempty"`
+}
+
+// Query evaluates conditions over the JSON values whose keys match the
+// query and returns the selected fields. Values that aren't JSON never match.
+func (b *Broker) Query(q *Query) (*QueryResult, error) {
+	var re *regexp.Regexp
+	if q.Pattern != "" {
+		var err error
+		if re, err = regexp.Compile(q.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	var conditions []queryCondition
+	if q.Where != "" {
+		var err error
+		if conditions, err = parseQueryConditions(q.Where); err != nil {
+			return nil, err
+		}
+	}
+
+	var selections []querySelection
+	if q.Select != "" {
+		for _, name := range strings.Split(q.Select, ",") {
+			name = strings.TrimSpace(name)
+			path, err := parseJSONPath(name)
+			if err != nil {
+				return nil, err
+			}
+			selections = append(selections, querySelection{name: name, path: path})
+		}
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	timeout := q.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+	if timeout > maxQueryTimeout {
+		timeout = maxQueryTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Scan the index in slices so the deadline bounds a sparse regex too,
+	// always taking one slice so a client following the cursor gets through
+	result := &QueryResult{Results: []QueryMatch{}}
+	cursor := q.Cursor
+	for {
+		keys, next := b.db.scanKeys(q.Prefix, cursor, re, 0, queryScanBatch)
+		for _, key := range keys {
+			if len(result.Results) == limit {
+				result.Cursor = cursor
+				return result, nil
+			}
+			cursor = key
+			result.Scanned++
+			if match, ok := b.queryKey(key, conditions, selections); ok {
+				result.Results = append(result.Results, match)
+			}
+		}
+		if next == "" {
+			return result, nil
+		}
+		cursor = next
+		if time.Now().After(deadline) {
+			result.TimedOut = true
+			result.Cursor = cursor
+			return result, nil
+		}
+	}
+}
+
+// queryKey applies the conditions of a query to one key and returns the
+// match with its selected fields, ok false when it doesn't match
+func (b *Broker) queryKey(key string, conditions []queryCondition, selections []querySelection) (QueryMatch, bool) {
+	value, version, err := b.db.GetValueWithVersion(key)
+	if err != nil {
+		return QueryMatch{}, false
+	}
+	var msg Message
+	if err := json.Unmarshal([]byte(value), &msg); err != nil {
+		return QueryMatch{}, false
+	}
+	doc, err := decodeJSON(msg.Message)
+	if err != nil {
+		return QueryMatch{}, false
+	}
+
+	for _, condition := range conditions {
+		if !condition.matches(doc) {
+			return QueryMatch{}, false
+		}
+	}
+
+	match := QueryMatch{Key: key, Version: version}
+	if len(selections) == 0 {
+		match.Value = doc
+	} else {
+		match.Fields = make(map[string]interface{}, len(selections))
+		for _, sel := range selections {
+			values := sel.path.eval(doc)
+			switch len(values) {
+			case 0:
+			case 1:
+				match.Fields[sel.name] = values[0]
+			default:
+				match.Fields[sel.name] = values
+			}
+		}
+	}
+	return match, true
+}
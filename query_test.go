@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newQueryBroker returns a broker holding /devices/00 to /devices/09, each
+// with its number as battery level
+func newQueryBroker(t *testing.T) *Broker {
+	t.Helper()
+	b := newTestBroker(t)
+	for i := 0; i < 10; i++ {
+		doc := fmt.Sprintf(`{"name":"dev%d","battery":%d,"tags":["a","b"]}`, i, i*10)
+		b.PutValue(fmt.Sprintf("/devices/%02d", i), doc, "", "test", 1)
+	}
+	b.PutValue("/devices/text", "not json", "", "test", 1)
+	return b
+}
+
+func TestQueryWhereAndSelect(t *testing.T) {
+	b := newQueryBroker(t)
+
+	result, err := b.Query(&Query{Prefix: "/devices/", Where: `battery < 30 && tags[*] == "b"`, Select: "name, tags[0]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 3 || result.Scanned != 11 || result.Cursor != "" {
+		t.Fatalf("got %+v, want 3 matches of 11 keys", result)
+	}
+	first := result.Results[0]
+	if first.Key != "/devices/00" || first.Fields["name"] != "dev0" || first.Fields["tags[0]"] != "a" || first.Value != nil {
+		t.Errorf("first match is %+v", first)
+	}
+
+	result, _ = b.Query(&Query{Pattern: `^/devices/0[5-9]$`, Where: `name == "dev7"`})
+	if len(result.Results) != 1 || result.Results[0].Key != "/devices/07" {
+		t.Errorf("regex query got %+v", result.Results)
+	}
+	if doc, _ := json.Marshal(result.Results[0].Value); string(doc) != `{"battery":70,"name":"dev7","tags":["a","b"]}` {
+		t.Errorf("whole value returned as %s", doc)
+	}
+}
+
+func TestQueryLimitAndCursor(t *testing.T) {
+	b := newQueryBroker(t)
+
+	var keys []string
+	q := &Query{Prefix: "/devices/", Where: "battery >= 0", Limit: 4}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging didn't end")
+		}
+		result, err := b.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range result.Results {
+			keys = append(keys, match.Key)
+		}
+		if result.Cursor == "" {
+			break
+		}
+		q.Cursor = result.Cursor
+	}
+	if len(keys) != 10 || keys[0] != "/devices/00" || keys[9] != "/devices/09" {
+		t.Errorf("pages returned %v", keys)
+	}
+}
+
+func TestQueryTimeoutBoundsSparseScan(t *testing.T) {
+	b := newTestBroker(t)
+	for i := 0; i < 3*queryScanBatch; i++ {
+		b.PutValue(fmt.Sprintf("/k/%04d", i), "{}", "", "test", 1)
+	}
+
+	q := &Query{Pattern: `9999$`, Timeout: time.Nanosecond}
+	result, err := b.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TimedOut || result.Cursor == "" || len(result.Results) != 0 {
+		t.Fatalf("got %+v, want a timeout with a cursor", result)
+	}
+
+	// Following the cursor gets through one slice at a time
+	for slices := 1; result.Cursor != ""; slices++ {
+		if slices > 4 {
+			t.Fatal("following the cursor didn't end")
+		}
+		q.Cursor = result.Cursor
+		if result, err = b.Query(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanKeysMaxScanned(t *testing.T) {
+	d := newTestDatabase(t)
+	for i := 0; i < 10; i++ {
+		d.SaveValue(fmt.Sprintf("/k/%d", i), i)
+	}
+	keys, next := d.scanKeys("", "", nil, 0, 4)
+	if len(keys) != 4 || next != "/k/3" {
+		t.Errorf("got %v, %q, want 4 keys and /k/3", keys, next)
+	}
+	keys, next = d.scanKeys("", next, nil, 0, 100)
+	if len(keys) != 6 || next != "" {
+		t.Errorf("got %v, %q, want the remaining 6 keys", keys, next)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	b := newQueryBroker(t)
+	for name, q := range map[string]*Query{
+		"regex":      {Pattern: "("},
+		"path":       {Where: "a[x] == 1"},
+		"literal":    {Where: "name == dev1"},
+		"empty part": {Where: "a == 1 && "},
+		"select":     {Select: "a..b"},
+	} {
+		if _, err := b.Query(q); err == nil {
+			t.Errorf("invalid %s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Quota limits a tenant's share of the server. Zero means unlimited.
+type Quota struct {
+	MaxKeys              int   `json:"max_keys"`
+	MaxValueBytes        int64 `json:"max_value_bytes"` // stored JSON of all values together
+	MaxMessagesPerMinute int   `json:"max_messages_per_minute"`
+	MaxClients           int   `json:"max_clients"`
+	MaxSubscriptions     int   `json:"max_subscriptions"`
+}
+
+// Quota limit names, as used in parameters and errors
+const (
+	QuotaKeys              = "max_keys"
+	QuotaValueBytes        = "max_value_bytes"
+	QuotaMessagesPerMinute = "max_messages_per_minute"
+	QuotaClients           = "max_clients"
+	QuotaSubscriptions     = "max_subscriptions"
+)
+
+// quotaWindow is the window the message rate is counted in
+const quotaWindow = 60 * time.Second
+
+// QuotaExceededError is returned when a request would take a tenant past
+// one of its quota limits. Nothing is changed.
+type QuotaExceededError struct {
+	Limit   string // one of the Quota* names
+	Max     int64
+	Current int64 // usage before the request
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s is %d, currently %d", e.Limit, e.Max, e.Current)
+}
+
+// QuotaUsage is what a tenant currently uses of each quota limit
+type QuotaUsage struct {
+	Keys              int   `json:"keys"`
+	ValueBytes        int64 `json:"value_bytes"`
+	MessagesPerMinute int   `json:"messages_per_minute"`
+	Clients           int   `json:"clients"`
+	Subscriptions     int   `json:"subscriptions"`
+}
+
+// QuotaStore keeps the quota of every tenant, persisted in quotas.json next
+// to users.json. Tenants without an entry are unlimited.
+type QuotaStore struct {
+	quotas   map[string]Quota
+	mu       sync.RWMutex
+	filePath string
+}
+
+// NewQuotaStore loads the quotas kept in dataDir
+func NewQuotaStore(dataDir string) (*QuotaStore, error) {
+	usersDir := filepath.Join(dataDir, "users")
+	if err := os.MkdirAll(usersDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create users directory: %w", err)
+	}
+
+	qs := &QuotaStore{
+		quotas:   make(map[string]Quota),
+		filePath: filepath.Join(usersDir, "quotas.json"),
+	}
+
+	data, err := ioutil.ReadFile(qs.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return qs, nil
+		}
+		return nil, fmt.Errorf("failed to load quotas: %w", err)
+	}
+	if err := json.Unmarshal(data, &qs.quotas); err != nil {
+		return nil, fmt.Errorf("failed to parse quotas file: %w", err)
+	}
+	return qs, nil
+}
+
+// Get returns a tenant's quota, all zero when it has none
+func (qs *QuotaStore) Get(tenant string) Quota {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.quotas[tenant]
+}
+
+// Set stores a tenant's quota, an all zero quota removing it
+func (qs *QuotaStore) Set(tenant string, quota Quota) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	if quota == (Quota{}) {
+		delete(qs.quotas, tenant)
+	} else {
+		qs.quotas[tenant] = quota
+	}
+	return qs.save()
+}
+
+// Delete removes a tenant's quota
+func (qs *QuotaStore) Delete(tenant string) error {
+	return qs.Set(tenant, Quota{})
+}
+
+// save writes the quotas to disk. Caller holds qs.mu.
+func (qs *QuotaStore) save() error {
+	data, err := json.MarshalIndent(qs.quotas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal quotas: %w", err)
+	}
+	if err := ioutil.WriteFile(qs.filePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write quotas file: %w", err)
+	}
+	return nil
+}
+
+// SetStorageLimits limits the number of keys and the bytes of stored JSON,
+// zero meaning unlimited. Writes that don't add to what is already over a
+// lowered limit still go through, so a tenant can always shrink.
+func (d *Database) SetStorageLimits(maxKeys int, maxValueBytes int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxKeys = maxKeys
+	d.maxValueBytes = maxValueBytes
+}
+
+// StorageUsage returns the number of keys and the bytes of stored JSON
+func (d *Database) StorageUsage() (int, int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.values), d.valueBytes
+}
+
+// checkStorage returns a *QuotaExceededError if going from the current
+// usage to keys and bytes breaks a storage limit. Caller holds d.mu.
+func (d *Database) checkStorage(keys int, bytes int64) error {
+	if d.maxKeys > 0 && keys > d.maxKeys && keys > len(d.values) {
+		return &QuotaExceededError{Limit: QuotaKeys, Max: int64(d.maxKeys), Current: int64(len(d.values))}
+	}
+	if d.maxValueBytes > 0 && bytes > d.maxValueBytes && bytes > d.valueBytes {
+		return &QuotaExceededError{Limit: QuotaValueBytes, Max: d.maxValueBytes, Current: d.valueBytes}
+	}
+	return nil
+}
+
+// checkStoreValue checks the storage limits for replacing key's value with
+// value. Caller holds d.mu.
+func (d *Database) checkStoreValue(key, value string) error {
+	keys := len(d.values)
+	old, exists := d.values[key]
+	if !exists {
+		keys++
+	}
+	return d.checkStorage(keys, d.valueBytes-int64(len(old))+int64(len(value)))
+}
+
+// checkBatchStorage checks the storage limits for applying a batch whose
+// deletes all exist. Caller holds d.mu.
+func (d *Database) checkBatchStorage(batch *StoreBatch) error {
+	keys, bytes := len(d.values), d.valueBytes
+	for key := range batch.Deletes {
+		keys--
+		bytes -= int64(len(d.values[key]))
+	}
+	for key, value := range batch.Puts {
+		old, exists := d.values[key]
+		if !exists {
+			keys++
+		}
+		bytes += int64(len(value.Value) - len(old))
+	}
+	return d.checkStorage(keys, bytes)
+}
+
+// checkImportStorage checks the storage limits for importing records with
+// their compacted values, every key being removed first for replace.
+// Caller holds d.mu.
+func (d *Database) checkImportStorage(records []*ExportRecord, values []string, replace bool, now int64) error {
+	keys, bytes := len(d.values), d.valueBytes
+	if replace {
+		keys, bytes = 0, 0
+	}
+	imported := make(map[string]string, len(records))
+	for i, record := range records {
+		if record.ExpiresAt > 0 && record.ExpiresAt <= now {
+			continue
+		}
+		old, exists := imported[record.Key]
+		if !exists && !replace {
+			old, exists = d.values[record.Key]
+		}
+		if !exists {
+			keys++
+		}
+		bytes += int64(len(values[i]) - len(old))
+		imported[record.Key] = values[i]
+	}
+	return d.checkStorage(keys, bytes)
+}
+
+// SetQuota applies a quota to the broker, the storage limits going to its
+// database
+func (b *Broker) SetQuota(quota Quota) {
+	b.mu.Lock()
+	b.quota = quota
+	b.mu.Unlock()
+
+	b.db.SetStorageLimits(quota.MaxKeys, quota.MaxValueBytes)
+}
+
+// Quota returns the quota applied to the broker
+func (b *Broker) Quota() Quota {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.quota
+}
+
+// QuotaUsage returns what the tenant currently uses of its quota
+func (b *Broker) QuotaUsage() QuotaUsage {
+	b.mu.RLock()
+	usage := QuotaUsage{
+		MessagesPerMinute: b.windowMessages(time.Now()),
+		Clients:           len(b.clients),
+		Subscriptions:     b.subscriptionCount(),
+	}
+	b.mu.RUnlock()
+
+	usage.Keys, usage.ValueBytes = b.db.StorageUsage()
+	return usage
+}
+
+// windowMessages returns the messages published in the current rate
+// window. Caller holds b.mu.
+func (b *Broker) windowMessages(now time.Time) int {
+	if now.Sub(b.quotaWindowStart) >= quotaWindow {
+		return 0
+	}
+	return b.quotaWindowMessages
+}
+
+// checkMessageQuota returns a *QuotaExceededError when the message rate
+// window has no room for messages more. Caller holds b.mu.
+func (b *Broker) checkMessageQuota(now time.Time, messages int) error {
+	if now.Sub(b.quotaWindowStart) >= quotaWindow {
+		b.quotaWindowStart = now
+		b.quotaWindowMessages = 0
+	}
+	if max := b.quota.MaxMessagesPerMinute; max > 0 && b.quotaWindowMessages+messages > max {
+		return &QuotaExceededError{Limit: QuotaMessagesPerMinute, Max: int64(max), Current: int64(b.quotaWindowMessages)}
+	}
+	return nil
+}
+
+// subscriptionCount returns the number of client subscriptions, by topic
+// and by regex. Caller holds b.mu.
+func (b *Broker) subscriptionCount() int {
+	count := 0
+	for _, clients := range b.subscriptions {
+		count += len(clients)
+	}
+	for _, sub := range b.regexSubscriptions {
+		count += len(sub.clients)
+	}
+	return count
+}
+
+// checkSubscribeQuota returns a *QuotaExceededError if subscribing
+// clientName to topics would add a client or subscriptions past the quota.
+// Caller holds b.mu.
+func (b *Broker) checkSubscribeQuota(topics []string, regex bool, clientName string) error {
+	if max := b.quota.MaxClients; max > 0 {
+		if _, exists := b.clients[clientName]; !exists && len(b.clients) >= max {
+			return &QuotaExceededError{Limit: QuotaClients, Max: int64(max), Current: int64(len(b.clients))}
+		}
+	}
+
+	max := b.quota.MaxSubscriptions
+	if max <= 0 {
+		return nil
+	}
+	added := 0
+	seen := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		if regex {
+			if sub, exists := b.regexSubscriptions[topic]; !exists || !contains(sub.clients, clientName) {
+				added++
+			}
+		} else if !contains(b.subscriptions[topic], clientName) {
+			added++
+		}
+	}
+	if current := b.subscriptionCount(); added > 0 && current+added > max {
+		return &QuotaExceededError{Limit: QuotaSubscriptions, Max: int64(max), Current: int64(current)}
+	}
+	return nil
+}
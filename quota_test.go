@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// quotaLimit returns the limit a *QuotaExceededError reports, or "" for
+// any other error
+func quotaLimit(err error) string {
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaErr.Limit
+	}
+	return ""
+}
+
+func TestQuotaMaxKeys(t *testing.T) {
+	b := newTestBroker(t)
+	b.SetQuota(Quota{MaxKeys: 2})
+
+	b.PutValue("/a", "1", "", "test", 1)
+	b.PutValue("/b", "1", "", "test", 1)
+	if err := b.PutValue("/c", "1", "", "test", 1); quotaLimit(err) != QuotaKeys {
+		t.Errorf("third key got %v, want the key quota", err)
+	}
+	if err := b.PutValue("/a", "2", "", "test", 1); err != nil {
+		t.Errorf("overwriting a key failed: %v", err)
+	}
+	_, err := b.Transact(nil, []TxnOp{{Op: TxnDelete, Key: "/a"}, {Op: TxnPut, Key: "/c", Value: "1"}}, "test", "", 1)
+	if err != nil {
+		t.Errorf("transaction staying within the quota failed: %v", err)
+	}
+	if _, err := b.Transact(nil, []TxnOp{{Op: TxnPut, Key: "/d", Value: "1"}}, "test", "", 1); quotaLimit(err) != QuotaKeys {
+		t.Errorf("transaction adding a key got %v, want the key quota", err)
+	}
+
+	records := []*ExportRecord{{Key: "/x", Value: json.RawMessage(`{}`)}}
+	if _, err := b.ImportValues(records, ImportMerge); quotaLimit(err) != QuotaKeys {
+		t.Errorf("merge import past the quota got %v", err)
+	}
+	if _, err := b.ImportValues(records, ImportReplace); err != nil {
+		t.Errorf("replace import within the quota failed: %v", err)
+	}
+}
+
+func TestQuotaMaxValueBytes(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/big", strings.Repeat("x", 500), "", "test", 1)
+	b.SetQuota(Quota{MaxValueBytes: 300})
+
+	if err := b.PutValue("/other", "1", "", "test", 1); quotaLimit(err) != QuotaValueBytes {
+		t.Errorf("growing past a lowered quota got %v", err)
+	}
+	if err := b.PutValue("/big", "small", "", "test", 1); err != nil {
+		t.Errorf("shrinking under a lowered quota failed: %v", err)
+	}
+	if err := b.PutValue("/other", "1", "", "test", 1); err != nil {
+		t.Errorf("write within the quota failed: %v", err)
+	}
+	if usage := b.QuotaUsage(); usage.Keys != 2 || usage.ValueBytes <= 0 || usage.ValueBytes > 300 {
+		t.Errorf("usage is %+v", usage)
+	}
+}
+
+func TestQuotaMessagesPerMinute(t *testing.T) {
+	b := newTestBroker(t)
+	b.SetQuota(Quota{MaxMessagesPerMinute: 2, MaxKeys: 1})
+	b.Subscribe("/a", "c1", "127.0.0.1")
+
+	// A message the storage quota turns away doesn't use up the rate
+	b.Publish("/a", "1", "test", "", 1)
+	if err := b.Publish("/b", "1", "test", "", 1); quotaLimit(err) != QuotaKeys {
+		t.Fatalf("publish past the key quota got %v", err)
+	}
+	if err := b.Publish("/a", "2", "test", "", 2); err != nil {
+		t.Fatalf("second message failed: %v", err)
+	}
+	if err := b.Publish("/a", "3", "test", "", 3); quotaLimit(err) != QuotaMessagesPerMinute {
+		t.Errorf("third message got %v, want the message quota", err)
+	}
+	if usage := b.QuotaUsage(); usage.MessagesPerMinute != 2 {
+		t.Errorf("usage counts %d messages, want 2", usage.MessagesPerMinute)
+	}
+
+	messages, _ := b.Pickup("c1", "127.0.0.1")
+	if n := len(messages["/a"]); n != 2 {
+		t.Errorf("subscriber got %d messages, want the 2 accepted", n)
+	}
+}
+
+func TestQuotaClientsAndSubscriptions(t *testing.T) {
+	b := newTestBroker(t)
+	b.SetQuota(Quota{MaxClients: 1, MaxSubscriptions: 2})
+
+	if err := b.SubscribeTopics([]string{"/a", "/b"}, false, "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe("/a", "c2", ""); quotaLimit(err) != QuotaClients {
+		t.Errorf("second client got %v, want the client quota", err)
+	}
+	if err := b.SubscribeTopics([]string{"^/c"}, true, "c1", ""); quotaLimit(err) != QuotaSubscriptions {
+		t.Errorf("third subscription got %v, want the subscription quota", err)
+	}
+	if err := b.Subscribe("/a", "c1", ""); err != nil {
+		t.Errorf("repeating a subscription failed: %v", err)
+	}
+}
+
+func TestQuotaStore(t *testing.T) {
+	dir := t.TempDir()
+	qs, err := NewQuotaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qs.Set("alice", Quota{MaxKeys: 10}); err != nil {
+		t.Fatal(err)
+	}
+	qs.Set("bob", Quota{MaxClients: 1})
+	qs.Delete("bob")
+
+	qs, err = NewQuotaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota := qs.Get("alice"); quota != (Quota{MaxKeys: 10}) {
+		t.Errorf("reloaded quota is %+v", quota)
+	}
+	if quota := qs.Get("bob"); quota != (Quota{}) {
+		t.Errorf("deleted quota reloaded as %+v", quota)
+	}
+}
+
+func TestQuotaPatchAndTransactCountMessages(t *testing.T) {
+	b := newTestBroker(t)
+	b.SetQuota(Quota{MaxMessagesPerMinute: 3})
+	b.Publish("/doc", `{"a":1}`, "test", "", 1)
+	if _, _, err := b.PatchValue("/doc", `{"b":2}`, PatchMerge, "test", "", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two puts don't fit in the one message left
+	_, err := b.Transact(nil, []TxnOp{{Op: TxnPut, Key: "/x", Value: "1"}, {Op: TxnPut, Key: "/y", Value: "2"}}, "test", "", 3)
+	if quotaLimit(err) != QuotaMessagesPerMinute {
+		t.Fatalf("transaction past the message quota got %v", err)
+	}
+	if _, err := b.GetValue("/x"); err == nil {
+		t.Error("transaction over the quota stored /x")
+	}
+	if _, err := b.Transact(nil, []TxnOp{{Op: TxnPut, Key: "/x", Value: "1"}}, "test", "", 3); err != nil {
+		t.Fatalf("transaction within the quota failed: %v", err)
+	}
+	if _, _, err := b.PatchValue("/doc", `{"c":3}`, PatchMerge, "test", "", 4); quotaLimit(err) != QuotaMessagesPerMinute {
+		t.Errorf("patch past the message quota got %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default retention of the time series resolutions
+const (
+	DefaultSeriesRawRetention    = 24 * time.Hour
+	DefaultSeriesMinuteRetention = 7 * 24 * time.Hour
+	DefaultSeriesHourRetention   = 365 * 24 * time.Hour
+)
+
+// errSeriesUnsupported is returned for time series on a store without them
+var errSeriesUnsupported = errors.New("time series are not supported by this storage backend")
+
+// seriesResolution is a resolution points are rolled up to. Raw points
+// are kept per second, several in the same second share a bucket.
+type seriesResolution struct {
+	name string
+	step int64 // bucket width in seconds
+}
+
+var seriesResolutions = []seriesResolution{
+	{name: "raw", step: 1},
+	{name: "1m", step: 60},
+	{name: "1h", step: 3600},
+}
+
+// parseSeriesResolution returns the bucket width of a resolution name,
+// raw if empty
+func parseSeriesResolution(name string) (int64, error) {
+	if name == "" {
+		return seriesResolutions[0].step, nil
+	}
+	for _, resolution := range seriesResolutions {
+		if resolution.name == name {
+			return resolution.step, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown resolution %q, use raw, 1m or 1h", name)
+}
+
+// SeriesRetention is how long each resolution is kept
+type SeriesRetention struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+// forStep returns the retention of the resolution with the given bucket width
+func (r SeriesRetention) forStep(step int64) time.Duration {
+	switch step {
+	case 60:
+		return r.Minute
+	case 3600:
+		return r.Hour
+	default:
+		return r.Raw
+	}
+}
+
+// SeriesPoint is a number published to a time series topic
+type SeriesPoint struct {
+	Topic string
+	Time  int64
+	Value float64
+}
+
+// SeriesBucket summarises the points of a topic within one bucket
+type SeriesBucket struct {
+	Time  int64   `json:"t"` // unix time the bucket starts
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Last  float64 `json:"last"`
+}
+
+// seriesStore is implemented by stores that can keep time series. Points
+// reach it through StoreBatch.Series.
+type seriesStore interface {
+	// EnableSeries prepares storage for time series with the given
+	// retention and returns the marked topic patterns
+	EnableSeries(retention SeriesRetention) ([]string, error)
+	// SetSeriesPattern marks or unmarks a topic pattern
+	SetSeriesPattern(pattern string, marked bool) error
+	// Series returns at most limit buckets of a topic from one resolution
+	// between two unix times, oldest first
+	Series(topic string, step, from, to int64, limit int) ([]SeriesBucket, error)
+	// PruneSeries removes buckets older than the retention of their resolution
+	PruneSeries(now time.Time) error
+}
+
+// validateSeriesPattern checks a topic pattern: + matches one segment and
+// # the rest of the topic, so it may only come last
+func validateSeriesPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if segment == "#" && i != len(segments)-1 {
+			return fmt.Errorf("# must be the last segment: %s", pattern)
+		}
+		if segment != "#" && segment != "+" && strings.ContainsAny(segment, "#+") {
+			return fmt.Errorf("wildcards must be whole segments: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// matchTopicPattern reports whether topic matches a pattern with + and #
+// wildcards
+func matchTopicPattern(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	topicSegments := strings.Split(topic, "/")
+	for i, segment := range patternSegments {
+		if segment == "#" {
+			return true
+		}
+		if i >= len(topicSegments) || (segment != "+" && segment != topicSegments[i]) {
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
+
+// EnableSeries turns on time series for the topics marked with MarkSeries.
+// Only stores implementing seriesStore, i.e. SQLite, support it.
+func (d *Database) EnableSeries(retention SeriesRetention) error {
+	store, ok := d.store.(seriesStore)
+	if !ok {
+		return errSeriesUnsupported
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	patterns, err := store.EnableSeries(retention)
+	if err != nil {
+		return err
+	}
+	d.seriesEnabled = true
+	d.seriesPatterns = patterns
+	return nil
+}
+
+// SeriesPatterns returns the topic patterns marked as time series
+func (d *Database) SeriesPatterns() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.seriesEnabled {
+		return nil, errSeriesUnsupported
+	}
+	return append([]string{}, d.seriesPatterns...), nil
+}
+
+// MarkSeries marks or unmarks a topic pattern as a time series. Numbers
+// published to matching topics are recorded from then on.
+func (d *Database) MarkSeries(pattern string, marked bool) error {
+	if err := validateSeriesPattern(pattern); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.seriesEnabled {
+		return errSeriesUnsupported
+	}
+	if err := d.store.(seriesStore).SetSeriesPattern(pattern, marked); err != nil {
+		return err
+	}
+
+	patterns := d.seriesPatterns[:0:0]
+	for _, existing := range d.seriesPatterns {
+		if existing != pattern {
+			patterns = append(patterns, existing)
+		}
+	}
+	if marked {
+		patterns = append(patterns, pattern)
+		sort.Strings(patterns)
+	}
+	d.seriesPatterns = patterns
+	return nil
+}
+
+// RecordSeries queues a point for the background writer if topic matches
+// a marked pattern, and reports whether it did
+func (d *Database) RecordSeries(topic string, value float64, at int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.seriesEnabled {
+		return false
+	}
+	for _, pattern := range d.seriesPatterns {
+		if matchTopicPattern(pattern, topic) {
+			d.pendingSeries = append(d.pendingSeries, SeriesPoint{Topic: topic, Time: at, Value: value})
+			return true
+		}
+	}
+	return false
+}
+
+// GetSeries returns at most limit buckets of a topic at a resolution
+// between two unix times, oldest first
+func (d *Database) GetSeries(topic, resolution string, from, to int64, limit int) ([]SeriesBucket, error) {
+	step, err := parseSeriesResolution(resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	enabled := d.seriesEnabled
+	d.mu.RUnlock()
+	if !enabled {
+		return nil, errSeriesUnsupported
+	}
+
+	// Write out pending points so queries see every one
+	if _, err := d.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush time series: %w", err)
+	}
+	return d.store.(seriesStore).Series(topic, step, from, to, limit)
+}
+
+// PruneSeries removes points older than the retention of their resolution
+func (d *Database) PruneSeries() error {
+	d.mu.RLock()
+	enabled := d.seriesEnabled
+	d.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	return d.store.(seriesStore).PruneSeries(time.Now())
+}
+
+// MarkSeries marks or unmarks a topic pattern of the tenant as a time series
+func (b *Broker) MarkSeries(pattern string, marked bool) error {
+	if err := b.db.MarkSeries(pattern, marked); err != nil {
+		return err
+	}
+	if marked {
+		b.LogUser("Marked %s as time series", pattern)
+	} else {
+		b.LogUser("Unmarked %s as time series", pattern)
+	}
+	return nil
+}
+
+// SeriesPatterns returns the topic patterns of the tenant marked as time series
+func (b *Broker) SeriesPatterns() ([]string, error) {
+	return b.db.SeriesPatterns()
+}
+
+// GetSeries returns the points of a topic between two unix times at a
+// resolution, raw, 1m or 1h
+func (b *Broker) GetSeries(topic, resolution string, from, to int64, limit int) ([]SeriesBucket, error) {
+	return b.db.GetSeries(topic, resolution, from, to, limit)
+}
+
+// EnableSeries creates the series tables and returns the marked patterns
+func (s *sqliteStore) EnableSeries(retention SeriesRetention) ([]string, error) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS series_patterns (pattern TEXT PRIMARY KEY)`,
+		`CREATE TABLE IF NOT EXISTS series (
+			topic TEXT NOT NULL,
+			step INTEGER NOT NULL,
+			bucket INTEGER NOT NULL,
+			count INTEGER NOT NULL,
+			sum REAL NOT NULL,
+			min REAL NOT NULL,
+			max REAL NOT NULL,
+			last REAL NOT NULL,
+			PRIMARY KEY (topic, step, bucket)
+		) WITHOUT ROWID`,
+		`CREATE INDEX IF NOT EXISTS series_bucket ON series (step, bucket)`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return nil, fmt.Errorf("failed to create series tables: %w", err)
+		}
+	}
+
+	rows, err := s.db.Query("SELECT pattern FROM series_patterns ORDER BY pattern")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query series patterns: %w", err)
+	}
+	defer rows.Close()
+
+	patterns := []string{}
+	for rows.Next() {
+		var pattern string
+		if err := rows.Scan(&pattern); err != nil {
+			return nil, fmt.Errorf("failed to scan series pattern: %w", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.seriesRetention = retention
+	s.mu.Unlock()
+	return patterns, nil
+}
+
+// SetSeriesPattern marks or unmarks a topic pattern
+func (s *sqliteStore) SetSeriesPattern(pattern string, marked bool) error {
+	query := "DELETE FROM series_patterns WHERE pattern = ?"
+	if marked {
+		query = "INSERT OR IGNORE INTO series_patterns (pattern) VALUES (?)"
+	}
+	if _, err := s.db.Exec(query, pattern); err != nil {
+		return fmt.Errorf("failed to update series pattern: %w", err)
+	}
+	return nil
+}
+
+// writeSeries adds points to their bucket at every resolution. Called from
+// Write inside its transaction.
+func (s *sqliteStore) writeSeries(tx *sql.Tx, points []SeriesPoint) error {
+	stmt, err := tx.Prepare(`INSERT INTO series (topic, step, bucket, count, sum, min, max, last)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (topic, step, bucket) DO UPDATE SET
+			count = count + 1,
+			sum = sum + excluded.sum,
+			min = MIN(min, excluded.min),
+			max = MAX(max, excluded.max),
+			last = excluded.last`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare series statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, point := range points {
+		for _, resolution := range seriesResolutions {
+			bucket := point.Time - point.Time%resolution.step
+			if _, err := stmt.Exec(point.Topic, resolution.step, bucket,
+				point.Value, point.Value, point.Value, point.Value); err != nil {
+				return fmt.Errorf("failed to insert series point for %s: %w", point.Topic, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Series returns the buckets of a topic at one resolution, oldest first
+func (s *sqliteStore) Series(topic string, step, from, to int64, limit int) ([]SeriesBucket, error) {
+	rows, err := s.db.Query(`SELECT bucket, count, sum, min, max, last FROM series
+		WHERE topic = ? AND step = ? AND bucket >= ? AND bucket <= ?
+		ORDER BY bucket LIMIT ?`, topic, step, from-from%step, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query series: %w", err)
+	}
+	defer rows.Close()
+
+	buckets := []SeriesBucket{}
+	for rows.Next() {
+		var bucket SeriesBucket
+		if err := rows.Scan(&bucket.Time, &bucket.Count, &bucket.Sum, &bucket.Min, &bucket.Max, &bucket.Last); err != nil {
+			return nil, fmt.Errorf("failed to scan series row: %w", err)
+		}
+		bucket.Avg = bucket.Sum / float64(bucket.Count)
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+// PruneSeries removes buckets that ended before the retention of their
+// resolution
+func (s *sqliteStore) PruneSeries(now time.Time) error {
+	s.mu.RLock()
+	retention := s.seriesRetention
+	s.mu.RUnlock()
+
+	for _, resolution := range seriesResolutions {
+		keep := retention.forStep(resolution.step)
+		if keep <= 0 {
+			continue
+		}
+		cutoff := now.Add(-keep).Unix() - resolution.step
+		if _, err := s.db.Exec("DELETE FROM series WHERE step = ? AND bucket <= ?", resolution.step, cutoff); err != nil {
+			return fmt.Errorf("failed to prune %s series: %w", resolution.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestSeriesPatterns(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		valid, match   bool
+	}{
+		{"/house/+/temp", "/house/kitchen/temp", true, true},
+		{"/house/+/temp", "/house/kitchen/temp/raw", true, false},
+		{"/house/#", "/house/kitchen/temp", true, true},
+		{"/house/kitchen", "/house/kitchen", true, true},
+		{"/house/#/temp", "", false, false},
+		{"/house/kit+", "", false, false},
+		{"", "", false, false},
+	}
+	for _, test := range tests {
+		if err := validateSeriesPattern(test.pattern); (err == nil) != test.valid {
+			t.Errorf("validateSeriesPattern(%q) got %v", test.pattern, err)
+		}
+		if test.valid && matchTopicPattern(test.pattern, test.topic) != test.match {
+			t.Errorf("matchTopicPattern(%q, %q) got %v, want %v", test.pattern, test.topic, !test.match, test.match)
+		}
+	}
+}
+
+func TestSeriesUnsupported(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.EnableSeries(SeriesRetention{}); err != errSeriesUnsupported {
+		t.Errorf("got %v enabling series on a memory store", err)
+	}
+	if d.RecordSeries("/t", 1, 0) {
+		t.Error("point recorded without series enabled")
+	}
+}
+
+func TestSeriesBuckets(t *testing.T) {
+	store, err := OpenStore(BackendSQLite, t.TempDir(), "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatabase(store, t.Name())
+	defer d.Close()
+	if err := d.EnableSeries(SeriesRetention{Raw: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MarkSeries("/house/+/temp", true); err != nil {
+		t.Fatal(err)
+	}
+	if d.RecordSeries("/house/kitchen/humidity", 50, 0) {
+		t.Error("point recorded for an unmarked topic")
+	}
+
+	// Two points share a raw bucket, all three share a minute
+	base := time.Now().Unix() / 3600 * 3600
+	for _, point := range []struct {
+		at    int64
+		value float64
+	}{{base, 20}, {base, 22}, {base + 30, 18}} {
+		if !d.RecordSeries("/house/kitchen/temp", point.value, point.at) {
+			t.Fatal("point not recorded for a marked topic")
+		}
+	}
+
+	raw, err := d.GetSeries("/house/kitchen/temp", "raw", base, base+60, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 || raw[0].Count != 2 || raw[0].Avg != 21 || raw[0].Last != 22 || raw[1].Time != base+30 {
+		t.Errorf("got raw buckets %+v", raw)
+	}
+	minute, _ := d.GetSeries("/house/kitchen/temp", "1m", base, base, 10)
+	if len(minute) != 1 || minute[0].Count != 3 || minute[0].Min != 18 || minute[0].Max != 22 || minute[0].Sum != 60 {
+		t.Errorf("got minute buckets %+v", minute)
+	}
+	if limited, _ := d.GetSeries("/house/kitchen/temp", "", base, base+60, 1); len(limited) != 1 {
+		t.Errorf("limit 1 returned %d buckets", len(limited))
+	}
+	if _, err := d.GetSeries("/house/kitchen/temp", "1d", base, base, 1); err == nil {
+		t.Error("unknown resolution accepted")
+	}
+
+	// Raw points older than their retention go, minutes stay
+	d.RecordSeries("/house/hall/temp", 15, base-2*3600)
+	d.Flush()
+	if err := d.PruneSeries(); err != nil {
+		t.Fatal(err)
+	}
+	if old, _ := d.GetSeries("/house/hall/temp", "raw", 0, base, 10); len(old) != 0 {
+		t.Errorf("pruned raw buckets still there: %+v", old)
+	}
+	if old, _ := d.GetSeries("/house/hall/temp", "1m", 0, base, 10); len(old) != 1 {
+		t.Errorf("got %d minute buckets, want the one kept", len(old))
+	}
+
+	if err := d.MarkSeries("/house/+/temp", false); err != nil {
+		t.Fatal(err)
+	}
+	if patterns, _ := d.SeriesPatterns(); len(patterns) != 0 {
+		t.Errorf("patterns after unmarking: %v", patterns)
+	}
+}
+
+func TestSeriesFromPatchAndTransact(t *testing.T) {
+	store, err := OpenStore(BackendSQLite, t.TempDir(), "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatabase(store, t.Name())
+	defer d.Close()
+	if err := d.EnableSeries(SeriesRetention{}); err != nil {
+		t.Fatal(err)
+	}
+	d.MarkSeries("/meter/#", true)
+	b := NewBroker(log.New(io.Discard, "", 0), d, false)
+
+	at := time.Now().Unix()
+	b.PutValue("/meter/a", "1", "", "test", at)
+	if _, _, err := b.PatchValue("/meter/a", `[{"op":"replace","path":"","value":5}]`, PatchJSON, "test", "", at); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Transact(nil, []TxnOp{{Op: TxnPut, Key: "/meter/a", Value: "7"}}, "test", "", at); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, _ := b.GetSeries("/meter/a", "raw", at, at, 10)
+	if len(buckets) != 1 || buckets[0].Count != 2 || buckets[0].Sum != 12 {
+		t.Errorf("got buckets %+v, want the patched and the transacted value", buckets)
+	}
+}
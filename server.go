@@ -6,9 +6,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -22,21 +26,28 @@ import (
 
 // BrokerManager manages per-user broker instances
 type BrokerManager struct {
-	brokers       map[string]*Broker
-	mu            sync.RWMutex
-	logger        *log.Logger
-	dataDir       string
-	defaultBroker *Broker
-	ctx           context.Context
+	brokers        map[string]*Broker
+	mu             sync.RWMutex
+	logger         *log.Logger
+	dataDir        string
+	defaultBroker  *Broker
+	ctx            context.Context
+	dbConfig       DatabaseConfig
+	backupMu       sync.Mutex               // one backup at a time
+	offlineBackups map[string]chan struct{} // tenants being copied without a broker, closed when done
+	quotas         *QuotaStore
 }
 
 // NewBrokerManager creates a new broker manager
-func NewBrokerManager(logger *log.Logger, dataDir string, allowPublic bool) *BrokerManager {
+func NewBrokerManager(logger *log.Logger, dataDir string, allowPublic bool, dbConfig DatabaseConfig, quotas *QuotaStore) *BrokerManager {
 	bm := &BrokerManager{
-		brokers: make(map[string]*Broker),
-		logger:  logger,
-		dataDir: dataDir,
-		ctx:     nil, // Will be set when Start() is called
+		brokers:        make(map[string]*Broker),
+		offlineBackups: make(map[string]chan struct{}),
+		logger:         logger,
+		dataDir:        dataDir,
+		ctx:            nil, // Will be set when Start() is called
+		dbConfig:       dbConfig,
+		quotas:         quotas,
 	}
 
 	// Note: Default broker creation is deferred until InitializeDefault() is called with context
@@ -52,18 +63,14 @@ func (bm *BrokerManager) InitializeDefault(ctx context.Context, allowPublic bool
 
 	// Create default/public broker if allowed
 	if allowPublic {
-		defaultDataDir := filepath.Join(bm.dataDir, "public")
+		defaultDataDir := tenantDataDir(bm.dataDir, "public")
 		if err := os.MkdirAll(defaultDataDir, 0755); err != nil {
 			bm.logger.Printf("Warning: Could not create public data dir: %v", err)
 		} else {
-			db, err := NewDatabase(filepath.Join(defaultDataDir, "moustique.db"))
+			db, err := bm.openDatabase(defaultDataDir, "public")
 			if err != nil {
 				bm.logger.Printf("Warning: Could not create public database: %v", err)
 			} else {
-				if err := db.LoadAll(); err != nil {
-					bm.logger.Printf("Warning: Could not load public database: %v", err)
-				}
-
 				// Create user log file for public broker
 				userLogPath := filepath.Join(defaultDataDir, "user.log")
 				userLogFile, err := os.OpenFile(userLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -74,6 +81,8 @@ func (bm *BrokerManager) InitializeDefault(ctx context.Context, allowPublic bool
 
 				bm.defaultBroker = NewBroker(bm.logger, db, false)
 				bm.defaultBroker.SetUserLogger(userLogger, userLogPath)
+				bm.defaultBroker.SetExpiryNotifications(bm.dbConfig.ExpiryNotifications)
+				bm.defaultBroker.SetQuota(bm.quotas.Get("public"))
 				bm.defaultBroker.LogUser("Public broker initialized")
 
 				// Publish resubscribe system message for clients to re-register
@@ -98,29 +107,37 @@ func (bm *BrokerManager) GetOrCreateBroker(username string) (*Broker, error) {
 		return broker, nil
 	}
 
+	// Don't open the store while a backup has it open, see backupTenant
+	for {
+		done, copying := bm.offlineBackups[username]
+		if !copying {
+			break
+		}
+		bm.mu.Unlock()
+		<-done
+		bm.mu.Lock()
+	}
+	if broker, exists := bm.brokers[username]; exists {
+		return broker, nil
+	}
+
 	// Ensure context is set
 	if bm.ctx == nil {
 		return nil, fmt.Errorf("broker manager context not initialized")
 	}
 
 	// Create user data directory
-	userDataDir := filepath.Join(bm.dataDir, "users", username)
+	userDataDir := tenantDataDir(bm.dataDir, username)
 	if err := os.MkdirAll(userDataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create user data directory: %w", err)
 	}
 
-	// Create database for this user
-	dbPath := filepath.Join(userDataDir, "moustique.db")
-	db, err := NewDatabase(dbPath)
+	// Create database for this user and load existing data
+	db, err := bm.openDatabase(userDataDir, username)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database: %w", err)
 	}
 
-	// Load existing data
-	if err := db.LoadAll(); err != nil {
-		bm.logger.Printf("Warning: Could not load database for user %s: %v", username, err)
-	}
-
 	// Create user log file
 	userLogPath := filepath.Join(userDataDir, "user.log")
 	userLogFile, err := os.OpenFile(userLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -133,6 +150,8 @@ func (bm *BrokerManager) GetOrCreateBroker(username string) (*Broker, error) {
 	// Create broker
 	broker := NewBroker(bm.logger, db, false)
 	broker.SetUserLogger(userLogger, userLogPath)
+	broker.SetExpiryNotifications(bm.dbConfig.ExpiryNotifications)
+	broker.SetQuota(bm.quotas.Get(username))
 	bm.brokers[username] = broker
 
 	// Publish resubscribe system message for clients to re-register
@@ -146,6 +165,116 @@ func (bm *BrokerManager) GetOrCreateBroker(username string) (*Broker, error) {
 	return broker, nil
 }
 
+// openDatabase opens and loads the database in a tenant data directory,
+// using the tenant's configured storage backend, and starts its background writer
+func (bm *BrokerManager) openDatabase(dataDir, name string) (*Database, error) {
+	store, err := bm.openStore(dataDir, name)
+	if err != nil {
+		return nil, err
+	}
+	db := NewDatabase(store, dataDir)
+
+	if err := db.LoadAll(); err != nil {
+		bm.logger.Printf("Warning: Could not load database for %s: %v", name, err)
+	}
+
+	if bm.dbConfig.HistoryEnabled {
+		if err := db.EnableHistory(bm.dbConfig.HistoryMaxVersions, bm.dbConfig.HistoryMaxAge); err != nil {
+			bm.logger.Printf("Warning: Could not enable value history for %s: %v", name, err)
+		}
+	}
+
+	// Time series need a store that supports them, others go without
+	if _, ok := store.(seriesStore); ok && bm.dbConfig.SeriesEnabled() {
+		if err := db.EnableSeries(SeriesRetention{
+			Raw:    bm.dbConfig.SeriesRawRetention,
+			Minute: bm.dbConfig.SeriesMinuteRetention,
+			Hour:   bm.dbConfig.SeriesHourRetention,
+		}); err != nil {
+			bm.logger.Printf("Warning: Could not enable time series for %s: %v", name, err)
+		}
+	}
+
+	go db.StartWriter(bm.ctx, bm.dbConfig.FlushInterval, bm.dbConfig.FlushBatchSize)
+	return db, nil
+}
+
+// openStore is the factory for tenant stores
+func (bm *BrokerManager) openStore(dataDir, name string) (Store, error) {
+	backend := bm.dbConfig.BackendFor(name)
+	store, err := openTenantStore(bm.dbConfig, dataDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if backend != BackendSQLite {
+		bm.logger.Printf("Using %s storage backend for %s", backend, name)
+	}
+	return store, nil
+}
+
+// allBrokers returns every broker keyed by tenant, with the public broker as "public"
+func (bm *BrokerManager) allBrokers() map[string]*Broker {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	brokers := make(map[string]*Broker, len(bm.brokers)+1)
+	if bm.defaultBroker != nil {
+		brokers["public"] = bm.defaultBroker
+	}
+	for username, broker := range bm.brokers {
+		brokers[username] = broker
+	}
+	return brokers
+}
+
+// SuperviseCheckpoints saves every tenant database in full once per
+// CheckpointInterval. Each tenant gets a random offset and jitter so they
+// don't all write at the same time. Failures are published as system messages.
+func (bm *BrokerManager) SuperviseCheckpoints(ctx context.Context) {
+	interval := bm.dbConfig.CheckpointInterval
+	if interval <= 0 {
+		return
+	}
+
+	jitter := func() time.Duration {
+		if bm.dbConfig.CheckpointJitter <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(bm.dbConfig.CheckpointJitter)))
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	nextRun := make(map[string]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for tenant, broker := range bm.allBrokers() {
+				next, scheduled := nextRun[tenant]
+				if !scheduled {
+					// Spread new tenants over the first interval
+					nextRun[tenant] = now.Add(time.Duration(rand.Int63n(int64(interval))))
+					continue
+				}
+				if now.Before(next) || broker.db == nil {
+					continue
+				}
+
+				if err := broker.db.Checkpoint(); err != nil {
+					bm.logger.Printf("Checkpoint failed for %s: %v", tenant, err)
+					broker.LogUser("Checkpoint failed: %v", err)
+					broker.PublishSystemMessage("/server/notification/checkpoint_failed",
+						fmt.Sprintf("Checkpoint failed: %v", err))
+				}
+				nextRun[tenant] = time.Now().Add(interval + jitter())
+			}
+		}
+	}
+}
+
 // GetBroker gets an existing broker (returns nil if not found)
 func (bm *BrokerManager) GetBroker(username string) *Broker {
 	bm.mu.RLock()
@@ -153,6 +282,24 @@ func (bm *BrokerManager) GetBroker(username string) *Broker {
 	return bm.brokers[username]
 }
 
+// SetQuota stores a tenant's quota and applies it to the tenant's broker if
+// it is running
+func (bm *BrokerManager) SetQuota(tenant string, quota Quota) error {
+	if err := bm.quotas.Set(tenant, quota); err != nil {
+		return err
+	}
+
+	broker := bm.GetBroker(tenant)
+	if tenant == "public" {
+		broker = bm.GetDefaultBroker()
+	}
+	if broker != nil {
+		broker.SetQuota(quota)
+		broker.LogUser("Quota set: %+v", quota)
+	}
+	return nil
+}
+
 // GetDefaultBroker returns the public/default broker
 func (bm *BrokerManager) GetDefaultBroker() *Broker {
 	return bm.defaultBroker
@@ -290,6 +437,15 @@ func (ua *UserAuth) AddUser(username, password string) error {
 	return ua.Save()
 }
 
+// HasUser reports whether a user exists
+func (ua *UserAuth) HasUser(username string) bool {
+	ua.mu.RLock()
+	defer ua.mu.RUnlock()
+
+	_, exists := ua.users[username]
+	return exists
+}
+
 // ValidateUser checks if username/password is valid
 func (ua *UserAuth) ValidateUser(username, password string) bool {
 	ua.mu.RLock()
@@ -308,6 +464,28 @@ func hashPassword(password string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// Number of entries returned by PEEK, VALHISTORY and SERIES when no limit is given
+const (
+	defaultPeekLimit    = 20
+	defaultHistoryLimit = 100
+	defaultSeriesLimit  = 1000
+)
+
+// Seconds before to that SERIES starts at when no from is given
+const defaultSeriesWindow = 24 * 60 * 60
+
+// How long WATCHVAL waits for a change
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+// maxPageLimit caps the page size of TOPICS and GETVALSBYREGEX
+const maxPageLimit = 10000
+
+// maxRequestBytes caps the body of a request, IMPORT documents included
+const maxRequestBytes = 64 << 20
+
 // Server handles HTTP connections
 type Server struct {
 	port          int
@@ -322,7 +500,7 @@ type Server struct {
 }
 
 // NewServer creates a new HTTP server
-func NewServer(port int, timeout time.Duration, logger *log.Logger, dataDir string, debug bool, Version string, allowPublic bool, allowedPeers []string) (*Server, error) {
+func NewServer(port int, timeout time.Duration, logger *log.Logger, dataDir string, debug bool, Version string, allowPublic bool, allowedPeers []string, dbConfig DatabaseConfig) (*Server, error) {
 	// Create data directory
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
@@ -333,11 +511,16 @@ func NewServer(port int, timeout time.Duration, logger *log.Logger, dataDir stri
 		return nil, fmt.Errorf("failed to initialize user auth: %w", err)
 	}
 
+	quotas, err := NewQuotaStore(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize quotas: %w", err)
+	}
+
 	return &Server{
 		port:          port,
 		timeout:       timeout,
 		logger:        logger,
-		brokerManager: NewBrokerManager(logger, dataDir, allowPublic),
+		brokerManager: NewBrokerManager(logger, dataDir, allowPublic, dbConfig, quotas),
 		userAuth:      userAuth,
 		security:      NewSecurityChecker(allowedPeers),
 		debug:         debug,
@@ -361,6 +544,8 @@ func (s *Server) Start(ctx context.Context) error {
 	if err := s.brokerManager.InitializeDefault(ctx, s.allowPublic); err != nil {
 		return fmt.Errorf("failed to initialize broker manager: %w", err)
 	}
+	go s.brokerManager.SuperviseCheckpoints(ctx)
+	go s.brokerManager.SuperviseBackups(ctx)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
 	if err != nil {
@@ -488,12 +673,19 @@ func (s *Server) handleRequest(conn net.Conn, req *http.Request, peerHost string
 	if req.Method == "GET" {
 		rawParams = req.URL.Query()
 	} else {
-		body, err := ioutil.ReadAll(req.Body)
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestBytes+1))
 		req.Body.Close()
 		if err != nil {
 			s.sendBadRequest(conn)
 			return
 		}
+		if len(body) > maxRequestBytes {
+			s.sendJSONStatus(conn, "413 Request Entity Too Large", map[string]interface{}{
+				"status": "too_large",
+				"max":    maxRequestBytes,
+			})
+			return
+		}
 
 		rawParams, err = url.ParseQuery(string(body))
 		if err != nil {
@@ -554,8 +746,18 @@ func (s *Server) handleRequest(conn net.Conn, req *http.Request, peerHost string
 			s.handleAdminAddUser(conn, params)
 		case "ADMIN/DELETE_USER":
 			s.handleAdminDeleteUser(conn, params)
+		case "ADMIN/SET_QUOTA":
+			s.handleAdminSetQuota(conn, params)
 		case "ADMIN/SERVER_LOG":
 			s.GetRecentLogs(conn, 100)
+		case "ADMIN/PEEK":
+			s.handleAdminPeek(conn, params)
+		case "ADMIN/BACKUP":
+			s.handleAdminBackup(conn, params)
+		case "ADMIN/EXPORT":
+			s.handleAdminExport(conn, params)
+		case "ADMIN/IMPORT":
+			s.handleAdminImport(conn, params)
 		default:
 			s.sendNotFound(conn)
 		}
@@ -615,24 +817,58 @@ func (s *Server) handleRequest(conn net.Conn, req *http.Request, peerHost string
 		s.handlePost(conn, params, peerHost, broker)
 	case "SUBSCRIBE":
 		s.handleSubscribe(conn, params, peerHost, broker)
+	case "PAUSE":
+		s.handlePause(conn, params, broker)
+	case "RESUME":
+		s.handleResume(conn, params, broker)
 	case "PUTVAL":
 		s.handlePutVal(conn, params, broker)
 	case "GETVAL":
 		s.handleGetVal(conn, params, broker)
 	case "GETVALSBYREGEX":
 		s.handleGetValsByRegex(conn, params, broker)
+	case "WATCHVAL":
+		s.handleWatchVal(conn, params, broker)
+	case "INCRVAL":
+		s.handleIncrVal(conn, params, broker)
+	case "PATCHVAL":
+		s.handlePatchVal(conn, params, peerHost, broker)
+	case "TXN":
+		s.handleTxn(conn, params, peerHost, broker)
+	case "DELVAL":
+		s.handleDelVal(conn, params, broker)
+	case "DELVALSBYREGEX":
+		s.handleDelValsByRegex(conn, params, broker)
+	case "VALHISTORY":
+		s.handleValHistory(conn, params, broker)
+	case "EXPORT":
+		s.handleExport(conn, broker)
+	case "IMPORT":
+		s.handleImport(conn, params, broker)
 	case "STATUS":
 		s.handleStatus(conn, params, broker)
 	case "STATS":
 		s.handleStats(conn, params, broker)
 	case "CLIENTS":
 		s.handleClients(conn, params, broker)
+	case "PEEK":
+		s.handlePeek(conn, params, broker)
 	case "POSTERS":
 		s.handlePosters(conn, params, broker)
 	case "LOG":
 		s.handleLog(conn, params, broker)
 	case "TOPICS":
 		s.handleTopics(conn, params, broker)
+	case "TREE":
+		s.handleTree(conn, params, broker)
+	case "QUERY":
+		s.handleQuery(conn, params, broker)
+	case "AGGREGATE":
+		s.handleAggregate(conn, params, broker)
+	case "SERIES":
+		s.handleSeries(conn, params, broker)
+	case "SERIESPATTERNS":
+		s.handleSeriesPatterns(conn, params, broker)
 	case "CROOKS":
 		s.handleCrooks(conn, params, broker)
 	default:
@@ -665,12 +901,37 @@ func (s *Server) handlePickup(conn net.Conn, params map[string]string, peerHost
 		return
 	}
 
-	messages, err := broker.Pickup(client, peerHost)
+	maxMessages, err := paramInt(params, "max_messages")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+	maxBytes, err := paramInt(params, "max_bytes")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	messages, pending, err := broker.PickupLimited(client, peerHost, maxMessages, maxBytes)
 	if err != nil {
 		s.sendError(conn, err)
 		return
 	}
 
+	// Clients asking for bounded pages get told whether more is waiting;
+	// everyone else gets the plain topic -> messages map as before. What a
+	// paused client has buffered is pending but can't be picked up yet.
+	if maxMessages > 0 || maxBytes > 0 {
+		paused := broker.ClientPaused(client)
+		s.sendJSON(conn, map[string]interface{}{
+			"messages": messages,
+			"pending":  pending,
+			"more":     pending > 0 && !paused,
+			"paused":   paused,
+		})
+		return
+	}
+
 	s.sendJSON(conn, messages)
 }
 
@@ -691,8 +952,19 @@ func (s *Server) handlePost(conn net.Conn, params map[string]string, peerHost st
 		}
 	}
 
-	err := broker.Publish(topic, message, from, peerHost, updatedTime)
+	ttl, err := paramTTL(params)
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	err = broker.PublishTTL(topic, message, from, peerHost, updatedTime, ttl)
 	if err != nil {
+		var quota *QuotaExceededError
+		if errors.As(err, &quota) {
+			s.sendQuotaExceeded(conn, quota)
+			return
+		}
 		s.sendError(conn, err)
 		return
 	}
@@ -701,16 +973,74 @@ func (s *Server) handlePost(conn net.Conn, params map[string]string, peerHost st
 }
 
 func (s *Server) handleSubscribe(conn net.Conn, params map[string]string, peerHost string, broker *Broker) {
-	topic := params["topic"]
 	client := params["client"]
 
-	if topic == "" || client == "" {
+	// Topics can be given one at a time in "topic" and/or as a JSON list in "topics"
+	topics := []string{}
+	if topic := params["topic"]; topic != "" {
+		topics = append(topics, topic)
+	}
+	if list := params["topics"]; list != "" {
+		var extra []string
+		if err := json.Unmarshal([]byte(list), &extra); err != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		for _, topic := range extra {
+			if topic != "" {
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	if len(topics) == 0 || client == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	err := broker.SubscribeTopics(topics, paramBool(params, "regex"), client, peerHost)
+	if err != nil {
+		var quota *QuotaExceededError
+		if errors.As(err, &quota) {
+			s.sendQuotaExceeded(conn, quota)
+			return
+		}
+		s.sendError(conn, err)
+		return
+	}
+
+	s.sendOK(conn)
+}
+
+func (s *Server) handlePause(conn net.Conn, params map[string]string, broker *Broker) {
+	client := params["client"]
+	if client == "" {
 		s.sendNotFound(conn)
 		return
 	}
 
-	err := broker.Subscribe(topic, client, peerHost)
+	secs, err := paramInt(params, "duration")
 	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	if err := broker.PauseClient(client, params["mode"], time.Duration(secs)*time.Second); err != nil {
+		s.sendError(conn, err)
+		return
+	}
+
+	s.sendOK(conn)
+}
+
+func (s *Server) handleResume(conn net.Conn, params map[string]string, broker *Broker) {
+	client := params["client"]
+	if client == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	if err := broker.ResumeClient(client); err != nil {
 		s.sendError(conn, err)
 		return
 	}
@@ -736,9 +1066,45 @@ func (s *Server) handlePutVal(conn net.Conn, params map[string]string, broker *B
 		}
 	}
 
-	err := broker.PutValue(valname, val, message, from, updatedTime)
+	ttl, err := paramTTL(params)
 	if err != nil {
-		s.sendError(conn, err)
+		s.sendBadRequest(conn)
+		return
+	}
+
+	// if_absent or if_version=<n> make the write conditional
+	var cond *WriteCondition
+	if paramBool(params, "if_absent") {
+		cond = &WriteCondition{IfAbsent: true}
+	} else if v := params["if_version"]; v != "" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		cond = &WriteCondition{IfVersion: version}
+	}
+
+	version, err := broker.PutValueIf(valname, val, message, from, updatedTime, ttl, cond)
+	if err != nil {
+		var conflict *VersionConflictError
+		var quota *QuotaExceededError
+		switch {
+		case errors.As(err, &conflict):
+			s.sendConflict(conn, conflict)
+		case errors.As(err, &quota):
+			s.sendQuotaExceeded(conn, quota)
+		default:
+			s.sendError(conn, err)
+		}
+		return
+	}
+
+	if cond != nil {
+		s.sendJSON(conn, map[string]interface{}{
+			"status":  "ok",
+			"version": version,
+		})
 		return
 	}
 
@@ -752,7 +1118,27 @@ func (s *Server) handleGetVal(conn net.Conn, params map[string]string, broker *B
 		return
 	}
 
-	value, err := broker.GetValue(topic)
+	// at=<unix time> or version=<n> read from the value history instead
+	var value *Message
+	var err error
+	switch {
+	case params["version"] != "":
+		version, perr := strconv.ParseInt(params["version"], 10, 64)
+		if perr != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		value, err = broker.GetValueVersion(topic, version)
+	case params["at"] != "":
+		at, perr := strconv.ParseInt(params["at"], 10, 64)
+		if perr != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		value, err = broker.GetValueAt(topic, at)
+	default:
+		value, err = broker.GetValue(topic)
+	}
 	if err != nil {
 		s.sendNotFound(conn)
 		return
@@ -761,74 +1147,503 @@ func (s *Server) handleGetVal(conn net.Conn, params map[string]string, broker *B
 	s.sendJSON(conn, value)
 }
 
-func (s *Server) handleGetValsByRegex(conn net.Conn, params map[string]string, broker *Broker) {
-	pattern := params["topic"]
-	if pattern == "" {
+func (s *Server) handleValHistory(conn net.Conn, params map[string]string, broker *Broker) {
+	topic := params["topic"]
+	if topic == "" {
 		s.sendNotFound(conn)
 		return
 	}
 
-	values, err := broker.GetValuesByRegex(pattern)
+	limit, err := paramInt(params, "limit")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+
+	history, err := broker.GetValueHistory(topic, limit)
 	if err != nil {
 		s.sendError(conn, err)
 		return
 	}
 
-	s.sendJSON(conn, values)
+	s.sendJSON(conn, history)
 }
 
-func (s *Server) handleVersion(conn net.Conn, versionType string) {
-	switch versionType {
-	case "running":
-		s.sendJSON(conn, s.version)
-	case "file":
-		fileversion, err := GetFileVersion()
-		if err != nil {
-			s.sendNotFound(conn)
-			return
-		}
-		s.sendJSON(conn, fileversion)
+func (s *Server) handleGetValsByRegex(conn net.Conn, params map[string]string, broker *Broker) {
+	pattern, prefix := params["topic"], params["prefix"]
+	if pattern == "" && prefix == "" {
+		s.sendNotFound(conn)
+		return
+	}
+	limit, ok := pageLimit(params)
+	if !ok {
+		s.sendBadRequest(conn)
+		return
 	}
-}
-
-func (s *Server) handleSignup(conn net.Conn, params map[string]string) {
-	// Get username and password from params (already ROT13+Base64 encoded)
-	username := params["username"]
-	password := params["password"]
 
-	if username == "" || password == "" {
-		s.sendError(conn, fmt.Errorf("username and password required"))
+	values, next, err := broker.GetValuesPage(pattern, prefix, params["cursor"], limit)
+	if err != nil {
+		s.sendError(conn, err)
 		return
 	}
 
-	// Decode username and password
-	decodedUsername := decodeROT13Base64(username)
-	decodedPassword := decodeROT13Base64(password)
+	if params["limit"] == "" {
+		s.sendJSON(conn, values)
+		return
+	}
+	s.sendJSON(conn, map[string]interface{}{
+		"values": values,
+		"cursor": next,
+	})
+}
 
-	// Validate username
-	if len(decodedUsername) < 3 || len(decodedUsername) > 32 {
-		s.sendError(conn, fmt.Errorf("username must be 3-32 characters"))
+func (s *Server) handleWatchVal(conn net.Conn, params map[string]string, broker *Broker) {
+	topic := params["topic"]
+	if topic == "" {
+		s.sendNotFound(conn)
 		return
 	}
 
-	// Validate password
-	if len(decodedPassword) < 8 {
-		s.sendError(conn, fmt.Errorf("password must be at least 8 characters"))
+	secs, err := paramInt(params, "timeout")
+	if err != nil {
+		s.sendBadRequest(conn)
 		return
 	}
+	timeout := defaultWatchTimeout
+	if secs > 0 {
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
 
-	// Add user
-	if err := s.AddUser(decodedUsername, decodedPassword); err != nil {
-		s.sendError(conn, fmt.Errorf("failed to create user: %v", err))
+	// Keep the connection open for the whole wait, unless the client leaves
+	conn.SetDeadline(time.Now().Add(timeout + s.timeout))
+	ctx, cancel := context.WithTimeout(s.brokerManager.ctx, timeout)
+	defer cancel()
+	cancelOnClose(conn, cancel)
+
+	// regex=true watches every key matching topic, resuming from seq
+	if paramBool(params, "regex") {
+		since, err := strconv.ParseInt(params["seq"], 10, 64)
+		if err != nil && params["seq"] != "" {
+			s.sendBadRequest(conn)
+			return
+		}
+
+		values, seq, err := broker.WatchValuesByRegex(ctx, topic, since)
+		if err != nil {
+			s.sendWatchError(conn, err)
+			return
+		}
+		s.sendJSON(conn, map[string]interface{}{
+			"changed": len(values) > 0,
+			"seq":     seq,
+			"values":  values,
+		})
 		return
 	}
 
-	s.logger.Printf("New user registered: %s", decodedUsername)
+	since, err := strconv.ParseInt(params["version"], 10, 64)
+	if err != nil && params["version"] != "" {
+		s.sendBadRequest(conn)
+		return
+	}
 
-	// Send success response
-	s.sendJSON(conn, map[string]string{
-		"status":  "success",
-		"message": "Account created successfully",
+	value, version, changed, err := broker.WatchValue(ctx, topic, since)
+	if err != nil {
+		s.sendWatchError(conn, err)
+		return
+	}
+	s.sendJSON(conn, map[string]interface{}{
+		"changed": changed,
+		"version": version,
+		"value":   value,
+	})
+}
+
+// cancelOnClose calls cancel once the client closes the connection. The
+// request has been read, so anything else the client sends is ignored.
+func cancelOnClose(conn net.Conn, cancel context.CancelFunc) {
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// sendWatchError reports a failed watch, with 429 when the tenant has too
+// many watches waiting
+func (s *Server) sendWatchError(conn net.Conn, err error) {
+	if errors.Is(err, errTooManyWatchers) {
+		s.sendJSONStatus(conn, "429 Too Many Requests", map[string]interface{}{
+			"status": "too_many_watchers",
+			"max":    maxWatchers,
+		})
+		return
+	}
+	s.sendError(conn, err)
+}
+
+func (s *Server) handleIncrVal(conn net.Conn, params map[string]string, broker *Broker) {
+	valname := params["valname"]
+	if valname == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	updatedTime := time.Now().Unix()
+	if t := params["updated_time"]; t != "" {
+		if parsed, err := strconv.ParseInt(t, 10, 64); err == nil {
+			updatedTime = parsed
+		}
+	}
+
+	// delta defaults to 1, mode=float allows fractional values
+	delta := params["delta"]
+	if delta == "" {
+		delta = "1"
+	}
+
+	var value string
+	var version int64
+	var err error
+	switch params["mode"] {
+	case "", "int":
+		n, perr := strconv.ParseInt(delta, 10, 64)
+		if perr != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		value, version, err = broker.IncrValue(valname, n, params["from"], updatedTime)
+	case "float":
+		f, perr := strconv.ParseFloat(delta, 64)
+		if perr != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			s.sendBadRequest(conn)
+			return
+		}
+		value, version, err = broker.IncrValueFloat(valname, f, params["from"], updatedTime)
+	default:
+		s.sendBadRequest(conn)
+		return
+	}
+	if err != nil {
+		var invalid *InvalidValueError
+		var quota *QuotaExceededError
+		switch {
+		case errors.As(err, &invalid):
+			s.sendInvalidValue(conn, invalid)
+		case errors.As(err, &quota):
+			s.sendQuotaExceeded(conn, quota)
+		default:
+			s.sendError(conn, err)
+		}
+		return
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"value":   value,
+		"version": version,
+	})
+}
+
+func (s *Server) handlePatchVal(conn net.Conn, params map[string]string, peerHost string, broker *Broker) {
+	valname := params["valname"]
+	patch := params["patch"]
+	if valname == "" || patch == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	format := params["format"]
+	if format == "" {
+		format = PatchMerge
+	}
+
+	updatedTime := time.Now().Unix()
+	if t := params["updated_time"]; t != "" {
+		if parsed, err := strconv.ParseInt(t, 10, 64); err == nil {
+			updatedTime = parsed
+		}
+	}
+
+	value, version, err := broker.PatchValue(valname, patch, format, params["from"], peerHost, updatedTime)
+	if err != nil {
+		var invalid *InvalidValueError
+		var patchErr *PatchError
+		var quota *QuotaExceededError
+		switch {
+		case errors.Is(err, errKeyNotFound):
+			s.sendNotFound(conn)
+		case errors.As(err, &invalid):
+			s.sendInvalidValue(conn, invalid)
+		case errors.As(err, &quota):
+			s.sendQuotaExceeded(conn, quota)
+		case errors.As(err, &patchErr) && patchErr.Malformed:
+			s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+				"status": "invalid_patch",
+				"error":  patchErr.Reason,
+			})
+		case errors.As(err, &patchErr):
+			s.sendJSONStatus(conn, "409 Conflict", map[string]interface{}{
+				"status": "patch_failed",
+				"error":  patchErr.Reason,
+			})
+		default:
+			s.sendError(conn, err)
+		}
+		return
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"value":   json.RawMessage(value),
+		"version": version,
+	})
+}
+
+func (s *Server) handleTxn(conn net.Conn, params map[string]string, peerHost string, broker *Broker) {
+	if params["ops"] == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	invalid := func(err error) {
+		s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+			"status": "invalid_txn",
+			"error":  err.Error(),
+		})
+	}
+
+	var checks []TxnCheck
+	if c := params["checks"]; c != "" {
+		if err := json.Unmarshal([]byte(c), &checks); err != nil {
+			invalid(fmt.Errorf("invalid checks: %w", err))
+			return
+		}
+	}
+	var ops []TxnOp
+	if err := json.Unmarshal([]byte(params["ops"]), &ops); err != nil {
+		invalid(fmt.Errorf("invalid ops: %w", err))
+		return
+	}
+	if err := validateTxn(checks, ops); err != nil {
+		invalid(err)
+		return
+	}
+
+	updatedTime := time.Now().Unix()
+	if t := params["updated_time"]; t != "" {
+		if parsed, err := strconv.ParseInt(t, 10, 64); err == nil {
+			updatedTime = parsed
+		}
+	}
+
+	result, err := broker.Transact(checks, ops, params["from"], peerHost, updatedTime)
+	if err != nil {
+		var failed *TxnCheckError
+		if errors.As(err, &failed) {
+			s.sendJSONStatus(conn, "409 Conflict", map[string]interface{}{
+				"status":          "check_failed",
+				"check":           failed.Index,
+				"key":             failed.Check.Key,
+				"exists":          failed.Exists,
+				"current_version": failed.Current,
+			})
+			return
+		}
+		var quota *QuotaExceededError
+		if errors.As(err, &quota) {
+			s.sendQuotaExceeded(conn, quota)
+			return
+		}
+		s.sendError(conn, err)
+		return
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"status":   "committed",
+		"versions": result.Versions,
+		"deleted":  result.Deleted,
+	})
+}
+
+func (s *Server) handleDelVal(conn net.Conn, params map[string]string, broker *Broker) {
+	topic := params["topic"]
+	if topic == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	dryRun := paramBool(params, "dry_run")
+	if !broker.DeleteValue(topic, params["from"], dryRun) {
+		s.sendNotFound(conn)
+		return
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"deleted": []string{topic},
+		"dry_run": dryRun,
+	})
+}
+
+func (s *Server) handleDelValsByRegex(conn net.Conn, params map[string]string, broker *Broker) {
+	pattern := params["topic"]
+	prefix := params["prefix"]
+	if pattern == "" && prefix == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	// A prefix takes the place of the regex when given
+	dryRun := paramBool(params, "dry_run")
+	var deleted []string
+	if prefix != "" {
+		deleted = broker.DeleteValuesByPrefix(prefix, params["from"], dryRun)
+	} else {
+		var err error
+		deleted, err = broker.DeleteValuesByRegex(pattern, params["from"], dryRun)
+		if err != nil {
+			s.sendError(conn, err)
+			return
+		}
+	}
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"deleted": deleted,
+		"dry_run": dryRun,
+	})
+}
+
+// handleExport streams every stored value as NDJSON. Each line is encoded
+// on its own like other responses.
+func (s *Server) handleExport(conn net.Conn, broker *Broker) {
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n")
+	fmt.Fprintf(conn, "Connection: close\r\n")
+	fmt.Fprintf(conn, "Content-Type: application/x-ndjson\r\n")
+	fmt.Fprintf(conn, "\r\n")
+
+	writer := bufio.NewWriter(conn)
+	count := 0
+	err := broker.ExportValues(func(record *ExportRecord) error {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		// Give large exports time to drain
+		count++
+		if count%1000 == 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		}
+		_, err = fmt.Fprintf(writer, "%s\n", encodeROT13Base64(string(line)))
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil && s.debug {
+		s.logger.Printf("Export failed after %d values: %v", count, err)
+	}
+}
+
+func (s *Server) handleImport(conn net.Conn, params map[string]string, broker *Broker) {
+	mode := params["mode"]
+	if mode == "" {
+		mode = ImportMerge
+	}
+	if mode != ImportMerge && mode != ImportReplace {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	records, err := ReadExport(strings.NewReader(params["data"]))
+	if err != nil {
+		s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+			"status": "invalid",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	count, err := broker.ImportValues(records, mode)
+	if err != nil {
+		var quota *QuotaExceededError
+		if errors.As(err, &quota) {
+			s.sendQuotaExceeded(conn, quota)
+			return
+		}
+		s.sendError(conn, err)
+		return
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"status":   "ok",
+		"imported": count,
+		"mode":     mode,
+	})
+}
+
+func (s *Server) handleVersion(conn net.Conn, versionType string) {
+	switch versionType {
+	case "running":
+		s.sendJSON(conn, s.version)
+	case "file":
+		fileversion, err := GetFileVersion()
+		if err != nil {
+			s.sendNotFound(conn)
+			return
+		}
+		s.sendJSON(conn, fileversion)
+	}
+}
+
+func (s *Server) handleSignup(conn net.Conn, params map[string]string) {
+	// Get username and password from params (already ROT13+Base64 encoded)
+	username := params["username"]
+	password := params["password"]
+
+	if username == "" || password == "" {
+		s.sendError(conn, fmt.Errorf("username and password required"))
+		return
+	}
+
+	// Decode username and password
+	decodedUsername := decodeROT13Base64(username)
+	decodedPassword := decodeROT13Base64(password)
+
+	// Validate username
+	if len(decodedUsername) < 3 || len(decodedUsername) > 32 {
+		s.sendError(conn, fmt.Errorf("username must be 3-32 characters"))
+		return
+	}
+
+	// Validate password
+	if len(decodedPassword) < 8 {
+		s.sendError(conn, fmt.Errorf("password must be at least 8 characters"))
+		return
+	}
+
+	// Add user
+	if err := s.AddUser(decodedUsername, decodedPassword); err != nil {
+		s.sendError(conn, fmt.Errorf("failed to create user: %v", err))
+		return
+	}
+
+	s.logger.Printf("New user registered: %s", decodedUsername)
+
+	// Send success response
+	s.sendJSON(conn, map[string]string{
+		"status":  "success",
+		"message": "Account created successfully",
 	})
 }
 
@@ -847,14 +1662,235 @@ func (s *Server) handleClients(conn net.Conn, params map[string]string, broker *
 	s.sendJSON(conn, clients)
 }
 
+func (s *Server) handlePeek(conn net.Conn, params map[string]string, broker *Broker) {
+	client := params["client"]
+	if client == "" {
+		s.sendNotFound(conn)
+		return
+	}
+
+	limit, err := paramInt(params, "limit")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+	if limit == 0 {
+		limit = defaultPeekLimit
+	}
+
+	peek, err := broker.PeekQueue(client, limit)
+	if err != nil {
+		s.sendNotFound(conn)
+		return
+	}
+
+	s.sendJSON(conn, peek)
+}
+
 func (s *Server) handlePosters(conn net.Conn, params map[string]string, broker *Broker) {
 	posters := broker.GetPosters()
 	s.sendJSON(conn, posters)
 }
 
+// handleTopics lists topics in order. Without limit it returns the full
+// list as before, with limit a page and the cursor of the next one.
 func (s *Server) handleTopics(conn net.Conn, params map[string]string, broker *Broker) {
-	topics := broker.GetTopics()
-	s.sendJSON(conn, topics)
+	limit, ok := pageLimit(params)
+	if !ok {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	topics, next := broker.GetTopicsPage(params["prefix"], params["cursor"], limit)
+	if params["limit"] == "" {
+		s.sendJSON(conn, topics)
+		return
+	}
+	s.sendJSON(conn, map[string]interface{}{
+		"topics": topics,
+		"cursor": next,
+	})
+}
+
+// pageLimit parses the limit parameter of paginated listings
+func pageLimit(params map[string]string) (int, bool) {
+	limit, err := paramInt(params, "limit")
+	if err != nil {
+		return 0, false
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, true
+}
+
+func (s *Server) handleTree(conn net.Conn, params map[string]string, broker *Broker) {
+	depth, err := paramInt(params, "depth")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	tree, err := broker.GetTree(params["topic"], depth)
+	if err != nil {
+		s.sendNotFound(conn)
+		return
+	}
+	s.sendJSON(conn, tree)
+}
+
+func (s *Server) handleQuery(conn net.Conn, params map[string]string, broker *Broker) {
+	if params["topic"] == "" && params["prefix"] == "" {
+		s.sendNotFound(conn)
+		return
+	}
+	limit, ok := pageLimit(params)
+	if !ok {
+		s.sendBadRequest(conn)
+		return
+	}
+	timeoutMs, err := paramInt(params, "timeout_ms")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	result, err := broker.Query(&Query{
+		Pattern: params["topic"],
+		Prefix:  params["prefix"],
+		Cursor:  params["cursor"],
+		Where:   params["where"],
+		Select:  params["select"],
+		Limit:   limit,
+		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	})
+	if err != nil {
+		s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+			"status": "invalid_query",
+			"error":  err.Error(),
+		})
+		return
+	}
+	s.sendJSON(conn, result)
+}
+
+func (s *Server) handleAggregate(conn net.Conn, params map[string]string, broker *Broker) {
+	if params["topic"] == "" && params["prefix"] == "" && params["group_by"] == "" {
+		s.sendNotFound(conn)
+		return
+	}
+	timeoutMs, err := paramInt(params, "timeout_ms")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	result, err := broker.Aggregate(&Aggregation{
+		Pattern: params["topic"],
+		Prefix:  params["prefix"],
+		Field:   params["field"],
+		GroupBy: params["group_by"],
+		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	})
+	if err != nil {
+		s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+			"status": "invalid_aggregation",
+			"error":  err.Error(),
+		})
+		return
+	}
+	s.sendJSON(conn, result)
+}
+
+func (s *Server) handleSeries(conn net.Conn, params map[string]string, broker *Broker) {
+	topic := params["topic"]
+	if topic == "" {
+		s.sendNotFound(conn)
+		return
+	}
+	from, err := paramInt(params, "from")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+	to, err := paramInt(params, "to")
+	if err != nil {
+		s.sendBadRequest(conn)
+		return
+	}
+	limit, ok := pageLimit(params)
+	if !ok {
+		s.sendBadRequest(conn)
+		return
+	}
+	if to == 0 {
+		to = int(time.Now().Unix())
+	}
+	if params["from"] == "" {
+		from = to - defaultSeriesWindow
+	}
+	if limit == 0 {
+		limit = defaultSeriesLimit
+	}
+	resolution := params["resolution"]
+	if resolution == "" {
+		resolution = "raw"
+	}
+
+	// Ask for one more to tell whether the range holds more points
+	points, err := broker.GetSeries(topic, resolution, int64(from), int64(to), limit+1)
+	if err != nil {
+		s.sendSeriesError(conn, err)
+		return
+	}
+	more := len(points) > limit
+	if more {
+		points = points[:limit]
+	}
+
+	s.sendJSON(conn, map[string]interface{}{
+		"topic":      topic,
+		"resolution": resolution,
+		"from":       from,
+		"to":         to,
+		"points":     points,
+		"more":       more,
+	})
+}
+
+func (s *Server) handleSeriesPatterns(conn net.Conn, params map[string]string, broker *Broker) {
+	if pattern := params["add"]; pattern != "" {
+		if err := broker.MarkSeries(pattern, true); err != nil {
+			s.sendSeriesError(conn, err)
+			return
+		}
+	}
+	if pattern := params["remove"]; pattern != "" {
+		if err := broker.MarkSeries(pattern, false); err != nil {
+			s.sendSeriesError(conn, err)
+			return
+		}
+	}
+
+	patterns, err := broker.SeriesPatterns()
+	if err != nil {
+		s.sendSeriesError(conn, err)
+		return
+	}
+	s.sendJSON(conn, map[string]interface{}{"patterns": patterns})
+}
+
+// sendSeriesError reports a time series request the tenant's store or the
+// parameters don't allow as 400
+func (s *Server) sendSeriesError(conn net.Conn, err error) {
+	status := "invalid_series"
+	if errors.Is(err, errSeriesUnsupported) {
+		status = "unsupported"
+	}
+	s.sendJSONStatus(conn, "400 Bad Request", map[string]interface{}{
+		"status": status,
+		"error":  err.Error(),
+	})
 }
 
 func (s *Server) handleCrooks(conn net.Conn, params map[string]string, broker *Broker) {
@@ -899,6 +1935,25 @@ func (s *Server) handleAdminListUsers(conn net.Conn, params map[string]string) {
 		Messages int64  `json:"messages"`
 		Topics   int    `json:"topics"`
 		Clients  int    `json:"clients"`
+
+		LastCheckpoint       string  `json:"last_checkpoint,omitempty"`
+		CheckpointDurationMs float64 `json:"checkpoint_duration_ms"`
+		CheckpointError      string  `json:"checkpoint_error,omitempty"`
+
+		Quota Quota       `json:"quota"`
+		Usage *QuotaUsage `json:"usage,omitempty"` // only for running brokers
+	}
+
+	checkpointInfo := func(info *UserInfo, broker *Broker) {
+		if broker.db == nil {
+			return
+		}
+		at, duration, errMsg := broker.db.CheckpointStatus()
+		if !at.IsZero() {
+			info.LastCheckpoint = formatNiceDateTime(at.Unix())
+		}
+		info.CheckpointDurationMs = float64(duration) / float64(time.Millisecond)
+		info.CheckpointError = errMsg
 	}
 
 	users := []UserInfo{}
@@ -932,6 +1987,10 @@ func (s *Server) handleAdminListUsers(conn net.Conn, params map[string]string) {
 		}
 
 		broker.mu.RUnlock()
+		checkpointInfo(&publicInfo, broker)
+		publicInfo.Quota = broker.Quota()
+		usage := broker.QuotaUsage()
+		publicInfo.Usage = &usage
 		users = append(users, publicInfo)
 	}
 
@@ -949,6 +2008,7 @@ func (s *Server) handleAdminListUsers(conn net.Conn, params map[string]string) {
 
 		userInfo := UserInfo{
 			Username: username,
+			Quota:    s.brokerManager.quotas.Get(username),
 		}
 
 		if broker != nil {
@@ -969,6 +2029,9 @@ func (s *Server) handleAdminListUsers(conn net.Conn, params map[string]string) {
 			}
 
 			broker.mu.RUnlock()
+			checkpointInfo(&userInfo, broker)
+			usage := broker.QuotaUsage()
+			userInfo.Usage = &usage
 		}
 
 		users = append(users, userInfo)
@@ -993,6 +2056,100 @@ func (s *Server) handleAdminListUsers(conn net.Conn, params map[string]string) {
 	s.sendJSON(conn, response)
 }
 
+// handleAdminPeek lets the superadmin inspect a client queue in any tenant broker
+func (s *Server) handleAdminPeek(conn net.Conn, params map[string]string) {
+	tenant := params["username"]
+	if tenant == "" {
+		s.sendBadRequest(conn)
+		return
+	}
+
+	var broker *Broker
+	if tenant == "public" {
+		broker = s.brokerManager.GetDefaultBroker()
+	} else {
+		broker = s.brokerManager.GetBroker(tenant)
+	}
+	if broker == nil {
+		s.sendNotFound(conn)
+		return
+	}
+
+	s.handlePeek(conn, params, broker)
+}
+
+// handleAdminBackup backs up the tenant in username, or every tenant, and
+// lists the available backups with list=true
+func (s *Server) handleAdminBackup(conn net.Conn, params map[string]string) {
+	bm := s.brokerManager
+	if paramBool(params, "list") {
+		names, err := ListBackups(backupRoot(bm.dbConfig, bm.dataDir))
+		if err != nil {
+			s.sendError(conn, err)
+			return
+		}
+		s.sendJSON(conn, map[string]interface{}{"backups": names})
+		return
+	}
+
+	var tenants []string
+	if tenant := params["username"]; tenant != "" {
+		if tenant != "public" && !s.userAuth.HasUser(tenant) {
+			s.sendNotFound(conn)
+			return
+		}
+		tenants = []string{tenant}
+	}
+
+	result, err := bm.Backup(tenants)
+	if err != nil {
+		if result != nil {
+			s.sendJSONStatus(conn, "500 Internal Server Error", map[string]interface{}{
+				"status": "failed",
+				"error":  err.Error(),
+				"failed": result.Failed,
+			})
+			return
+		}
+		s.sendError(conn, err)
+		return
+	}
+	s.sendJSON(conn, result)
+}
+
+func (s *Server) handleAdminExport(conn net.Conn, params map[string]string) {
+	broker, err := s.adminTenantBroker(params["username"])
+	if err != nil {
+		s.sendNotFound(conn)
+		return
+	}
+	s.handleExport(conn, broker)
+}
+
+func (s *Server) handleAdminImport(conn net.Conn, params map[string]string) {
+	broker, err := s.adminTenantBroker(params["username"])
+	if err != nil {
+		s.sendNotFound(conn)
+		return
+	}
+	s.handleImport(conn, params, broker)
+}
+
+// adminTenantBroker returns the broker of a tenant for admin endpoints,
+// loading it if the user exists but hasn't connected yet
+func (s *Server) adminTenantBroker(tenant string) (*Broker, error) {
+	if tenant == "public" {
+		if broker := s.brokerManager.GetDefaultBroker(); broker != nil {
+			return broker, nil
+		}
+		return nil, fmt.Errorf("public access not configured")
+	}
+	if tenant == "" || !s.userAuth.HasUser(tenant) {
+		return nil, fmt.Errorf("unknown tenant: %s", tenant)
+	}
+	return s.brokerManager.GetOrCreateBroker(tenant)
+}
+
 func (s *Server) handleAdminAddUser(conn net.Conn, params map[string]string) {
 	username := params["username"]
 	password := params["password"]
@@ -1027,6 +2184,55 @@ func (s *Server) handleAdminAddUser(conn net.Conn, params map[string]string) {
 	})
 }
 
+// handleAdminSetQuota sets a tenant's quota. Limits that aren't given keep
+// their current value and 0 removes a limit.
+func (s *Server) handleAdminSetQuota(conn net.Conn, params map[string]string) {
+	tenant := params["username"]
+	if tenant != "public" && (tenant == "" || !s.userAuth.HasUser(tenant)) {
+		s.sendNotFound(conn)
+		return
+	}
+
+	quota := s.brokerManager.quotas.Get(tenant)
+	limits := map[string]*int{
+		QuotaKeys:              &quota.MaxKeys,
+		QuotaMessagesPerMinute: &quota.MaxMessagesPerMinute,
+		QuotaClients:           &quota.MaxClients,
+		QuotaSubscriptions:     &quota.MaxSubscriptions,
+	}
+	for name, limit := range limits {
+		if params[name] == "" {
+			continue
+		}
+		n, err := paramInt(params, name)
+		if err != nil {
+			s.sendBadRequest(conn)
+			return
+		}
+		*limit = n
+	}
+	if v := params[QuotaValueBytes]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			s.sendBadRequest(conn)
+			return
+		}
+		quota.MaxValueBytes = n
+	}
+
+	if err := s.brokerManager.SetQuota(tenant, quota); err != nil {
+		s.sendError(conn, err)
+		return
+	}
+	s.logger.Printf("Quota of %s set: %+v", tenant, quota)
+
+	s.sendJSON(conn, map[string]interface{}{
+		"status":   "success",
+		"username": tenant,
+		"quota":    quota,
+	})
+}
+
 func (s *Server) handleAdminDeleteUser(conn net.Conn, params map[string]string) {
 	username := params["username"]
 	if username == "" {
@@ -1043,6 +2249,9 @@ func (s *Server) handleAdminDeleteUser(conn net.Conn, params map[string]string)
 	if err := s.userAuth.Save(); err != nil {
 		s.logger.Printf("Failed to save users after deletion: %v", err)
 	}
+	if err := s.brokerManager.quotas.Delete(username); err != nil {
+		s.logger.Printf("Failed to remove quota of deleted user: %v", err)
+	}
 
 	s.sendJSON(conn, map[string]string{
 		"status":  "success",
@@ -1060,6 +2269,43 @@ func (s *Server) sendOK(conn net.Conn) {
 }
 
 func (s *Server) sendJSON(conn net.Conn, data interface{}) {
+	s.sendJSONStatus(conn, "200 OK", data)
+}
+
+// sendConflict reports a failed conditional write with 409 and the current version
+func (s *Server) sendConflict(conn net.Conn, conflict *VersionConflictError) {
+	s.sendJSONStatus(conn, "409 Conflict", map[string]interface{}{
+		"status":          "conflict",
+		"key":             conflict.Key,
+		"current_version": conflict.Current,
+	})
+}
+
+// sendQuotaExceeded reports a request over the tenant's quota, with 429 for
+// the message rate, which frees up by itself, and 403 for the other limits
+func (s *Server) sendQuotaExceeded(conn net.Conn, quota *QuotaExceededError) {
+	status := "403 Forbidden"
+	if quota.Limit == QuotaMessagesPerMinute {
+		status = "429 Too Many Requests"
+	}
+	s.sendJSONStatus(conn, status, map[string]interface{}{
+		"status":  "quota_exceeded",
+		"limit":   quota.Limit,
+		"max":     quota.Max,
+		"current": quota.Current,
+	})
+}
+
+// sendInvalidValue reports with 422 that an update doesn't fit the stored value
+func (s *Server) sendInvalidValue(conn net.Conn, invalid *InvalidValueError) {
+	s.sendJSONStatus(conn, "422 Unprocessable Entity", map[string]interface{}{
+		"status": "invalid_value",
+		"key":    invalid.Key,
+		"error":  invalid.Reason,
+	})
+}
+
+func (s *Server) sendJSONStatus(conn net.Conn, status string, data interface{}) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		s.sendError(conn, err)
@@ -1068,7 +2314,7 @@ func (s *Server) sendJSON(conn net.Conn, data interface{}) {
 
 	encoded := encodeROT13Base64(string(jsonData))
 
-	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n")
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\n", status)
 	fmt.Fprintf(conn, "Connection: close\r\n")
 	fmt.Fprintf(conn, "Keep-Alive: timeout=15, max=500\r\n")
 	fmt.Fprintf(conn, "Content-Type: text/plain; charset=utf-8\r\n")
@@ -1118,6 +2364,38 @@ func (s *Server) sendError(conn net.Conn, err error) {
 	fmt.Fprintf(conn, "Error: %v", err)
 }
 
+// paramBool reports whether a request parameter is set to a true value
+func paramBool(params map[string]string, name string) bool {
+	switch strings.ToLower(params[name]) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// paramInt parses an optional non-negative integer request parameter,
+// returning 0 when it is not set
+func paramInt(params map[string]string, name string) (int, error) {
+	value := params[name]
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return n, nil
+}
+
+// paramTTL parses the optional ttl parameter, given in seconds
+func paramTTL(params map[string]string) (time.Duration, error) {
+	secs, err := paramInt(params, "ttl")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
 func formatJSON(data interface{}) string {
 	jsonData, _ := json.MarshalIndent(data, "", "  ")
 	return string(jsonData)
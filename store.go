@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Storage backends a tenant database can be kept in
+const (
+	BackendSQLite = "sqlite" // SQLite file, needs cgo
+	BackendFile   = "file"   // append-only log file, pure Go
+	BackendMemory = "memory" // nothing persisted, for tests and ephemeral tenants
+)
+
+// StoredValue is a value, its version and expiry as kept by a Store
+type StoredValue struct {
+	Value     string
+	Version   int64
+	ExpiresAt int64 // unix time, 0 = never
+}
+
+// StoreBatch is a set of changes a Store applies atomically
+type StoreBatch struct {
+	Puts    map[string]StoredValue
+	Deletes map[string]bool
+	History []HistoryRecord // only written by stores that keep history
+	Series  []SeriesPoint   // only written by stores that keep time series
+}
+
+// Store is the persistent storage behind a Database. The Database keeps
+// every value in memory and writes changes through in batches.
+type Store interface {
+	// Get returns a single key
+	Get(key string) (StoredValue, bool, error)
+	// Put stores a single key
+	Put(key string, value StoredValue) error
+	// Delete removes a single key
+	Delete(key string) error
+	// Scan calls fn for each key starting with prefix, in key order
+	Scan(prefix string, fn func(key string, value StoredValue) error) error
+	// Iterate calls fn for every key, in no particular order
+	Iterate(fn func(key string, value StoredValue) error) error
+	// Write applies a batch of puts and deletes atomically
+	Write(batch *StoreBatch) error
+	// Close releases the store
+	Close() error
+}
+
+// OpenStore opens the store for a tenant data directory. syncMode is the
+// database sync setting, see DatabaseConfig.
+func OpenStore(backend, dataDir, syncMode string) (Store, error) {
+	if backend != BackendMemory {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %w", err)
+		}
+	}
+
+	switch backend {
+	case "", BackendSQLite:
+		return newSQLiteStore(filepath.Join(dataDir, storeFileName(backend)), syncMode)
+	case BackendFile:
+		return newFileStore(filepath.Join(dataDir, storeFileName(backend)), syncMode)
+	case BackendMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+// storeFileName returns the name of the file a backend keeps its data in,
+// empty for the memory backend
+func storeFileName(backend string) string {
+	switch backend {
+	case "", BackendSQLite:
+		return "moustique.db"
+	case BackendFile:
+		return "moustique.kv"
+	default:
+		return ""
+	}
+}
+
+// memoryStore keeps values in a map. The file store builds on it.
+type memoryStore struct {
+	mu     sync.RWMutex
+	values map[string]StoredValue
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[string]StoredValue)}
+}
+
+func (m *memoryStore) Get(key string) (StoredValue, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, exists := m.values[key]
+	return value, exists, nil
+}
+
+func (m *memoryStore) Put(key string, value StoredValue) error {
+	return m.Write(&StoreBatch{Puts: map[string]StoredValue{key: value}})
+}
+
+func (m *memoryStore) Delete(key string) error {
+	return m.Write(&StoreBatch{Deletes: map[string]bool{key: true}})
+}
+
+func (m *memoryStore) Scan(prefix string, fn func(key string, value StoredValue) error) error {
+	m.mu.RLock()
+	keys := make([]string, 0)
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([]StoredValue, len(keys))
+	for i, key := range keys {
+		values[i] = m.values[key]
+	}
+	m.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Iterate(fn func(key string, value StoredValue) error) error {
+	m.mu.RLock()
+	snapshot := make(map[string]StoredValue, len(m.values))
+	for key, value := range m.values {
+		snapshot[key] = value
+	}
+	m.mu.RUnlock()
+
+	for key, value := range snapshot {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Write(batch *StoreBatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.apply(batch)
+	return nil
+}
+
+// apply applies a batch to the map. Caller holds m.mu.
+func (m *memoryStore) apply(batch *StoreBatch) {
+	for key, value := range batch.Puts {
+		m.values[key] = value
+	}
+	for key := range batch.Deletes {
+		delete(m.values, key)
+	}
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Compaction of the file store log
+const (
+	fileStoreCompactMinEntries = 10000 // never compact logs shorter than this
+	fileStoreCompactBatchSize  = 1000  // keys per line in a compacted log
+)
+
+// fileStore is a pure Go store that keeps values in memory and appends
+// every batch as one JSON line to a log file. The log is replayed on open
+// and rewritten once it holds more than twice as many entries as live keys.
+// A torn last line from a crash is dropped, so batches stay atomic.
+type fileStore struct {
+	*memoryStore
+	path    string
+	file    *os.File
+	size    int64 // bytes of complete batches in the log
+	sync    bool  // fsync after every batch
+	entries int   // puts and deletes in the log since the last compaction
+}
+
+// fileStoreBatch is one line of the log
+type fileStoreBatch struct {
+	Puts    map[string]fileStoreValue `json:"puts,omitempty"`
+	Deletes []string                  `json:"deletes,omitempty"`
+}
+
+type fileStoreValue struct {
+	Value     string `json:"value"`
+	Version   int64  `json:"version"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// newFileStore opens or creates a file store. Batches are synced to disk
+// unless syncMode is "off".
+func newFileStore(path, syncMode string) (*fileStore, error) {
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+		sync:        !strings.EqualFold(syncMode, "off"),
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store file: %w", err)
+	}
+	s.file = file
+	return s, nil
+}
+
+// replay loads the log into memory and cuts off a torn last line
+func (s *fileStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open store file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var good int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read store file: %w", err)
+		}
+
+		var batch fileStoreBatch
+		if err := json.Unmarshal(line, &batch); err != nil {
+			break
+		}
+		s.apply(batch.storeBatch())
+		s.entries += len(batch.Puts) + len(batch.Deletes)
+		good += int64(len(line))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat store file: %w", err)
+	}
+	s.size = good
+	if info.Size() > good {
+		fmt.Printf("Dropping %d bytes of incomplete writes from %s\n", info.Size()-good, s.path)
+		if err := os.Truncate(s.path, good); err != nil {
+			return fmt.Errorf("failed to truncate store file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *fileStoreBatch) storeBatch() *StoreBatch {
+	batch := &StoreBatch{
+		Puts:    make(map[string]StoredValue, len(b.Puts)),
+		Deletes: make(map[string]bool, len(b.Deletes)),
+	}
+	for key, value := range b.Puts {
+		batch.Puts[key] = StoredValue{Value: value.Value, Version: value.Version, ExpiresAt: value.ExpiresAt}
+	}
+	for _, key := range b.Deletes {
+		batch.Deletes[key] = true
+	}
+	return batch
+}
+
+func newFileStoreBatch(batch *StoreBatch) *fileStoreBatch {
+	line := &fileStoreBatch{Puts: make(map[string]fileStoreValue, len(batch.Puts))}
+	for key, value := range batch.Puts {
+		line.Puts[key] = fileStoreValue{Value: value.Value, Version: value.Version, ExpiresAt: value.ExpiresAt}
+	}
+	for key := range batch.Deletes {
+		line.Deletes = append(line.Deletes, key)
+	}
+	return line
+}
+
+func (s *fileStore) Put(key string, value StoredValue) error {
+	return s.Write(&StoreBatch{Puts: map[string]StoredValue{key: value}})
+}
+
+func (s *fileStore) Delete(key string) error {
+	return s.Write(&StoreBatch{Deletes: map[string]bool{key: true}})
+}
+
+// Write appends the batch to the log and then applies it in memory
+func (s *fileStore) Write(batch *StoreBatch) error {
+	if len(batch.Puts) == 0 && len(batch.Deletes) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.appendLine(s.file, newFileStoreBatch(batch))
+	if err != nil {
+		// Don't leave half a line for later batches to follow
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += n
+	if s.sync {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync store file: %w", err)
+		}
+	}
+
+	s.apply(batch)
+	s.entries += len(batch.Puts) + len(batch.Deletes)
+
+	if s.entries > fileStoreCompactMinEntries && s.entries > 2*len(s.values) {
+		if err := s.compact(); err != nil {
+			fmt.Printf("Compaction of %s failed: %v\n", s.path, err)
+		}
+	}
+	return nil
+}
+
+// appendLine writes one batch line and returns its length in bytes
+func (s *fileStore) appendLine(file *os.File, line *fileStoreBatch) (int64, error) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	n, err := file.Write(append(data, '\n'))
+	if err != nil {
+		return 0, fmt.Errorf("failed to write store file: %w", err)
+	}
+	return int64(n), nil
+}
+
+// Compact rewrites the log with only the live keys, dropping old entries
+func (s *fileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compact()
+}
+
+// compact rewrites the log with only the live keys. Caller holds s.mu.
+func (s *fileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var size int64
+	for start := 0; start < len(keys); start += fileStoreCompactBatchSize {
+		end := start + fileStoreCompactBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		line := &fileStoreBatch{Puts: make(map[string]fileStoreValue, end-start)}
+		for _, key := range keys[start:end] {
+			value := s.values[key]
+			line.Puts[key] = fileStoreValue{Value: value.Value, Version: value.Version, ExpiresAt: value.ExpiresAt}
+		}
+		n, err := s.appendLine(tmp, line)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		size += n
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync compacted file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close compacted file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace store file: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen store file: %w", err)
+	}
+	s.file.Close()
+	s.file = file
+	s.size = size
+	s.entries = len(keys)
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
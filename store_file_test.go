@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moustique.kv")
+	store, err := newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("a", StoredValue{Value: "1", Version: 1})
+	store.Put("a", StoredValue{Value: "2", Version: 2})
+	store.Put("b", StoredValue{Value: "3", Version: 1})
+	store.Delete("b")
+	store.Close()
+
+	store, err = newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if value, found, _ := store.Get("a"); !found || value.Value != "2" || value.Version != 2 {
+		t.Errorf("replayed a as %+v, %v, want the latest write", value, found)
+	}
+	if _, found, _ := store.Get("b"); found {
+		t.Error("replayed a deleted key")
+	}
+}
+
+func TestFileStoreTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moustique.kv")
+	store, err := newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("a", StoredValue{Value: "1", Version: 1})
+	store.Close()
+
+	info, _ := os.Stat(path)
+	complete := info.Size()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"puts":{"b":{"value":"2","vers`)
+	file.Close()
+
+	store, err = newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Get("b"); found {
+		t.Error("torn batch applied")
+	}
+	if info, _ := os.Stat(path); info.Size() != complete {
+		t.Errorf("store file is %d bytes after replay, want the torn line cut to %d", info.Size(), complete)
+	}
+
+	// Later batches follow the last complete line
+	store.Put("c", StoredValue{Value: "3", Version: 1})
+	store.Close()
+	store, err = newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, key := range []string{"a", "c"} {
+		if _, found, _ := store.Get(key); !found {
+			t.Errorf("%s missing after reopening", key)
+		}
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moustique.kv")
+	store, err := newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 100; i++ {
+		store.Put("a", StoredValue{Value: "x", Version: i})
+	}
+	store.Put("b", StoredValue{Value: "y", Version: 1})
+	before, _ := os.Stat(path)
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("compaction left %d bytes of %d", after.Size(), before.Size())
+	}
+	store.Close()
+
+	store, err = newFileStore(path, "off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if value, found, _ := store.Get("a"); !found || value.Version != 100 {
+		t.Errorf("got %+v, %v after compaction, want version 100", value, found)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps values in the kv table of a SQLite database
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+
+	// Value history, see history.go
+	mu                 sync.RWMutex
+	historyMaxVersions int
+	historyMaxAge      time.Duration
+
+	// Time series, see series.go
+	seriesRetention SeriesRetention
+}
+
+// newSQLiteStore opens a SQLite store. syncMode sets SQLite's synchronous
+// pragma (off, normal, full or extra), empty keeps the default.
+func newSQLiteStore(path, syncMode string) (*sqliteStore, error) {
+	dsn := path
+	if syncMode != "" {
+		dsn += "?_sync=" + strings.ToUpper(syncMode)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Create table if not exists
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	if err := migrateKVColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+// migrateKVColumns adds the version and expires_at columns to kv tables
+// created before values were versioned or could expire
+func migrateKVColumns(db *sql.DB) error {
+	columns := []struct {
+		name string
+		ddl  string
+	}{
+		{"version", "ALTER TABLE kv ADD COLUMN version INTEGER NOT NULL DEFAULT 1"},
+		{"expires_at", "ALTER TABLE kv ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	existing, err := kvColumns(db)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if existing[column.name] {
+			continue
+		}
+		if _, err := db.Exec(column.ddl); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", column.name, err)
+		}
+	}
+	return nil
+}
+
+// kvColumns returns the names of the kv table's columns
+func kvColumns(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(kv)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect kv table: %w", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, fmt.Errorf("failed to inspect kv table: %w", err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to inspect kv table: %w", err)
+	}
+	return columns, nil
+}
+
+func (s *sqliteStore) Get(key string) (StoredValue, bool, error) {
+	var value StoredValue
+	err := s.db.QueryRow("SELECT value, version, expires_at FROM kv WHERE key = ?", key).
+		Scan(&value.Value, &value.Version, &value.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, fmt.Errorf("failed to query key %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (s *sqliteStore) Put(key string, value StoredValue) error {
+	return s.Write(&StoreBatch{Puts: map[string]StoredValue{key: value}})
+}
+
+func (s *sqliteStore) Delete(key string) error {
+	return s.Write(&StoreBatch{Deletes: map[string]bool{key: true}})
+}
+
+func (s *sqliteStore) Scan(prefix string, fn func(key string, value StoredValue) error) error {
+	return s.query(fn, `SELECT key, value, version, expires_at FROM kv
+		WHERE substr(key, 1, length(?)) = ? ORDER BY key`, prefix, prefix)
+}
+
+func (s *sqliteStore) Iterate(fn func(key string, value StoredValue) error) error {
+	return s.query(fn, "SELECT key, value, version, expires_at FROM kv")
+}
+
+// query calls fn for every row of a kv query
+func (s *sqliteStore) query(fn func(key string, value StoredValue) error, query string, args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value StoredValue
+		if err := rows.Scan(&key, &value.Value, &value.Version, &value.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Write writes puts, deletes, history records and series points in one transaction
+func (s *sqliteStore) Write(batch *StoreBatch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO kv (key, value, version, expires_at) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, value := range batch.Puts {
+		if _, err := stmt.Exec(key, value.Value, value.Version, value.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to insert key %s: %w", key, err)
+		}
+	}
+
+	if len(batch.Deletes) > 0 {
+		delStmt, err := tx.Prepare("DELETE FROM kv WHERE key = ?")
+		if err != nil {
+			return fmt.Errorf("failed to prepare delete statement: %w", err)
+		}
+		defer delStmt.Close()
+
+		for key := range batch.Deletes {
+			if _, err := delStmt.Exec(key); err != nil {
+				return fmt.Errorf("failed to delete key %s: %w", key, err)
+			}
+		}
+	}
+
+	if len(batch.History) > 0 {
+		if err := s.writeHistory(tx, batch.History); err != nil {
+			return err
+		}
+	}
+
+	if len(batch.Series) > 0 {
+		if err := s.writeSeries(tx, batch.Series); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Compact rebuilds the database file so no freed page keeps old data
+func (s *sqliteStore) Compact() error {
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testBackends are the backends every Store must behave the same in
+var testBackends = []string{BackendMemory, BackendFile, BackendSQLite}
+
+func TestStoreBackends(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			store, err := OpenStore(backend, t.TempDir(), "off")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			if err := store.Put("/b", StoredValue{Value: `"b"`, Version: 1}); err != nil {
+				t.Fatal(err)
+			}
+			err = store.Write(&StoreBatch{
+				Puts: map[string]StoredValue{
+					"/a/2":  {Value: `"2"`, Version: 3, ExpiresAt: 1700000000},
+					"/a/1":  {Value: `"1"`, Version: 2},
+					"/gone": {Value: `"x"`, Version: 1},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Write(&StoreBatch{Deletes: map[string]bool{"/gone": true, "/b": true}}); err != nil {
+				t.Fatal(err)
+			}
+
+			value, found, err := store.Get("/a/2")
+			if err != nil || !found || value != (StoredValue{Value: `"2"`, Version: 3, ExpiresAt: 1700000000}) {
+				t.Errorf("Get returned %+v, %v, %v", value, found, err)
+			}
+			if _, found, _ := store.Get("/gone"); found {
+				t.Error("deleted key still found")
+			}
+
+			var keys []string
+			store.Scan("/a/", func(key string, value StoredValue) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if strings.Join(keys, ",") != "/a/1,/a/2" {
+				t.Errorf("Scan returned %v, want /a/1,/a/2", keys)
+			}
+
+			count := 0
+			store.Iterate(func(key string, value StoredValue) error {
+				count++
+				return nil
+			})
+			if count != 2 {
+				t.Errorf("Iterate visited %d keys, want 2", count)
+			}
+		})
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenStore(backend, dir, "normal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := NewDatabase(store, dir)
+			d.SaveValue("/kept", "value")
+			d.SaveValue("/removed", "value")
+			d.DeleteValues([]string{"/removed"})
+			if err := d.SaveAll(); err != nil {
+				t.Fatal(err)
+			}
+			d.Close()
+
+			store, err = OpenStore(backend, dir, "normal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d = NewDatabase(store, dir)
+			defer d.Close()
+			if err := d.LoadAll(); err != nil {
+				t.Fatal(err)
+			}
+			if value, version, err := d.GetValueWithVersion("/kept"); err != nil || value != `"value"` || version != 1 {
+				t.Errorf("got %s at version %d, %v after reopening", value, version, err)
+			}
+			if d.HasValue("/removed") {
+				t.Error("deleted key back after reopening")
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TreeNode is a node of the topic tree. Topics are split at slashes; a node
+// has a value if its path is a stored key.
+type TreeNode struct {
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	ChildCount  int         `json:"child_count"`
+	Value       *Message    `json:"value,omitempty"`
+	UpdatedTime int64       `json:"updated_time,omitempty"` // of the node's own value
+	Subscribers int         `json:"subscribers"`            // clients a message to the path would reach
+	Children    []*TreeNode `json:"children,omitempty"`
+}
+
+// treeChild returns the path and name of the child of parent that key lies
+// under. The root has the path "" and its children are the first segments
+// of keys, "/house" for "/house/kitchen".
+func treeChild(parent, key string) (string, string) {
+	rest := strings.TrimPrefix(key[len(parent):], "/")
+	name := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name = rest[:i]
+	}
+	return key[:len(key)-len(rest)+len(name)], name
+}
+
+// GetTree returns the topic tree below start, "" for the whole key space.
+// With depth > 0 only that many levels are returned, the last level still
+// reporting its child count so clients can expand it later.
+func (b *Broker) GetTree(start string, depth int) (*TreeNode, error) {
+	start = strings.TrimSuffix(start, "/")
+	prefix := ""
+	if start != "" {
+		prefix = start + "/"
+	}
+	var keys []string
+	if depth > 0 {
+		keys = b.db.scanTreeKeys(prefix, depth+1)
+	} else {
+		keys, _ = b.db.ScanKeys(prefix, "", nil, 0)
+	}
+
+	root := &TreeNode{Name: start[strings.LastIndex(start, "/")+1:], Path: start}
+	hasValue := start != "" && b.db.HasValue(start)
+	if start != "" && !hasValue && len(keys) == 0 {
+		return nil, fmt.Errorf("no topics under %s", start)
+	}
+
+	// Build the levels to return plus one more, which is only counted
+	nodes := map[string]*TreeNode{start: root}
+	withValue := []*TreeNode{}
+	if hasValue {
+		withValue = append(withValue, root)
+	}
+	for _, key := range keys {
+		parent := root
+		for level := 1; depth <= 0 || level <= depth+1; level++ {
+			path, name := treeChild(parent.Path, key)
+			node, exists := nodes[path]
+			if !exists {
+				node = &TreeNode{Name: name, Path: path}
+				nodes[path] = node
+				parent.ChildCount++
+				if depth <= 0 || level <= depth {
+					parent.Children = append(parent.Children, node)
+				}
+			}
+			if path == key {
+				if depth <= 0 || level <= depth {
+					withValue = append(withValue, node)
+				}
+				break
+			}
+			parent = node
+		}
+	}
+
+	for _, node := range withValue {
+		value, version, err := b.db.GetValueWithVersion(node.Path)
+		if err != nil {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(value), &msg); err != nil {
+			continue
+		}
+		msg.Version = version
+		node.Value = &msg
+		node.UpdatedTime = msg.UpdatedTime
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var visit func(node *TreeNode)
+	visit = func(node *TreeNode) {
+		node.Subscribers = b.countSubscribers(node.Path)
+		sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Name < node.Children[j].Name })
+		for _, child := range node.Children {
+			visit(child)
+		}
+	}
+	visit(root)
+	return root, nil
+}
+
+// scanTreeKeys returns the keys under prefix at most levels segments below
+// it in order. A deeper subtree is returned as the path of its node at that
+// level only, the rest of it being skipped in the index.
+func (d *Database) scanTreeKeys(prefix string, levels int) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now().Unix()
+	keys := []string{}
+	for from := prefix; ; {
+		skipTo := ""
+		d.index.Ascend(from, func(key string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			rest := strings.TrimPrefix(key[len(prefix):], "/")
+			segments := strings.SplitN(rest, "/", levels+1)
+			if len(segments) <= levels {
+				if !d.isExpired(key, now) {
+					keys = append(keys, key)
+				}
+				return true
+			}
+			// Every key under node sorts before node+"0", '0' following '/'
+			node := key[:len(key)-len(rest)] + strings.Join(segments[:levels], "/")
+			keys = append(keys, node)
+			skipTo = node + "0"
+			return false
+		})
+		if skipTo == "" {
+			return keys
+		}
+		from = skipTo
+	}
+}
+
+// countSubscribers returns the number of clients a message published to
+// topic would be delivered to. Caller holds b.mu.
+func (b *Broker) countSubscribers(topic string) int {
+	if topic == "" {
+		return 0
+	}
+
+	clients := make(map[string]bool)
+	for _, clientName := range b.subscriptions["#"] {
+		clients[clientName] = true
+	}
+	// Not through explodeTopic, whose cache would keep every tree path
+	for _, subscription := range explodeTopicPatterns(topic) {
+		for _, clientName := range b.subscriptions[subscription] {
+			clients[clientName] = true
+		}
+	}
+	for _, pattern := range b.matchRegexSubscriptions(topic) {
+		for _, clientName := range b.regexSubscriptions[pattern].clients {
+			clients[clientName] = true
+		}
+	}
+	return len(clients)
+}
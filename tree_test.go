@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGetTree(t *testing.T) {
+	b := newTestBroker(t)
+	for _, key := range []string{"/house", "/house/kitchen/temp", "/house/kitchen/light", "/house/garage/door", "/garden/rain"} {
+		b.PutValue(key, "1", "", "test", 1)
+	}
+	b.Subscribe("/house/kitchen/+", "c1", "127.0.0.1")
+	b.SubscribeTopics([]string{"^/house/kitchen/t"}, true, "c2", "127.0.0.1")
+
+	root, err := b.GetTree("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ChildCount != 2 || root.Children[0].Name != "garden" || root.Children[1].Path != "/house" {
+		t.Fatalf("root has children %+v", root.Children)
+	}
+	house := root.Children[1]
+	if house.Value == nil || house.ChildCount != 2 {
+		t.Errorf("/house has value %v and %d children", house.Value, house.ChildCount)
+	}
+	kitchen := house.Children[1]
+	if kitchen.Path != "/house/kitchen" || kitchen.Value != nil || len(kitchen.Children) != 2 {
+		t.Fatalf("kitchen node is %+v", kitchen)
+	}
+	if light, temp := kitchen.Children[0], kitchen.Children[1]; light.Subscribers != 1 || temp.Subscribers != 2 || temp.Value.Version != 1 {
+		t.Errorf("light has %d subscribers, temp %d at version %d", light.Subscribers, temp.Subscribers, temp.Value.Version)
+	}
+}
+
+func TestGetTreeDepth(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/a/b/c", "1", "", "test", 1)
+	b.PutValue("/a/d", "1", "", "test", 1)
+
+	node, err := b.GetTree("/a/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Path != "/a" || len(node.Children) != 2 {
+		t.Fatalf("got %+v", node)
+	}
+	child := node.Children[0]
+	if child.Name != "b" || child.ChildCount != 1 || len(child.Children) != 0 {
+		t.Errorf("node below the depth is %+v, want its child counted only", child)
+	}
+
+	if _, err := b.GetTree("/missing", 0); err == nil {
+		t.Error("tree of a missing topic returned")
+	}
+}
+
+func TestGetTreeDepthSkipsSubtrees(t *testing.T) {
+	b := newTestBroker(t)
+	for i := 0; i < 50; i++ {
+		b.PutValue(fmt.Sprintf("/a/b/c/%02d", i), "1", "", "test", 1)
+	}
+	b.PutValue("/a/b0", "1", "", "test", 1)
+	b.PutValue("/a/d", "1", "", "test", 1)
+
+	keys := b.db.scanTreeKeys("/a/", 2)
+	if want := []string{"/a/b/c", "/a/b0", "/a/d"}; strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("scanned %v, want %v", keys, want)
+	}
+
+	node, err := b.GetTree("/a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.ChildCount != 3 || node.Children[0].ChildCount != 1 {
+		t.Errorf("got %+v", node)
+	}
+	b.mu.RLock()
+	cached := len(b.topicExplosionCache)
+	b.mu.RUnlock()
+	if cached != 0 {
+		t.Errorf("tree left %d topics in the explosion cache", cached)
+	}
+}
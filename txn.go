@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxTxnOps bounds the checks plus operations of a transaction, which
+// holds the database lock while it is written
+const maxTxnOps = 1000
+
+// TxnCheck is a precondition of a transaction. Version requires the key to
+// be at that version, 0 meaning absent; Exists requires it to exist or not.
+type TxnCheck struct {
+	Key     string `json:"key"`
+	Version *int64 `json:"version,omitempty"`
+	Exists  *bool  `json:"exists,omitempty"`
+}
+
+// holds reports whether the check passes for a key's current state
+func (c TxnCheck) holds(exists bool, version int64) bool {
+	if c.Version != nil && *c.Version != version {
+		return false
+	}
+	if c.Exists != nil && *c.Exists != exists {
+		return false
+	}
+	return true
+}
+
+// TxnOp is a write of a transaction: put stores Value, delete removes the key
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"` // seconds, 0 keeps the value forever
+}
+
+// Transaction operations
+const (
+	TxnPut    = "put"
+	TxnDelete = "delete"
+)
+
+// TxnWrite is a transaction write as the Database applies it, a nil Value
+// deleting the key
+type TxnWrite struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// TxnCheckError is returned when a check of a transaction fails, nothing
+// having been written
+type TxnCheckError struct {
+	Index   int // position of the check in the transaction
+	Check   TxnCheck
+	Exists  bool
+	Current int64 // 0 when the key doesn't exist
+}
+
+func (e *TxnCheckError) Error() string {
+	return fmt.Sprintf("check %d failed for key %s: current version is %d", e.Index, e.Check.Key, e.Current)
+}
+
+// validateTxn checks the shape of a transaction before it takes any lock
+func validateTxn(checks []TxnCheck, ops []TxnOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("no operations")
+	}
+	if len(checks)+len(ops) > maxTxnOps {
+		return fmt.Errorf("too many checks and operations, at most %d", maxTxnOps)
+	}
+	for i, check := range checks {
+		if check.Key == "" {
+			return fmt.Errorf("check %d: missing key", i)
+		}
+		if check.Version == nil && check.Exists == nil {
+			return fmt.Errorf("check %d: needs version or exists", i)
+		}
+		if check.Version != nil && *check.Version < 0 {
+			return fmt.Errorf("check %d: invalid version %d", i, *check.Version)
+		}
+	}
+	written := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("operation %d: missing key", i)
+		}
+		if written[op.Key] {
+			return fmt.Errorf("operation %d: key %s is written twice", i, op.Key)
+		}
+		written[op.Key] = true
+		switch op.Op {
+		case TxnPut:
+			if op.TTL < 0 {
+				return fmt.Errorf("operation %d: invalid ttl %d", i, op.TTL)
+			}
+		case TxnDelete:
+		default:
+			return fmt.Errorf("operation %d: unknown op %q, use put or delete", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// Transact applies writes if every check holds, all or nothing. The writes
+// go to the store in one batch while the lock is held, so they are on disk
+// together before anyone can read them. It returns the new version of each
+// write, 0 for deletes, and the keys deleted. A *TxnCheckError is returned
+// when a check fails.
+func (d *Database) Transact(checks []TxnCheck, writes []TxnWrite) ([]int64, []string, error) {
+	// Keep the background writer from storing older state of these keys
+	// after the transaction
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for _, check := range checks {
+		if d.isExpired(check.Key, now.Unix()) {
+			d.expireKey(check.Key)
+		}
+	}
+	for _, write := range writes {
+		if d.isExpired(write.Key, now.Unix()) {
+			d.expireKey(write.Key)
+		}
+	}
+
+	for i, check := range checks {
+		_, exists := d.values[check.Key]
+		var current int64
+		if exists {
+			current = d.versions[check.Key]
+		}
+		if !check.holds(exists, current) {
+			return nil, nil, &TxnCheckError{Index: i, Check: check, Exists: exists, Current: current}
+		}
+	}
+
+	batch := &StoreBatch{Puts: make(map[string]StoredValue), Deletes: make(map[string]bool)}
+	versions := make([]int64, len(writes))
+	for i, write := range writes {
+		if write.Value == nil {
+			if _, exists := d.values[write.Key]; exists {
+				batch.Deletes[write.Key] = true
+			}
+			continue
+		}
+
+		var expiresAt int64
+		if write.TTL > 0 {
+			expiresAt = now.Add(write.TTL).Unix()
+		}
+		version := d.versions[write.Key] + 1
+		jsonData, err := marshalValue(write.Value, version, expiresAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		batch.Puts[write.Key] = StoredValue{Value: string(jsonData), Version: version, ExpiresAt: expiresAt}
+		versions[i] = version
+
+		if msg, isMessage := write.Value.(*Message); isMessage && d.historyEnabled {
+			batch.History = append(batch.History, HistoryRecord{
+				Key:         write.Key,
+				Version:     version,
+				Value:       string(jsonData),
+				From:        msg.From,
+				UpdatedTime: msg.UpdatedTime,
+			})
+		}
+	}
+
+	if err := d.checkBatchStorage(batch); err != nil {
+		return nil, nil, err
+	}
+
+	if err := d.store.Write(batch); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Committed, now apply it in memory. Nothing is left for the writer.
+	deleted := make([]string, 0, len(batch.Deletes))
+	for key := range batch.Deletes {
+		d.removeKey(key)
+		delete(d.deleted, key)
+		deleted = append(deleted, key)
+	}
+	sort.Strings(deleted)
+	for key, value := range batch.Puts {
+		d.setValue(key, value.Value)
+		d.versions[key] = value.Version
+		delete(d.dirty, key)
+		delete(d.deleted, key)
+		if value.ExpiresAt > 0 {
+			d.expires[key] = value.ExpiresAt
+		} else {
+			delete(d.expires, key)
+		}
+		d.writeSeq++
+		d.writeSeqs[key] = d.writeSeq
+	}
+	d.notifyChange()
+
+	return versions, deleted, nil
+}
+
+// TxnResult reports a committed transaction: the new version of each put
+// and the keys deleted
+type TxnResult struct {
+	Versions map[string]int64 `json:"versions"`
+	Deleted  []string         `json:"deleted"`
+}
+
+// Transact applies ops atomically if every check holds. Puts count against
+// the message quota like publishes, and are delivered to subscribers and
+// deletes announced on deletedValueTopic only once the transaction is
+// committed.
+func (b *Broker) Transact(checks []TxnCheck, ops []TxnOp, from, ip string, updatedTime int64) (*TxnResult, error) {
+	if err := validateTxn(checks, ops); err != nil {
+		return nil, err
+	}
+	if from == "" {
+		from = "UNKNOWN"
+	}
+
+	puts := 0
+	for _, op := range ops {
+		if op.Op == TxnPut {
+			puts++
+		}
+	}
+
+	b.mu.Lock()
+	if err := b.checkMessageQuota(time.Now(), puts); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	writes := make([]TxnWrite, len(ops))
+	messages := make(map[string]*Message)
+	recipients := make(map[string][]recipient)
+	for i, op := range ops {
+		writes[i] = TxnWrite{Key: op.Key, TTL: time.Duration(op.TTL) * time.Second}
+		if op.Op == TxnPut {
+			msg := &Message{
+				From:                from,
+				Topic:               op.Key,
+				Message:             op.Value,
+				UpdatedTime:         updatedTime,
+				UpdatedNiceDatetime: formatNiceDateTime(updatedTime),
+				Subscribers:         make(map[string]bool),
+				IP:                  ip,
+			}
+			writes[i].Value = msg
+			messages[op.Key] = msg
+			recipients[op.Key] = b.address(op.Key, msg)
+		}
+	}
+
+	versions, deleted, err := b.db.Transact(checks, writes)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+
+	b.quotaWindowMessages += puts
+
+	result := &TxnResult{Versions: make(map[string]int64), Deleted: deleted}
+	for i, op := range ops {
+		if op.Op == TxnPut {
+			result.Versions[op.Key] = versions[i]
+			b.deliver(messages[op.Key], recipients[op.Key])
+			b.recordSeries(op.Key, op.Value, updatedTime)
+		}
+	}
+	b.LogUser("Committed transaction of %d operations from %s (IP: %s)", len(ops), from, ip)
+	b.mu.Unlock()
+
+	if len(result.Deleted) > 0 {
+		event, _ := json.Marshal(result.Deleted)
+		b.PublishSystemMessage(deletedValueTopic, string(event))
+	}
+	return result, nil
+}
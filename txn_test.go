@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// failingStore is a memory store whose batch writes fail
+type failingStore struct {
+	*memoryStore
+}
+
+func (s failingStore) Write(batch *StoreBatch) error {
+	return fmt.Errorf("disk full")
+}
+
+func int64Ptr(n int64) *int64 { return &n }
+func boolPtr(b bool) *bool    { return &b }
+
+func TestTransactCommits(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/acct/+", "auditor", "127.0.0.1")
+	b.PutValue("/acct/a", "100", "", "test", 1)
+	b.PutValue("/acct/old", "0", "", "test", 1)
+
+	result, err := b.Transact(
+		[]TxnCheck{{Key: "/acct/a", Version: int64Ptr(1)}, {Key: "/acct/b", Exists: boolPtr(false)}},
+		[]TxnOp{
+			{Op: TxnPut, Key: "/acct/a", Value: "50"},
+			{Op: TxnPut, Key: "/acct/b", Value: "50"},
+			{Op: TxnDelete, Key: "/acct/old"},
+			{Op: TxnDelete, Key: "/acct/never"},
+		},
+		"test", "127.0.0.1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Versions["/acct/a"] != 2 || result.Versions["/acct/b"] != 1 || len(result.Deleted) != 1 || result.Deleted[0] != "/acct/old" {
+		t.Errorf("got %+v", result)
+	}
+
+	messages, _ := b.Pickup("auditor", "127.0.0.1")
+	if n := len(messages["/acct/+"]); n != 2 {
+		t.Errorf("subscriber got %d messages, want the 2 puts", n)
+	}
+	if msgs := messages[deletedValueTopic]; len(msgs) != 1 || msgs[0].Message != `["/acct/old"]` {
+		t.Errorf("got delete announcements %v", msgs)
+	}
+}
+
+func TestTransactFailedCheckWritesNothing(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/acct/+", "auditor", "127.0.0.1")
+	b.PutValue("/acct/a", "100", "", "test", 1)
+	b.Pickup("auditor", "127.0.0.1")
+
+	_, err := b.Transact(
+		[]TxnCheck{{Key: "/acct/a", Version: int64Ptr(1)}, {Key: "/acct/a", Exists: boolPtr(false)}},
+		[]TxnOp{{Op: TxnPut, Key: "/acct/a", Value: "0"}, {Op: TxnPut, Key: "/acct/b", Value: "100"}},
+		"test", "127.0.0.1", 2)
+	var checkErr *TxnCheckError
+	if !errors.As(err, &checkErr) || checkErr.Index != 1 || checkErr.Current != 1 {
+		t.Fatalf("got %v, want check 1 to fail at version 1", err)
+	}
+
+	if value, _ := b.GetValue("/acct/a"); value.Message != "100" || value.Version != 1 {
+		t.Errorf("/acct/a changed to %s at version %d", value.Message, value.Version)
+	}
+	if b.db.HasValue("/acct/b") {
+		t.Error("/acct/b written by a failed transaction")
+	}
+	if messages, _ := b.Pickup("auditor", "127.0.0.1"); countMessages(messages) != 0 {
+		t.Errorf("failed transaction delivered %v", messages)
+	}
+}
+
+func TestTransactStoreFailureWritesNothing(t *testing.T) {
+	d := NewDatabase(failingStore{newMemoryStore()}, t.Name())
+	d.SaveValue("/a", "before")
+
+	_, _, err := d.Transact(nil, []TxnWrite{{Key: "/a", Value: "after"}, {Key: "/b", Value: "new"}})
+	if err == nil {
+		t.Fatal("transaction committed to a failing store")
+	}
+	if value, version, _ := d.GetValueWithVersion("/a"); value != `"before"` || version != 1 {
+		t.Errorf("/a changed to %s at version %d", value, version)
+	}
+	if d.HasValue("/b") {
+		t.Error("/b written by a failed transaction")
+	}
+}
+
+func TestTransactValidation(t *testing.T) {
+	b := newTestBroker(t)
+	for name, txn := range map[string]struct {
+		checks []TxnCheck
+		ops    []TxnOp
+	}{
+		"no operations":    {nil, nil},
+		"empty check":      {[]TxnCheck{{Key: "/a"}}, []TxnOp{{Op: TxnPut, Key: "/a"}}},
+		"negative version": {[]TxnCheck{{Key: "/a", Version: int64Ptr(-1)}}, []TxnOp{{Op: TxnPut, Key: "/a"}}},
+		"written twice":    {nil, []TxnOp{{Op: TxnPut, Key: "/a"}, {Op: TxnDelete, Key: "/a"}}},
+		"unknown op":       {nil, []TxnOp{{Op: "incr", Key: "/a"}}},
+		"negative ttl":     {nil, []TxnOp{{Op: TxnPut, Key: "/a", TTL: -1}}},
+		"missing key":      {nil, []TxnOp{{Op: TxnPut}}},
+	} {
+		if _, err := b.Transact(txn.checks, txn.ops, "test", "127.0.0.1", 1); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+func TestTransactListsSubscribers(t *testing.T) {
+	b := newTestBroker(t)
+	b.Subscribe("/a", "c1", "127.0.0.1")
+	if _, err := b.Transact(nil, []TxnOp{{Op: TxnPut, Key: "/a", Value: "1"}}, "test", "127.0.0.1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := b.GetValue("/a"); !stored.Subscribers["c1"] {
+		t.Errorf("value put by a transaction lists subscribers %v, want c1", stored.Subscribers)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"time"
+)
+
+// notifyChange wakes every watcher. Caller holds d.mu.
+func (d *Database) notifyChange() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// WatchValue waits until key is at another version than since, or ctx is
+// done. It returns the key's current value and version, where version 0
+// means the key doesn't exist, and whether it changed.
+func (d *Database) WatchValue(ctx context.Context, key string, since int64) (string, int64, bool) {
+	for {
+		d.mu.RLock()
+		value, exists := d.values[key]
+		version := d.versions[key]
+		if !exists || d.isExpired(key, time.Now().Unix()) {
+			value, version = "", 0
+		}
+		changed := d.changed
+		d.mu.RUnlock()
+
+		if version != since {
+			return value, version, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return value, version, false
+		case <-changed:
+		}
+	}
+}
+
+// WatchKeys waits until a key matching re is written after the write
+// sequence number since, or ctx is done. It returns the matching keys
+// written since then and the current sequence number to watch from next.
+// A since of 0, or one from before a restart, watches from now.
+func (d *Database) WatchKeys(ctx context.Context, re *regexp.Regexp, since int64) (map[string]StoredValue, int64) {
+	d.mu.RLock()
+	if since <= 0 || since > d.writeSeq {
+		since = d.writeSeq
+	}
+	d.mu.RUnlock()
+
+	for {
+		d.mu.RLock()
+		now := time.Now().Unix()
+		rows := make(map[string]StoredValue)
+		for key, seq := range d.writeSeqs {
+			if seq > since && re.MatchString(key) && !d.isExpired(key, now) {
+				rows[key] = StoredValue{Value: d.values[key], Version: d.versions[key]}
+			}
+		}
+		seq := d.writeSeq
+		changed := d.changed
+		d.mu.RUnlock()
+
+		if len(rows) > 0 {
+			return rows, seq
+		}
+
+		select {
+		case <-ctx.Done():
+			return rows, seq
+		case <-changed:
+		}
+	}
+}
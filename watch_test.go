@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchValue(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/k", "one", "", "test", 1)
+
+	msg, version, changed, err := b.WatchValue(context.Background(), "/k", 0)
+	if err != nil || !changed || version != 1 || msg.Message != "one" {
+		t.Fatalf("watch from version 0 got %+v at %d, %v, %v", msg, version, changed, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.PutValue("/k", "two", "", "test", 2)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, version, changed, _ = b.WatchValue(ctx, "/k", 1)
+	if !changed || version != 2 || msg.Message != "two" {
+		t.Errorf("watch got %+v at %d, %v, want the second write", msg, version, changed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, version, changed, _ := b.WatchValue(ctx, "/k", 2); changed || version != 2 {
+		t.Errorf("watch without a write returned version %d, changed %v", version, changed)
+	}
+}
+
+func TestWatchValueSeesDeleteAndRecreate(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/k", "one", "", "test", 1)
+
+	// Removed and written again before the watcher looks
+	b.DeleteValue("/k", "test", false)
+	b.PutValue("/k", "again", "", "test", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	msg, version, changed, _ := b.WatchValue(ctx, "/k", 1)
+	if !changed || version != 2 || msg.Message != "again" {
+		t.Errorf("watch got %+v at %d, %v, want the re-created value", msg, version, changed)
+	}
+
+	b.DeleteValue("/k", "test", false)
+	msg, version, changed, _ = b.WatchValue(context.Background(), "/k", 2)
+	if !changed || version != 0 || msg != nil {
+		t.Errorf("watch got %+v at %d, %v, want the delete", msg, version, changed)
+	}
+}
+
+func TestWatchValuesByRegex(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/sensors/old", "0", "", "test", 1)
+
+	// A first watch without a sequence number only waits for new writes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	values, seq, err := b.WatchValuesByRegex(ctx, "^/sensors/", 0)
+	if err != nil || len(values) != 0 {
+		t.Fatalf("first watch got %v, %v", values, err)
+	}
+
+	b.PutValue("/other", "1", "", "test", 2)
+	b.PutValue("/sensors/a", "1", "", "test", 2)
+	values, next, _ := b.WatchValuesByRegex(context.Background(), "^/sensors/", seq)
+	if len(values) != 1 || values["/sensors/a"] == nil || next <= seq {
+		t.Errorf("watch got %v with sequence %d after %d", values, next, seq)
+	}
+
+	if _, _, err := b.WatchValuesByRegex(context.Background(), "(", 0); err == nil {
+		t.Error("invalid regex accepted")
+	}
+}
+
+func TestWatchersCapped(t *testing.T) {
+	b := newTestBroker(t)
+	b.PutValue("/k", "one", "", "test", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	for i := 0; i < maxWatchers; i++ {
+		go func() {
+			b.WatchValue(ctx, "/k", 1)
+			done <- struct{}{}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b.mu.RLock()
+		waiting := b.watchers
+		b.mu.RUnlock()
+		if waiting == maxWatchers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d watches waiting, want %d", waiting, maxWatchers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, _, _, err := b.WatchValue(ctx, "/k", 1); err != errTooManyWatchers {
+		t.Errorf("watch over the cap got %v", err)
+	}
+	if _, _, err := b.WatchValuesByRegex(ctx, "^/k", 1); err != errTooManyWatchers {
+		t.Errorf("regex watch over the cap got %v", err)
+	}
+
+	cancel()
+	for i := 0; i < maxWatchers; i++ {
+		<-done
+	}
+	if _, _, _, err := b.WatchValue(context.Background(), "/k", 0); err != nil {
+		t.Errorf("watch after the others ended got %v", err)
+	}
+}
+
+func TestCancelOnClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cancelOnClose(server, cancel)
+	client.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("wait not cancelled when the client closed the connection")
+	}
+}